@@ -0,0 +1,44 @@
+#!/bin/sh
+
+# Copyright 2019 The Kubernetes Authors.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# Starts HAProxy and reloads it each time kube-keepalived-vip writes the
+# configuration file. The listening sockets are transferred to the new
+# process using the admin socket (-x), so no connections are refused.
+
+CFG=/etc/haproxy/haproxy.cfg
+PIDFILE=/var/run/haproxy.pid
+SOCKET=/tmp/haproxy
+
+# the configuration is written by kube-keepalived-vip
+while [ ! -s "$CFG" ]; do
+  sleep 1
+done
+
+haproxy -f "$CFG" -p "$PIDFILE" -D
+
+# the events received during a reload are queued by inotifywait
+inotifywait -m -q -e close_write "$CFG" | while read event; do
+  if ! haproxy -c -q -f "$CFG"; then
+    echo "invalid HAProxy configuration, keeping the running process"
+    continue
+  fi
+
+  if [ -S "$SOCKET" ]; then
+    haproxy -f "$CFG" -p "$PIDFILE" -D -x "$SOCKET" -sf $(cat "$PIDFILE")
+  else
+    haproxy -f "$CFG" -p "$PIDFILE" -D -sf $(cat "$PIDFILE")
+  fi
+done
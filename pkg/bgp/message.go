@@ -0,0 +1,380 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// BGP message types (RFC 4271)
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+)
+
+// path attribute types
+const (
+	attrOrigin        = 1
+	attrASPath        = 2
+	attrNextHop       = 3
+	attrLocalPref     = 5
+	attrCommunities   = 8
+	attrMPReachNLRI   = 14
+	attrMPUnreachNLRI = 15
+)
+
+// path attribute flags
+const (
+	flagOptional   = 0x80
+	flagTransitive = 0x40
+	flagExtended   = 0x10
+)
+
+const (
+	headerLen  = 19
+	maxMsgLen  = 4096
+	bgpVersion = 4
+
+	afiIPv4     = 1
+	afiIPv6     = 2
+	safiUnicast = 1
+
+	capMultiprotocol = 1
+	capFourOctetAS   = 65
+
+	// asTrans is used in the OPEN message when the ASN does not fit in two octets (RFC 6793)
+	asTrans = 23456
+
+	asSequence = 2
+	originIGP  = 0
+)
+
+// NOTIFICATION error codes and the subcodes of OPEN message errors
+const (
+	errOpenMessage = 2
+
+	errUnsupportedVersion   = 1
+	errBadPeerAS            = 2
+	errUnacceptableHoldTime = 6
+)
+
+// errMessageTooLong is returned when a message exceeds maxMsgLen
+var errMessageTooLong = errors.New("BGP message exceeds the maximum length")
+
+// openError is an error in the OPEN message of the peer, notified using
+// the subcode
+type openError struct {
+	subcode uint8
+	msg     string
+}
+
+func (e *openError) Error() string {
+	return e.msg
+}
+
+// message is a decoded BGP message
+type message struct {
+	Type uint8
+	Body []byte
+}
+
+// openMessage contains the fields of a BGP OPEN message used by the speaker
+type openMessage struct {
+	ASN      uint32
+	HoldTime uint16
+	RouterID net.IP
+	// FourOctetAS is true if the peer supports four octet AS numbers
+	FourOctetAS bool
+}
+
+// encodeMessage returns a BGP message with the header. Messages longer than
+// maxMsgLen return errMessageTooLong.
+func encodeMessage(msgType uint8, body []byte) ([]byte, error) {
+	if headerLen+len(body) > maxMsgLen {
+		return nil, errMessageTooLong
+	}
+
+	buf := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		buf[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(buf[16:18], uint16(headerLen+len(body)))
+	buf[18] = msgType
+	return append(buf, body...), nil
+}
+
+// readMessage reads one BGP message from r
+func readMessage(r io.Reader) (*message, error) {
+	header := make([]byte, headerLen)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < 16; i++ {
+		if header[i] != 0xff {
+			return nil, fmt.Errorf("invalid BGP message marker")
+		}
+	}
+
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < headerLen || length > maxMsgLen {
+		return nil, fmt.Errorf("invalid BGP message length %v", length)
+	}
+
+	body := make([]byte, length-headerLen)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &message{Type: header[18], Body: body}, nil
+}
+
+// encodeOpen returns an OPEN message announcing support for IPv4 and IPv6
+// unicast and four octet AS numbers
+func encodeOpen(asn uint32, holdTime uint16, routerID net.IP) []byte {
+	caps := &bytes.Buffer{}
+	for _, afi := range []uint16{afiIPv4, afiIPv6} {
+		caps.Write([]byte{capMultiprotocol, 4})
+		binary.Write(caps, binary.BigEndian, afi)
+		caps.Write([]byte{0, safiUnicast})
+	}
+	caps.Write([]byte{capFourOctetAS, 4})
+	binary.Write(caps, binary.BigEndian, asn)
+
+	myAS := uint16(asTrans)
+	if asn <= 0xffff {
+		myAS = uint16(asn)
+	}
+
+	body := &bytes.Buffer{}
+	body.WriteByte(bgpVersion)
+	binary.Write(body, binary.BigEndian, myAS)
+	binary.Write(body, binary.BigEndian, holdTime)
+	body.Write(routerID.To4())
+	// optional parameter of type 2 (capabilities)
+	body.WriteByte(byte(caps.Len() + 2))
+	body.Write([]byte{2, byte(caps.Len())})
+	body.Write(caps.Bytes())
+
+	// the capabilities are fixed, the message is always shorter than maxMsgLen
+	msg, _ := encodeMessage(msgOpen, body.Bytes())
+	return msg
+}
+
+// decodeOpen decodes the body of an OPEN message
+func decodeOpen(body []byte) (*openMessage, error) {
+	if len(body) < 10 {
+		return nil, fmt.Errorf("OPEN message too short")
+	}
+
+	if body[0] != bgpVersion {
+		return nil, &openError{errUnsupportedVersion, fmt.Sprintf("unsupported BGP version %v", body[0])}
+	}
+
+	open := &openMessage{
+		ASN:      uint32(binary.BigEndian.Uint16(body[1:3])),
+		HoldTime: binary.BigEndian.Uint16(body[3:5]),
+		RouterID: net.IP(body[5:9]),
+	}
+
+	// the hold time must be zero or at least three seconds (RFC 4271)
+	if open.HoldTime == 1 || open.HoldTime == 2 {
+		return nil, &openError{errUnacceptableHoldTime, fmt.Sprintf("unacceptable hold time %v", open.HoldTime)}
+	}
+
+	params := body[10:]
+	if len(params) != int(body[9]) {
+		return nil, fmt.Errorf("invalid OPEN optional parameters length")
+	}
+
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return nil, fmt.Errorf("invalid OPEN optional parameter")
+		}
+
+		if paramType == 2 {
+			caps := params[2 : 2+paramLen]
+			for len(caps) >= 2 {
+				capCode, capLen := caps[0], int(caps[1])
+				if len(caps) < 2+capLen {
+					return nil, fmt.Errorf("invalid OPEN capability")
+				}
+
+				if capCode == capFourOctetAS && capLen == 4 {
+					open.FourOctetAS = true
+					open.ASN = binary.BigEndian.Uint32(caps[2:6])
+				}
+				caps = caps[2+capLen:]
+			}
+		}
+
+		params = params[2+paramLen:]
+	}
+
+	return open, nil
+}
+
+// encodeNotification returns a NOTIFICATION message
+func encodeNotification(code, subcode uint8) []byte {
+	msg, _ := encodeMessage(msgNotification, []byte{code, subcode})
+	return msg
+}
+
+// encodeKeepalive returns a KEEPALIVE message
+func encodeKeepalive() []byte {
+	msg, _ := encodeMessage(msgKeepalive, nil)
+	return msg
+}
+
+// pathAttributes contains the attributes of the routes announced by the speaker
+type pathAttributes struct {
+	// LocalASN is the AS of the speaker, prepended to the AS_PATH in eBGP sessions
+	LocalASN uint32
+	EBGP     bool
+	// FourOctetAS is true if the AS numbers are encoded using four octets
+	FourOctetAS bool
+	NextHop     net.IP
+	Communities []uint32
+}
+
+func appendAttribute(buf *bytes.Buffer, flags, attrType uint8, value []byte) {
+	if len(value) > 255 {
+		buf.Write([]byte{flags | flagExtended, attrType})
+		binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	} else {
+		buf.Write([]byte{flags, attrType, byte(len(value))})
+	}
+	buf.Write(value)
+}
+
+// encodePrefix encodes a prefix using the NLRI format (length in bits and
+// the minimum number of octets of the address)
+func encodePrefix(buf *bytes.Buffer, prefix *net.IPNet) {
+	ones, _ := prefix.Mask.Size()
+	ip := prefix.IP.To4()
+	if ip == nil {
+		ip = prefix.IP.To16()
+	}
+	buf.WriteByte(byte(ones))
+	buf.Write(ip[:(ones+7)/8])
+}
+
+// commonAttributes returns ORIGIN, AS_PATH, LOCAL_PREF (iBGP) and COMMUNITIES
+func (attrs pathAttributes) commonAttributes(buf *bytes.Buffer) {
+	appendAttribute(buf, flagTransitive, attrOrigin, []byte{originIGP})
+
+	asPath := &bytes.Buffer{}
+	if attrs.EBGP {
+		asPath.Write([]byte{asSequence, 1})
+		if attrs.FourOctetAS {
+			binary.Write(asPath, binary.BigEndian, attrs.LocalASN)
+		} else {
+			binary.Write(asPath, binary.BigEndian, uint16(attrs.LocalASN))
+		}
+	}
+	appendAttribute(buf, flagTransitive, attrASPath, asPath.Bytes())
+
+	if !attrs.EBGP {
+		localPref := make([]byte, 4)
+		binary.BigEndian.PutUint32(localPref, 100)
+		appendAttribute(buf, flagTransitive, attrLocalPref, localPref)
+	}
+
+	if len(attrs.Communities) > 0 {
+		communities := &bytes.Buffer{}
+		for _, community := range attrs.Communities {
+			binary.Write(communities, binary.BigEndian, community)
+		}
+		appendAttribute(buf, flagOptional|flagTransitive, attrCommunities, communities.Bytes())
+	}
+}
+
+// encodeUpdateIPv4 returns an UPDATE message announcing and withdrawing IPv4 prefixes
+func encodeUpdateIPv4(attrs pathAttributes, announce, withdraw []*net.IPNet) ([]byte, error) {
+	withdrawn := &bytes.Buffer{}
+	for _, prefix := range withdraw {
+		encodePrefix(withdrawn, prefix)
+	}
+
+	pathAttrs := &bytes.Buffer{}
+	nlri := &bytes.Buffer{}
+	if len(announce) > 0 {
+		attrs.commonAttributes(pathAttrs)
+		appendAttribute(pathAttrs, flagTransitive, attrNextHop, attrs.NextHop.To4())
+
+		for _, prefix := range announce {
+			encodePrefix(nlri, prefix)
+		}
+	}
+
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, uint16(withdrawn.Len()))
+	body.Write(withdrawn.Bytes())
+	binary.Write(body, binary.BigEndian, uint16(pathAttrs.Len()))
+	body.Write(pathAttrs.Bytes())
+	body.Write(nlri.Bytes())
+
+	return encodeMessage(msgUpdate, body.Bytes())
+}
+
+// encodeUpdateIPv6 returns an UPDATE message announcing and withdrawing
+// IPv6 prefixes using the multiprotocol extensions (RFC 4760)
+func encodeUpdateIPv6(attrs pathAttributes, announce, withdraw []*net.IPNet) ([]byte, error) {
+	pathAttrs := &bytes.Buffer{}
+
+	if len(withdraw) > 0 {
+		unreach := &bytes.Buffer{}
+		binary.Write(unreach, binary.BigEndian, uint16(afiIPv6))
+		unreach.WriteByte(safiUnicast)
+		for _, prefix := range withdraw {
+			encodePrefix(unreach, prefix)
+		}
+		appendAttribute(pathAttrs, flagOptional, attrMPUnreachNLRI, unreach.Bytes())
+	}
+
+	if len(announce) > 0 {
+		attrs.commonAttributes(pathAttrs)
+
+		reach := &bytes.Buffer{}
+		binary.Write(reach, binary.BigEndian, uint16(afiIPv6))
+		reach.WriteByte(safiUnicast)
+		reach.WriteByte(net.IPv6len)
+		reach.Write(attrs.NextHop.To16())
+		reach.WriteByte(0)
+		for _, prefix := range announce {
+			encodePrefix(reach, prefix)
+		}
+		appendAttribute(pathAttrs, flagOptional, attrMPReachNLRI, reach.Bytes())
+	}
+
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, uint16(0))
+	binary.Write(body, binary.BigEndian, uint16(pathAttrs.Len()))
+	body.Write(pathAttrs.Bytes())
+
+	return encodeMessage(msgUpdate, body.Bytes())
+}
@@ -0,0 +1,306 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return prefix
+}
+
+func TestOpen(t *testing.T) {
+	testcases := []struct {
+		asn      uint32
+		expected uint16
+	}{
+		{65000, 65000},
+		{4200000000, asTrans},
+	}
+
+	for _, tc := range testcases {
+		b := encodeOpen(tc.asn, 90, net.ParseIP("10.0.0.1"))
+
+		msg, err := readMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if msg.Type != msgOpen {
+			t.Fatalf("expected OPEN message but returned %v", msg.Type)
+		}
+
+		if as := uint16(msg.Body[1])<<8 | uint16(msg.Body[2]); as != tc.expected {
+			t.Errorf("expected AS %v in the header but returned %v", tc.expected, as)
+		}
+
+		open, err := decodeOpen(msg.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if open.ASN != tc.asn || open.HoldTime != 90 || !open.FourOctetAS ||
+			!open.RouterID.Equal(net.ParseIP("10.0.0.1")) {
+			t.Errorf("unexpected OPEN message: %+v", open)
+		}
+	}
+}
+
+func TestDecodeOpenHoldTime(t *testing.T) {
+	testcases := map[uint16]bool{0: true, 1: false, 2: false, 3: true, 90: true}
+
+	for holdTime, valid := range testcases {
+		b := encodeOpen(65000, holdTime, net.ParseIP("10.0.0.1"))
+		msg, err := readMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		_, err = decodeOpen(msg.Body)
+		if valid {
+			if err != nil {
+				t.Errorf("hold time %v: unexpected error: %v", holdTime, err)
+			}
+			continue
+		}
+
+		oe, ok := err.(*openError)
+		if !ok || oe.subcode != errUnacceptableHoldTime {
+			t.Errorf("hold time %v: expected an unacceptable hold time error but returned %v", holdTime, err)
+		}
+	}
+}
+
+func TestEncodeMessageTooLong(t *testing.T) {
+	if _, err := encodeMessage(msgUpdate, make([]byte, maxMsgLen-headerLen)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := encodeMessage(msgUpdate, make([]byte, maxMsgLen-headerLen+1)); err != errMessageTooLong {
+		t.Errorf("expected %v but returned %v", errMessageTooLong, err)
+	}
+}
+
+func TestEncodeUpdates(t *testing.T) {
+	testcases := map[string]struct {
+		encode  updateEncoder
+		nextHop string
+		prefix  string
+	}{
+		"IPv4": {encodeUpdateIPv4, "10.0.0.1", "10.%v.%v.%v/32"},
+		"IPv6": {encodeUpdateIPv6, "fd00::1", "fd00::%v:%v:%v/128"},
+	}
+
+	for name, tc := range testcases {
+		attrs := pathAttributes{
+			LocalASN:    65000,
+			NextHop:     net.ParseIP(tc.nextHop),
+			Communities: []uint32{65000<<16 | 100},
+		}
+
+		announce := []*net.IPNet{}
+		withdraw := []*net.IPNet{}
+		for i := 0; i < 2000; i++ {
+			announce = append(announce, mustParseCIDR(t, fmt.Sprintf(tc.prefix, 4, i/256, i%256)))
+			withdraw = append(withdraw, mustParseCIDR(t, fmt.Sprintf(tc.prefix, 5, i/256, i%256)))
+		}
+
+		msgs, err := encodeUpdates(attrs, announce, withdraw, tc.encode)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+
+		if len(msgs) < 2 {
+			t.Errorf("%v: expected several messages but returned %v", name, len(msgs))
+		}
+
+		for _, msg := range msgs {
+			if len(msg) > maxMsgLen {
+				t.Errorf("%v: message of %v bytes exceeds %v", name, len(msg), maxMsgLen)
+			}
+			if _, err := readMessage(bytes.NewReader(msg)); err != nil {
+				t.Errorf("%v: unexpected error: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestReadMessageInvalid(t *testing.T) {
+	b := encodeKeepalive()
+	b[0] = 0
+
+	_, err := readMessage(bytes.NewReader(b))
+	if err == nil {
+		t.Errorf("expected an error with an invalid marker")
+	}
+}
+
+func TestEncodeUpdateIPv4(t *testing.T) {
+	attrs := pathAttributes{
+		LocalASN:    65000,
+		EBGP:        true,
+		FourOctetAS: true,
+		NextHop:     net.ParseIP("10.0.0.1"),
+		Communities: []uint32{65000<<16 | 100},
+	}
+
+	b, err := encodeUpdateIPv4(attrs,
+		[]*net.IPNet{mustParseCIDR(t, "10.4.0.50/32")},
+		[]*net.IPNet{mustParseCIDR(t, "10.4.0.51/32")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msg, err := readMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []byte{
+		// withdrawn routes
+		0, 5, 32, 10, 4, 0, 51,
+		// path attributes length
+		0, 27,
+		// ORIGIN IGP
+		0x40, attrOrigin, 1, 0,
+		// AS_PATH with one AS_SEQUENCE
+		0x40, attrASPath, 6, asSequence, 1, 0, 0, 0xfd, 0xe8,
+		// COMMUNITIES 65000:100
+		0xc0, attrCommunities, 4, 0xfd, 0xe8, 0, 100,
+		// NEXT_HOP
+		0x40, attrNextHop, 4, 10, 0, 0, 1,
+		// NLRI
+		32, 10, 4, 0, 50,
+	}
+
+	if !bytes.Equal(msg.Body, expected) {
+		t.Errorf("expected\n%v\nbut returned\n%v", expected, msg.Body)
+	}
+}
+
+func TestEncodeUpdateIPv4Withdraw(t *testing.T) {
+	b, err := encodeUpdateIPv4(pathAttributes{}, nil, []*net.IPNet{mustParseCIDR(t, "10.4.0.51/32")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msg, err := readMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []byte{0, 5, 32, 10, 4, 0, 51, 0, 0}
+	if !bytes.Equal(msg.Body, expected) {
+		t.Errorf("expected %v but returned %v", expected, msg.Body)
+	}
+}
+
+func TestEncodeUpdateIPv6(t *testing.T) {
+	attrs := pathAttributes{
+		LocalASN: 65000,
+		NextHop:  net.ParseIP("fd00::1"),
+	}
+
+	b, err := encodeUpdateIPv6(attrs, []*net.IPNet{mustParseCIDR(t, "fd00::10/128")}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msg, err := readMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body := msg.Body
+	if body[0] != 0 || body[1] != 0 {
+		t.Fatalf("expected no withdrawn routes")
+	}
+
+	reach := []byte{
+		0x80, attrMPReachNLRI, 38,
+		0, afiIPv6, safiUnicast, 16,
+		0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0,
+		128, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x10,
+	}
+	if !bytes.HasSuffix(body, reach) {
+		t.Errorf("expected MP_REACH_NLRI %v in %v", reach, body)
+	}
+
+	// iBGP sessions use an empty AS_PATH and LOCAL_PREF
+	localPref := []byte{0x40, attrLocalPref, 4, 0, 0, 0, 100}
+	if !bytes.Contains(body, localPref) {
+		t.Errorf("expected LOCAL_PREF %v in %v", localPref, body)
+	}
+}
+
+func TestParsePeer(t *testing.T) {
+	testcases := []struct {
+		input    string
+		expected Peer
+		err      bool
+	}{
+		{"10.0.0.1:64512", Peer{Address: "10.0.0.1", Port: 179, ASN: 64512}, false},
+		{"[fd00::1]:4200000000", Peer{Address: "fd00::1", Port: 179, ASN: 4200000000}, false},
+		{"10.0.0.1", Peer{}, true},
+		{"router:64512", Peer{}, true},
+		{"10.0.0.1:0", Peer{}, true},
+	}
+
+	for _, tc := range testcases {
+		peer, err := ParsePeer(tc.input)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", tc.input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.input, err)
+			continue
+		}
+
+		if peer != tc.expected {
+			t.Errorf("%v: expected %v but returned %v", tc.input, tc.expected, peer)
+		}
+	}
+}
+
+func TestParseCommunity(t *testing.T) {
+	c, err := ParseCommunity("65000:100")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c != 65000<<16|100 {
+		t.Errorf("unexpected community %v", c)
+	}
+
+	for _, input := range []string{"65000", "70000:1", "1:a"} {
+		if _, err := ParseCommunity(input); err == nil {
+			t.Errorf("%v: expected an error", input)
+		}
+	}
+}
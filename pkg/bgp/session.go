@@ -0,0 +1,335 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// session is a BGP session with a peer
+type session struct {
+	speaker *Speaker
+	peer    Peer
+	conn    net.Conn
+
+	mu          sync.Mutex
+	established bool
+	attrs       pathAttributes
+	// announced contains the prefixes announced to the peer
+	announced map[string]*net.IPNet
+
+	// changed receives a value when the prefixes of the speaker change
+	changed chan struct{}
+}
+
+func newSession(speaker *Speaker, peer Peer, conn net.Conn) *session {
+	return &session{
+		speaker:   speaker,
+		peer:      peer,
+		conn:      conn,
+		announced: map[string]*net.IPNet{},
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+func (s *session) isEstablished() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.established
+}
+
+func (s *session) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// close sends a NOTIFICATION message and closes the connection
+func (s *session) close(code, subcode uint8) {
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	s.conn.Write(encodeNotification(code, subcode))
+	s.conn.Close()
+}
+
+func (s *session) write(msg []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+// run opens the session and announces the prefixes until the connection is closed
+func (s *session) run() error {
+	defer s.conn.Close()
+
+	cfg := s.speaker.cfg
+	holdTime := uint16(cfg.HoldTime / time.Second)
+
+	err := s.write(encodeOpen(cfg.ASN, holdTime, cfg.RouterID))
+	if err != nil {
+		return err
+	}
+
+	s.conn.SetReadDeadline(time.Now().Add(openHoldTime))
+	msg, err := readMessage(s.conn)
+	if err != nil {
+		return err
+	}
+
+	if msg.Type != msgOpen {
+		s.close(5, 0)
+		return fmt.Errorf("expected OPEN message but received type %v", msg.Type)
+	}
+
+	open, err := decodeOpen(msg.Body)
+	if err != nil {
+		var subcode uint8
+		if oe, ok := err.(*openError); ok {
+			subcode = oe.subcode
+		}
+		s.close(errOpenMessage, subcode)
+		return err
+	}
+
+	if open.ASN != s.peer.ASN {
+		s.close(errOpenMessage, errBadPeerAS)
+		return fmt.Errorf("expected ASN %v but peer uses %v", s.peer.ASN, open.ASN)
+	}
+
+	if !open.FourOctetAS && cfg.ASN > 0xffff {
+		s.close(errOpenMessage, errBadPeerAS)
+		return fmt.Errorf("peer does not support four octet AS numbers")
+	}
+
+	// the hold time is the smaller of the two (zero disables keepalives)
+	if open.HoldTime < holdTime {
+		holdTime = open.HoldTime
+	}
+
+	s.attrs = pathAttributes{
+		LocalASN:    cfg.ASN,
+		EBGP:        cfg.ASN != s.peer.ASN,
+		FourOctetAS: open.FourOctetAS,
+		Communities: cfg.Communities,
+	}
+
+	err = s.write(encodeKeepalive())
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	received := make(chan *message)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if holdTime > 0 {
+				s.conn.SetReadDeadline(time.Now().Add(time.Duration(holdTime) * time.Second))
+			} else {
+				s.conn.SetReadDeadline(time.Time{})
+			}
+
+			msg, err := readMessage(s.conn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+
+			select {
+			case received <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	keepalive := time.Duration(holdTime) * time.Second / 3
+	if keepalive == 0 {
+		keepalive = time.Hour
+	}
+	ticker := time.NewTicker(keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.speaker.stopCh:
+			s.close(6, 2)
+			return nil
+		case err := <-readErr:
+			return err
+		case msg := <-received:
+			switch msg.Type {
+			case msgKeepalive:
+				if !s.isEstablished() {
+					glog.Infof("BGP session with %v established", s.peer)
+					s.mu.Lock()
+					s.established = true
+					s.mu.Unlock()
+					s.notify()
+				}
+			case msgNotification:
+				return fmt.Errorf("received NOTIFICATION %v", msg.Body)
+			case msgUpdate:
+				// routes announced by the peer are ignored
+			default:
+				s.close(1, 3)
+				return fmt.Errorf("unexpected message type %v", msg.Type)
+			}
+		case <-s.changed:
+			if !s.isEstablished() {
+				continue
+			}
+
+			err := s.sync()
+			if err != nil {
+				return err
+			}
+		case <-ticker.C:
+			err := s.write(encodeKeepalive())
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sync sends the UPDATE messages required to announce the current prefixes
+// of the speaker and withdraw the ones that were removed
+func (s *session) sync() error {
+	prefixes := s.speaker.currentPrefixes()
+
+	var announce4, announce6, withdraw4, withdraw6 []*net.IPNet
+	for key, prefix := range prefixes {
+		if _, ok := s.announced[key]; ok {
+			continue
+		}
+
+		if prefix.IP.To4() != nil {
+			announce4 = append(announce4, prefix)
+		} else {
+			announce6 = append(announce6, prefix)
+		}
+	}
+
+	for key, prefix := range s.announced {
+		if _, ok := prefixes[key]; ok {
+			continue
+		}
+
+		if prefix.IP.To4() != nil {
+			withdraw4 = append(withdraw4, prefix)
+		} else {
+			withdraw6 = append(withdraw6, prefix)
+		}
+	}
+
+	cfg := s.speaker.cfg
+
+	if cfg.NextHop == nil && len(announce4) > 0 {
+		glog.Warningf("no IPv4 next hop, IPv4 routes are not announced to %v", s.peer)
+		announce4 = nil
+	}
+
+	attrs := s.attrs
+	attrs.NextHop = cfg.NextHop
+	err := s.sendUpdates(attrs, announce4, withdraw4, encodeUpdateIPv4)
+	if err != nil {
+		return err
+	}
+
+	if cfg.NextHopIPv6 == nil && len(announce6) > 0 {
+		glog.Warningf("no IPv6 next hop, IPv6 routes are not announced to %v", s.peer)
+		announce6 = nil
+	}
+
+	attrs.NextHop = cfg.NextHopIPv6
+	err = s.sendUpdates(attrs, announce6, withdraw6, encodeUpdateIPv6)
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range append(withdraw4, withdraw6...) {
+		glog.Infof("BGP withdraw %v to %v", prefix, s.peer)
+		delete(s.announced, prefix.String())
+	}
+
+	for _, prefix := range append(announce4, announce6...) {
+		glog.Infof("BGP announce %v to %v", prefix, s.peer)
+		s.announced[prefix.String()] = prefix
+	}
+
+	return nil
+}
+
+type updateEncoder func(attrs pathAttributes, announce, withdraw []*net.IPNet) ([]byte, error)
+
+func (s *session) sendUpdates(attrs pathAttributes, announce, withdraw []*net.IPNet, encode updateEncoder) error {
+	msgs, err := encodeUpdates(attrs, announce, withdraw, encode)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		err := s.write(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodeUpdates returns the UPDATE messages required to announce and
+// withdraw the prefixes. The prefixes are split in several messages when
+// they do not fit in a message of maxMsgLen.
+func encodeUpdates(attrs pathAttributes, announce, withdraw []*net.IPNet, encode updateEncoder) ([][]byte, error) {
+	msgs := [][]byte{}
+	for len(announce) > 0 || len(withdraw) > 0 {
+		a, w := announce, withdraw
+		msg, err := encode(attrs, a, w)
+		for err == errMessageTooLong {
+			// halve the longest list until the message fits
+			if len(a) >= len(w) {
+				a = a[:len(a)/2]
+			} else {
+				w = w[:len(w)/2]
+			}
+
+			if len(a) == 0 && len(w) == 0 {
+				return nil, fmt.Errorf("the path attributes do not fit in a BGP message")
+			}
+
+			msg, err = encode(attrs, a, w)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, msg)
+		announce = announce[len(a):]
+		withdraw = withdraw[len(w):]
+	}
+
+	return msgs, nil
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bgp contains a minimal BGP speaker that only announces routes.
+// Routes received from the peers are ignored.
+//
+// The controller only originates host routes of the VIPs, so the speaker
+// implements the OPEN, KEEPALIVE and UPDATE messages required for that
+// instead of embedding GoBGP, which adds a RIB, a policy engine, a gRPC API
+// and their dependencies to the binary and to the pinned Kubernetes
+// libraries of the module.
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultPort = 179
+	// connectRetry is the time to wait before retrying a failed session
+	connectRetry = 10 * time.Second
+	// openHoldTime is the time to wait for the OPEN message of the peer (RFC 4271)
+	openHoldTime = 4 * time.Minute
+)
+
+// Config contains the settings of the speaker
+type Config struct {
+	ASN      uint32
+	RouterID net.IP
+	HoldTime time.Duration
+	// NextHop is the next hop of the IPv4 routes
+	NextHop net.IP
+	// NextHopIPv6 is the next hop of the IPv6 routes. If empty IPv6
+	// routes are not announced
+	NextHopIPv6 net.IP
+	Communities []uint32
+}
+
+// Peer is a BGP neighbor
+type Peer struct {
+	Address string
+	Port    int
+	ASN     uint32
+}
+
+func (p Peer) String() string {
+	return net.JoinHostPort(p.Address, strconv.Itoa(p.Port))
+}
+
+// ParsePeer parses a peer with the format address:asn. IPv6 addresses
+// must use brackets ([fd00::1]:64512). The port 179 is used.
+func ParsePeer(input string) (Peer, error) {
+	host, asn, err := net.SplitHostPort(input)
+	if err != nil {
+		return Peer{}, fmt.Errorf("invalid BGP peer %v (address:asn): %v", input, err)
+	}
+
+	if net.ParseIP(host) == nil {
+		return Peer{}, fmt.Errorf("invalid BGP peer address %v", host)
+	}
+
+	n, err := strconv.ParseUint(asn, 10, 32)
+	if err != nil || n == 0 {
+		return Peer{}, fmt.Errorf("invalid BGP peer ASN %v", asn)
+	}
+
+	return Peer{Address: host, Port: defaultPort, ASN: uint32(n)}, nil
+}
+
+// ParseCommunity parses a community with the format AA:NN
+func ParseCommunity(input string) (uint32, error) {
+	parts := strings.Split(input, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid BGP community %v (AA:NN)", input)
+	}
+
+	high, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid BGP community %v: %v", input, err)
+	}
+
+	low, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid BGP community %v: %v", input, err)
+	}
+
+	return uint32(high<<16 | low), nil
+}
+
+// Speaker announces a set of prefixes to all the configured peers
+type Speaker struct {
+	cfg   Config
+	peers []Peer
+
+	mu       sync.Mutex
+	prefixes map[string]*net.IPNet
+	sessions map[string]*session
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewSpeaker creates a new BGP speaker
+func NewSpeaker(cfg Config, peers []Peer) *Speaker {
+	return &Speaker{
+		cfg:      cfg,
+		peers:    peers,
+		prefixes: map[string]*net.IPNet{},
+		sessions: map[string]*session{},
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Start starts a session with each peer. Sessions are retried until Stop is called.
+func (s *Speaker) Start() {
+	for _, peer := range s.peers {
+		s.wg.Add(1)
+		go s.run(peer)
+	}
+}
+
+// Stop closes the sessions. The peers withdraw the announced routes.
+func (s *Speaker) Stop() {
+	close(s.stopCh)
+
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		sess.close(6, 2)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// Announce replaces the announced prefixes
+func (s *Speaker) Announce(prefixes []*net.IPNet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prefixes = map[string]*net.IPNet{}
+	for _, prefix := range prefixes {
+		s.prefixes[prefix.String()] = prefix
+	}
+
+	for _, sess := range s.sessions {
+		sess.notify()
+	}
+}
+
+// Established returns the peers with an established session
+func (s *Speaker) Established() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := []string{}
+	for name, sess := range s.sessions {
+		if sess.isEstablished() {
+			peers = append(peers, name)
+		}
+	}
+	sort.Strings(peers)
+
+	return peers
+}
+
+func (s *Speaker) currentPrefixes() map[string]*net.IPNet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefixes := map[string]*net.IPNet{}
+	for k, v := range s.prefixes {
+		prefixes[k] = v
+	}
+	return prefixes
+}
+
+func (s *Speaker) run(peer Peer) {
+	defer s.wg.Done()
+
+	for {
+		err := s.connect(peer)
+		if err != nil {
+			glog.Warningf("BGP session with %v: %v", peer, err)
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-time.After(connectRetry):
+		}
+	}
+}
+
+func (s *Speaker) connect(peer Peer) error {
+	conn, err := net.DialTimeout("tcp", peer.String(), connectRetry)
+	if err != nil {
+		return err
+	}
+
+	sess := newSession(s, peer, conn)
+
+	s.mu.Lock()
+	select {
+	case <-s.stopCh:
+		s.mu.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	s.sessions[peer.String()] = sess
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, peer.String())
+		s.mu.Unlock()
+	}()
+
+	return sess.run()
+}
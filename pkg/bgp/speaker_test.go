@@ -0,0 +1,98 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// readType reads messages from the connection until one of the given type is found
+func readType(t *testing.T, conn net.Conn, msgType uint8) *message {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestSpeaker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	speaker := NewSpeaker(Config{
+		ASN:      65000,
+		RouterID: net.ParseIP("10.0.0.1"),
+		HoldTime: 90 * time.Second,
+		NextHop:  net.ParseIP("10.0.0.1"),
+	}, []Peer{{Address: "127.0.0.1", Port: port, ASN: 65001}})
+
+	speaker.Announce([]*net.IPNet{mustParseCIDR(t, "10.4.0.50/32")})
+	speaker.Start()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	msg := readType(t, conn, msgOpen)
+	open, err := decodeOpen(msg.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if open.ASN != 65000 {
+		t.Errorf("expected ASN 65000 but returned %v", open.ASN)
+	}
+
+	conn.Write(encodeOpen(65001, 30, net.ParseIP("10.0.0.254")))
+	conn.Write(encodeKeepalive())
+
+	msg = readType(t, conn, msgUpdate)
+	if !bytes.HasSuffix(msg.Body, []byte{32, 10, 4, 0, 50}) {
+		t.Errorf("expected announcement of 10.4.0.50/32 but returned %v", msg.Body)
+	}
+
+	if established := speaker.Established(); len(established) != 1 {
+		t.Errorf("expected one established session but returned %v", established)
+	}
+
+	speaker.Announce([]*net.IPNet{})
+	msg = readType(t, conn, msgUpdate)
+	expected := []byte{0, 5, 32, 10, 4, 0, 50, 0, 0}
+	if !bytes.Equal(msg.Body, expected) {
+		t.Errorf("expected withdrawal %v but returned %v", expected, msg.Body)
+	}
+
+	speaker.Stop()
+	msg = readType(t, conn, msgNotification)
+	if msg.Body[0] != 6 {
+		t.Errorf("expected Cease notification but returned %v", msg.Body)
+	}
+}
@@ -20,12 +20,17 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/spf13/pflag"
 
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -33,7 +38,9 @@ import (
 	"k8s.io/kubernetes/pkg/util/sysctl"
 	k8sexec "k8s.io/utils/exec"
 
+	"github.com/aledbf/kube-keepalived-vip/pkg/bgp"
 	"github.com/aledbf/kube-keepalived-vip/pkg/controller"
+	"github.com/aledbf/kube-keepalived-vip/pkg/k8s"
 )
 
 var (
@@ -47,17 +54,28 @@ var (
 	kubeConfigFile = flags.String("kubeconfig", "", "Path to kubeconfig file with authorization and master location information.")
 
 	watchNamespace = flags.String("watch-namespace", apiv1.NamespaceAll,
-		`Namespace to watch for Ingress. Default is to watch all namespaces`)
+		`Comma separated list of namespaces to watch for services. Default is to watch all namespaces`)
+
+	serviceSelector = flags.String("service-selector", "", `Label selector of the services that can be exposed.
+		Only the matching services and endpoints are watched`)
 
 	useUnicast = flags.Bool("use-unicast", false, `use unicast instead of multicast for communication
 		with other keepalived instances`)
 
 	configMapName = flags.String("services-configmap", "",
-		`Name of the ConfigMap that contains the definition of the services to expose.
+		`Comma separated list of ConfigMaps (namespace/name) that contain the definition of the services to expose.
 		The key in the map indicates the external IP to use. The value is the name of the
 		service with the format namespace/serviceName and the port of the service could be a number or the
 		name of the port.`)
 
+	configMapSelector = flags.String("services-configmap-selector", "",
+		`Label selector of other ConfigMaps, in any namespace, that contain the definition of the
+		services to expose. The VIPs of all the ConfigMaps are merged`)
+
+	configMapCrossNamespace = flags.Bool("services-configmap-cross-namespace", false,
+		`Allow the ConfigMaps selected by --services-configmap-selector to reference services and
+		TLS secrets of other namespaces. By default they can only use their own namespace`)
+
 	proxyMode = flags.Bool("proxy-protocol-mode", false, `If true, it will use keepalived to announce the virtual
 		IP address/es and HAProxy with proxy protocol to forward traffic to the endpoints.
 		Please check http://blog.haproxy.com/haproxy/proxy-protocol
@@ -85,9 +103,82 @@ var (
 	iface = flags.String("iface", "", `network interface to listen on. If undefined, the nodes
                  default interface will be used instead`)
 
+	nodeAddressPolicy = flags.String("node-address-policy", "", `Address of the nodes used as VRRP peers
+		and in the unicast adverts: InternalIP, ExternalIP, the address in a CIDR (10.0.0.0/24) or the address in an
+		annotation of the node (annotation:<key>). The address must be in the interface of --iface. Empty prefers
+		the ExternalIP over the InternalIP`)
+
+	excludeIfaces = flags.String("exclude-ifaces", strings.Join(controller.DefaultExcludedIfaces, ","),
+		`Comma separated list of patterns (like veth*) of the network interfaces never used by the controller,
+		when detecting the interface with the node IP address or the default route and finding interfaces by CIDR`)
+
 	httpPort = flags.Int("http-port", 8080, `The HTTP port to use for health checks`)
 
 	releaseVips = flags.Bool("release-vips", true, `add --release-vips to keepalived args`)
+
+	webhookPort = flags.Int("webhook-port", 0, `The HTTPS port used by the validating admission webhook
+		of the services ConfigMap. Zero disables the webhook`)
+
+	webhookCertFile = flags.String("webhook-cert-file", "/etc/webhook/tls.crt", `Path to the TLS certificate
+		used by the validating admission webhook`)
+
+	webhookKeyFile = flags.String("webhook-key-file", "/etc/webhook/tls.key", `Path to the TLS private key
+		used by the validating admission webhook`)
+
+	vrrpAuthSecret = flags.String("vrrp-auth-secret", "", `Name of the secret (namespace/name) that contains
+		the VRRP passwords. The key in the secret is the name of the VRRP instance (vips).
+		Enabling authentication switches keepalived to VRRP version 2`)
+
+	vrrpSourceFilter = flags.Bool("vrrp-source-filter", false, `Drop the VRRP adverts received in the interface
+		of keepalived from addresses that are not nodes of the cluster. The addresses are updated when nodes
+		are added or removed`)
+
+	vrrpConfigMap = flags.String("vrrp-configmap", "", `Name of the ConfigMap (namespace/name) with the settings
+		of the VRRP instances (gratuitous ARP and adverts). The key is the name of the VRRP instance (vips)`)
+
+	ipPoolsConfigMap = flags.String("ip-pools-configmap", "", `Name of the ConfigMap (namespace/name) with the pools
+		of VIPs. When it is set the VIPs must be part of a pool, and entries with a name instead of an address get
+		a VIP from a pool. The allocations are recorded in the ConfigMap <name>-allocations`)
+
+	splitBrainDetection = flags.Bool("split-brain-detection", false, `Publish the VRRP state of the node in a Lease
+		and report VIPs held by more than one node in /health, /metrics and events`)
+
+	splitBrainStepDown = flags.Bool("split-brain-step-down", false, `Force the FAULT state in the node with
+		lower priority when more than one node holds the same VIP (requires --split-brain-detection)`)
+
+	localityPriority = flags.Bool("locality-priority", false, `Raise the VRRP priority of the node by the
+		number of endpoints of the VIPs running in the node (up to 50)`)
+
+	nodeMaintenance = flags.String("node-maintenance", "", `Move the VIPs to other nodes when the node is cordoned,
+		not ready or has the annotation kube-keepalived-vip/maintenance=true. The value fault forces the
+		FAULT state of the VRRP instance and priority lowers its priority (requires preempt). Empty disables it`)
+
+	handoffTimeout = flags.Duration("handoff-timeout", 10*time.Second, `Maximum time to wait during the shutdown
+		for other node to become MASTER before removing the VIPs`)
+
+	duplicateAddressDetection = flags.Bool("duplicate-address-detection", true, `Probe the VIPs in the interface
+		(ARP probes for IPv4 and neighbor solicitations for IPv6) before announcing them the first time. VIPs
+		used by other hosts are not announced and probed again every 30 seconds`)
+
+	announceMode = flags.String("announce-mode", "vrrp", `Protocol used to announce the VIPs: vrrp, bgp or lease.
+		In bgp mode every node with endpoints announces the VIPs as /32 (or /128) routes.
+		In lease mode the node holding a Kubernetes Lease of each VIP configures the address`)
+
+	bgpASN = flags.Uint32("bgp-asn", 0, `The AS number used by the BGP speaker`)
+
+	bgpPeers = flags.StringSlice("bgp-peers", []string{}, `Comma separated list of BGP peers with the
+		format address:asn. IPv6 addresses must use brackets ([fd00::1]:64512)`)
+
+	bgpRouterID = flags.String("bgp-router-id", "", `The BGP router ID. If undefined, the node IP address
+		is used`)
+
+	bgpCommunities = flags.StringSlice("bgp-communities", []string{}, `Comma separated list of BGP communities
+		(AA:NN) added to the announced routes`)
+
+	bgpHoldTime = flags.Duration("bgp-hold-time", 90*time.Second, `The BGP hold time`)
+
+	bgpNextHopIPv6 = flags.String("bgp-next-hop-ipv6", "", `The next hop of the IPv6 routes. Required to
+		announce IPv6 VIPs from nodes with an IPv4 address`)
 )
 
 func main() {
@@ -100,8 +191,12 @@ func main() {
 	// https://github.com/kubernetes/kubernetes/issues/17162
 	flag.CommandLine.Parse([]string{})
 
-	if *configMapName == "" {
-		glog.Fatalf("Please specify --services-configmap")
+	if *configMapName == "" && *configMapSelector == "" {
+		glog.Fatalf("Please specify --services-configmap or --services-configmap-selector")
+	}
+
+	if _, err := labels.Parse(*configMapSelector); err != nil {
+		glog.Fatalf("Invalid configmap selector %v: %v", *configMapSelector, err)
 	}
 
 	if *httpPort < 0 || *httpPort > 65535 {
@@ -112,15 +207,43 @@ func main() {
 		glog.Fatalf("Error using VRID %d, only values between 0 and 255 are allowed.", vrid)
 	}
 
+	if *webhookPort < 0 || *webhookPort > 65535 {
+		glog.Fatalf("Invalid webhook port %d, only values between 0 and 65535 are allowed.", *webhookPort)
+	}
+
 	if *useUnicast {
 		glog.Info("keepalived will use unicast to sync the nodes")
 	}
 
+	switch *nodeMaintenance {
+	case "", "fault", "priority":
+	default:
+		glog.Fatalf("Invalid node maintenance mode %v, only fault and priority are allowed.", *nodeMaintenance)
+	}
+
+	if _, err := labels.Parse(*serviceSelector); err != nil {
+		glog.Fatalf("Invalid service selector %v: %v", *serviceSelector, err)
+	}
+
+	bgpCfg, peers, err := parseBGPFlags()
+	if err != nil {
+		glog.Fatalf("%v", err)
+	}
+
+	if *nodeMaintenance != "" && *announceMode != "vrrp" {
+		glog.Fatalf("--node-maintenance requires the vrrp announce mode (current %v)", *announceMode)
+	}
+
+	addressPolicy, err := k8s.ParseNodeAddressPolicy(*nodeAddressPolicy)
+	if err != nil {
+		glog.Fatalf("%v", err)
+	}
+
 	if *vrid < 0 || *vrid > 255 {
 		glog.Fatalf("Error using VRID %d, only values between 0 and 255 are allowed.", vrid)
 	}
 
-	err := loadIPVModule()
+	err = loadIPVModule()
 	if err != nil {
 		glog.Fatalf("unexpected error: %v", err)
 	}
@@ -139,7 +262,37 @@ func main() {
 	}
 
 	glog.Info("starting LVS configuration")
-	ipvsc := controller.NewIPVSController(kubeClient, *watchNamespace, *useUnicast, *configMapName, *vrid, *proxyMode, *iface, *httpPort, *releaseVips)
+	ipvsc := controller.NewIPVSController(kubeClient, &controller.Configuration{
+		WatchNamespaces:           parseList(*watchNamespace),
+		ServiceSelector:           *serviceSelector,
+		ConfigMapNames:            parseList(*configMapName),
+		ConfigMapSelector:         *configMapSelector,
+		ConfigMapCrossNamespace:   *configMapCrossNamespace,
+		UseUnicast:                *useUnicast,
+		VRID:                      *vrid,
+		ProxyMode:                 *proxyMode,
+		Iface:                     *iface,
+		ExcludeIfaces:             parseList(*excludeIfaces),
+		NodeAddressPolicy:         addressPolicy,
+		HTTPPort:                  *httpPort,
+		ReleaseVips:               *releaseVips,
+		WebhookPort:               *webhookPort,
+		WebhookCertFile:           *webhookCertFile,
+		WebhookKeyFile:            *webhookKeyFile,
+		VRRPAuthSecret:            *vrrpAuthSecret,
+		VRRPSourceFilter:          *vrrpSourceFilter,
+		VRRPConfigMap:             *vrrpConfigMap,
+		IPPoolsConfigMap:          *ipPoolsConfigMap,
+		SplitBrainDetection:       *splitBrainDetection,
+		SplitBrainStepDown:        *splitBrainStepDown,
+		LocalityPriority:          *localityPriority,
+		NodeMaintenance:           *nodeMaintenance,
+		HandoffTimeout:            *handoffTimeout,
+		DuplicateAddressDetection: *duplicateAddressDetection,
+		AnnounceMode:              *announceMode,
+		BGP:                       bgpCfg,
+		BGPPeers:                  peers,
+	})
 
 	// If kube-proxy running in ipvs mode
 	// Reset of IPVS lead to connection loss with API server
@@ -243,6 +396,67 @@ func changeSysctl() error {
 	return nil
 }
 
+// parseBGPFlags returns the configuration of the BGP speaker
+func parseBGPFlags() (bgp.Config, []bgp.Peer, error) {
+	cfg := bgp.Config{
+		ASN:      *bgpASN,
+		HoldTime: *bgpHoldTime,
+	}
+
+	switch *announceMode {
+	case "vrrp", "lease":
+		return cfg, nil, nil
+	case "bgp":
+	default:
+		return cfg, nil, fmt.Errorf("invalid announce mode %v. Only vrrp, bgp and lease are supported", *announceMode)
+	}
+
+	if cfg.ASN == 0 {
+		return cfg, nil, fmt.Errorf("please specify --bgp-asn")
+	}
+
+	if cfg.HoldTime != 0 && (cfg.HoldTime < 3*time.Second || cfg.HoldTime > 65535*time.Second) {
+		return cfg, nil, fmt.Errorf("invalid BGP hold time %v, only zero or values between 3s and 65535s are allowed", cfg.HoldTime)
+	}
+
+	if *bgpRouterID != "" {
+		cfg.RouterID = net.ParseIP(*bgpRouterID)
+		if cfg.RouterID == nil || cfg.RouterID.To4() == nil {
+			return cfg, nil, fmt.Errorf("invalid BGP router ID %v", *bgpRouterID)
+		}
+	}
+
+	if *bgpNextHopIPv6 != "" {
+		cfg.NextHopIPv6 = net.ParseIP(*bgpNextHopIPv6)
+		if cfg.NextHopIPv6 == nil || cfg.NextHopIPv6.To4() != nil {
+			return cfg, nil, fmt.Errorf("invalid IPv6 next hop %v", *bgpNextHopIPv6)
+		}
+	}
+
+	for _, c := range *bgpCommunities {
+		community, err := bgp.ParseCommunity(c)
+		if err != nil {
+			return cfg, nil, err
+		}
+		cfg.Communities = append(cfg.Communities, community)
+	}
+
+	if len(*bgpPeers) == 0 {
+		return cfg, nil, fmt.Errorf("please specify --bgp-peers")
+	}
+
+	peers := []bgp.Peer{}
+	for _, p := range *bgpPeers {
+		peer, err := bgp.ParsePeer(p)
+		if err != nil {
+			return cfg, nil, err
+		}
+		peers = append(peers, peer)
+	}
+
+	return cfg, peers, nil
+}
+
 func resetIPVS() error {
 	glog.Info("cleaning ipvs configuration")
 	_, err := k8sexec.New().Command("ipvsadm", "-C").CombinedOutput()
@@ -265,3 +479,19 @@ func copyHaproxyCfg() {
 		glog.Fatalf("unexpected error writing haproxy.cfg: %v", err)
 	}
 }
+
+// parseList returns the sorted values of a comma separated list
+func parseList(value string) []string {
+	values := []string{}
+	seen := map[string]bool{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" && !seen[v] {
+			values = append(values, v)
+			seen[v] = true
+		}
+	}
+
+	sort.Strings(values)
+	return values
+}
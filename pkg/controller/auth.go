@@ -0,0 +1,122 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	// rotateAtAnnotation contains the time (RFC3339) when the nodes start
+	// using the new content of the VRRP authentication secret. All the
+	// nodes switch at the same time, avoiding a split brain while the
+	// passwords do not match.
+	rotateAtAnnotation = "kube-keepalived-vip/rotate-at"
+
+	// maxAuthPassLen is the maximum length of a VRRP password
+	maxAuthPassLen = 8
+)
+
+// parseVRRPAuth returns the VRRP passwords contained in a secret. The keys
+// of the secret are the names of the VRRP instances.
+func parseVRRPAuth(secret *apiv1.Secret) (map[string]string, error) {
+	keys := []string{}
+	for k := range secret.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	auth := map[string]string{}
+	for _, instance := range keys {
+		pass := string(secret.Data[instance])
+		if pass == "" {
+			return nil, fmt.Errorf("empty VRRP password for instance %v", instance)
+		}
+		if len(pass) > maxAuthPassLen {
+			return nil, fmt.Errorf("VRRP password for instance %v is longer than %v characters", instance, maxAuthPassLen)
+		}
+		auth[instance] = pass
+	}
+
+	return auth, nil
+}
+
+// getVRRPAuth returns the VRRP passwords to use in keepalived. Once
+// keepalived is configured, a change in the secret with the rotate-at
+// annotation is only applied when that time is reached. In case of errors
+// the current passwords are used.
+func (ipvsc *ipvsControllerController) getVRRPAuth() map[string]string {
+	current := ipvsc.keepalived.vrrpAuth
+	if ipvsc.authSecretName == "" {
+		return current
+	}
+
+	obj, exists, err := ipvsc.authSecretLister.Store.GetByKey(ipvsc.authSecretName)
+	if err != nil || !exists {
+		glog.Warningf("VRRP authentication secret %v not found: %v", ipvsc.authSecretName, err)
+		return current
+	}
+
+	secret := obj.(*apiv1.Secret)
+	auth, err := parseVRRPAuth(secret)
+	if err != nil {
+		glog.Warningf("invalid VRRP authentication secret %v: %v", ipvsc.authSecretName, err)
+		return current
+	}
+
+	if reflect.DeepEqual(auth, current) {
+		return current
+	}
+
+	// the first configuration does not need to be coordinated
+	if ipvsc.ruMD5 == "" {
+		return auth
+	}
+
+	rotateAt, ok := secret.Annotations[rotateAtAnnotation]
+	if !ok {
+		return auth
+	}
+
+	t, err := time.Parse(time.RFC3339, rotateAt)
+	if err != nil {
+		glog.Warningf("invalid %v annotation in secret %v: %v", rotateAtAnnotation, ipvsc.authSecretName, err)
+		return current
+	}
+
+	wait := time.Until(t)
+	if wait <= 0 {
+		return auth
+	}
+
+	glog.Infof("VRRP passwords will change at %v", t)
+	if ipvsc.rotationTimer != nil {
+		ipvsc.rotationTimer.Stop()
+	}
+	ipvsc.rotationTimer = time.AfterFunc(wait, func() {
+		ipvsc.syncQueue.Enqueue(secret)
+	})
+
+	return current
+}
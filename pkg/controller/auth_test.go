@@ -0,0 +1,112 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/aledbf/kube-keepalived-vip/pkg/task"
+)
+
+func TestParseVRRPAuth(t *testing.T) {
+	testcases := map[string]struct {
+		Data     map[string][]byte
+		Expected map[string]string
+		Error    bool
+	}{
+		"valid":        {map[string][]byte{"vips": []byte("s3cr3t")}, map[string]string{"vips": "s3cr3t"}, false},
+		"empty":        {map[string][]byte{"vips": []byte("")}, nil, true},
+		"too long":     {map[string][]byte{"vips": []byte("123456789")}, nil, true},
+		"no instances": {map[string][]byte{}, map[string]string{}, false},
+	}
+
+	for k, tc := range testcases {
+		auth, err := parseVRRPAuth(&apiv1.Secret{Data: tc.Data})
+		if tc.Error {
+			if err == nil {
+				t.Errorf("%s: expected an error", k)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", k, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(auth, tc.Expected) {
+			t.Errorf("%s: expected %v but returned %v", k, tc.Expected, auth)
+		}
+	}
+}
+
+func TestGetVRRPAuth(t *testing.T) {
+	ipvsc := &ipvsControllerController{
+		authSecretName: "default/vrrp-auth",
+		keepalived:     &keepalived{},
+	}
+	ipvsc.syncQueue = task.NewTaskQueue(func(interface{}) error { return nil })
+	ipvsc.authSecretLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vrrp-auth"},
+		Data:       map[string][]byte{"vips": []byte("old")},
+	}
+	ipvsc.authSecretLister.Store.Add(secret)
+
+	// the first configuration is applied immediately
+	auth := ipvsc.getVRRPAuth()
+	if auth["vips"] != "old" {
+		t.Fatalf("expected password old but returned %v", auth)
+	}
+	ipvsc.keepalived.vrrpAuth = auth
+	ipvsc.ruMD5 = "applied"
+
+	// a rotation in the future keeps the current password
+	rotated := secret.DeepCopy()
+	rotated.Data["vips"] = []byte("new")
+	rotated.Annotations = map[string]string{
+		rotateAtAnnotation: time.Now().Add(time.Hour).Format(time.RFC3339),
+	}
+	ipvsc.authSecretLister.Store.Update(rotated)
+
+	auth = ipvsc.getVRRPAuth()
+	if auth["vips"] != "old" {
+		t.Errorf("expected password old until the rotation but returned %v", auth)
+	}
+	if ipvsc.rotationTimer == nil {
+		t.Errorf("expected a scheduled rotation")
+	} else {
+		ipvsc.rotationTimer.Stop()
+	}
+
+	// once the rotation time is reached the new password is used
+	rotated = rotated.DeepCopy()
+	rotated.Annotations[rotateAtAnnotation] = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	ipvsc.authSecretLister.Store.Update(rotated)
+
+	auth = ipvsc.getVRRPAuth()
+	if auth["vips"] != "new" {
+		t.Errorf("expected password new but returned %v", auth)
+	}
+}
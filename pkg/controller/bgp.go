@@ -0,0 +1,223 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"k8s.io/kubernetes/pkg/util/sysctl"
+	k8sexec "k8s.io/utils/exec"
+
+	"github.com/aledbf/kube-keepalived-vip/pkg/bgp"
+)
+
+const (
+	announceBGP = "bgp"
+
+	// bgpIface is the dummy interface that contains the VIPs announced using BGP
+	bgpIface = "kube-vip0"
+)
+
+// bgpARPSysctls are the settings of the interface of the node that avoid
+// replies to ARP requests for the VIPs configured in the dummy interface
+var bgpARPSysctls = map[string]int{
+	"arp_ignore":   1,
+	"arp_announce": 2,
+}
+
+// bgpAnnouncer announces the VIPs with healthy backends in the node using BGP.
+// The VIPs are configured in a dummy interface so LVS (or HAProxy) accepts
+// the traffic routed to the node.
+type bgpAnnouncer struct {
+	speaker *bgp.Speaker
+	// vips contains the addresses configured in the dummy interface
+	vips []string
+
+	// iface is the interface of the node using bgpARPSysctls
+	iface  string
+	sysctl sysctl.Interface
+	// previous contains the values of the sysctls before the changes
+	previous map[string]int
+}
+
+func newBGPAnnouncer(cfg bgp.Config, peers []bgp.Peer, iface string) *bgpAnnouncer {
+	return &bgpAnnouncer{
+		speaker: bgp.NewSpeaker(cfg, peers),
+		iface:   iface,
+		sysctl:  sysctl.New(),
+	}
+}
+
+// Start creates the dummy interface and starts the BGP sessions
+func (b *bgpAnnouncer) Start() error {
+	err := b.setARPSysctls()
+	if err != nil {
+		return err
+	}
+
+	out, err := k8sexec.New().Command("ip", "link", "add", bgpIface, "type", "dummy").CombinedOutput()
+	if err != nil {
+		glog.V(2).Infof("error creating interface %v (already exists?): %v\n%s", bgpIface, err, out)
+	}
+
+	out, err = k8sexec.New().Command("ip", "link", "set", bgpIface, "up").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error configuring interface %v: %v\n%s", bgpIface, err, out)
+	}
+
+	b.speaker.Start()
+	return nil
+}
+
+// Update configures the VIPs with healthy backends and announces them
+func (b *bgpAnnouncer) Update(svcs []vip) error {
+	vips := getAnnouncedVIPs(svcs)
+
+	for _, ip := range b.vips {
+		if !contains(vips, ip) {
+			removeVIP(vipAddress{IP: ip, Interface: bgpIface})
+		}
+	}
+
+	prefixes := []*net.IPNet{}
+	for _, ip := range vips {
+		prefix := vipPrefix(ip)
+		if prefix == nil {
+			glog.Warningf("invalid VIP %v", ip)
+			continue
+		}
+
+		if !contains(b.vips, ip) {
+			err := addAddress(vipAddress{IP: ip, Interface: bgpIface})
+			if err != nil {
+				return err
+			}
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	b.vips = vips
+	b.speaker.Announce(prefixes)
+
+	return nil
+}
+
+// Healthy returns an error if there is no established BGP session
+func (b *bgpAnnouncer) Healthy() error {
+	if len(b.speaker.Established()) == 0 {
+		return fmt.Errorf("there is no established BGP session")
+	}
+
+	return nil
+}
+
+// Stop closes the BGP sessions, removes the VIPs from the node and restores
+// the ARP settings of the interface
+func (b *bgpAnnouncer) Stop() {
+	b.speaker.Stop()
+
+	for _, ip := range b.vips {
+		removeVIP(vipAddress{IP: ip, Interface: bgpIface})
+	}
+	b.vips = nil
+
+	b.restoreARPSysctls()
+}
+
+// setARPSysctls changes the ARP settings of the interface of the node,
+// keeping the previous values to restore them in Stop
+func (b *bgpAnnouncer) setARPSysctls() error {
+	b.previous = map[string]int{}
+	for name, value := range bgpARPSysctls {
+		key := fmt.Sprintf("net/ipv4/conf/%v/%v", b.iface, name)
+		current, err := b.sysctl.GetSysctl(key)
+		if err != nil {
+			return err
+		}
+
+		b.previous[key] = current
+		if current == value {
+			continue
+		}
+
+		err = b.sysctl.SetSysctl(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreARPSysctls restores the ARP settings changed by setARPSysctls
+func (b *bgpAnnouncer) restoreARPSysctls() {
+	for key, value := range b.previous {
+		err := b.sysctl.SetSysctl(key, value)
+		if err != nil {
+			glog.Warningf("unexpected error restoring %v: %v", key, err)
+		}
+	}
+	b.previous = nil
+}
+
+// getAnnouncedVIPs returns the VIPs announced using BGP. A VIP is only
+// announced if it has at least one endpoint. Entries without a service
+// are always announced.
+func getAnnouncedVIPs(svcs []vip) []string {
+	vips := []string{}
+	for _, svc := range svcs {
+		if svc.LVSMethod == "VIP" || hasBackends(svc) {
+			vips = appendIfMissing(vips, svc.IP)
+		}
+	}
+
+	sort.Strings(vips)
+	return vips
+}
+
+func hasBackends(svc vip) bool {
+	if len(svc.Backends) > 0 {
+		return true
+	}
+
+	for _, r := range svc.Routes {
+		if len(r.Backends) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// vipPrefix returns the host route (/32 or /128) of an address
+func vipPrefix(ip string) *net.IPNet {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+
+	if addr.To4() != nil {
+		return &net.IPNet{IP: addr.To4(), Mask: net.CIDRMask(32, 32)}
+	}
+
+	return &net.IPNet{IP: addr, Mask: net.CIDRMask(128, 128)}
+}
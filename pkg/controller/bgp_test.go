@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetAnnouncedVIPs(t *testing.T) {
+	svcs := []vip{
+		{IP: "10.4.0.50", Port: 80, LVSMethod: "NAT", Backends: []service{{IP: "10.2.0.1", Port: 8080}}},
+		{IP: "10.4.0.50", Port: 443, LVSMethod: "NAT"},
+		{IP: "10.4.0.51", Port: 80, LVSMethod: "NAT"},
+		{IP: "10.4.0.52", LVSMethod: "VIP"},
+		{IP: "10.4.0.53", Port: 80, Mode: modeHTTP, Routes: []route{
+			{Host: "foo.bar", Backends: []service{{IP: "10.2.0.2", Port: 8080}}},
+		}},
+		{IP: "fd00::10", Port: 80, LVSMethod: "NAT", Backends: []service{{IP: "fd01::1", Port: 8080}}},
+	}
+
+	expected := []string{"10.4.0.50", "10.4.0.52", "10.4.0.53", "fd00::10"}
+	vips := getAnnouncedVIPs(svcs)
+	if !reflect.DeepEqual(vips, expected) {
+		t.Errorf("expected %v but returned %v", expected, vips)
+	}
+}
+
+func TestVIPPrefix(t *testing.T) {
+	testcases := map[string]string{
+		"10.4.0.50":   "10.4.0.50/32",
+		"fd00::10":    "fd00::10/128",
+		"not-an-ip":   "",
+		"10.4.0.50/8": "",
+	}
+
+	for ip, expected := range testcases {
+		prefix := vipPrefix(ip)
+		if expected == "" {
+			if prefix != nil {
+				t.Errorf("%v: expected no prefix but returned %v", ip, prefix)
+			}
+			continue
+		}
+
+		if prefix == nil || prefix.String() != expected {
+			t.Errorf("%v: expected %v but returned %v", ip, expected, prefix)
+		}
+	}
+}
+
+// fakeSysctl contains the values of the sysctls by key
+type fakeSysctl map[string]int
+
+func (f fakeSysctl) GetSysctl(key string) (int, error) {
+	return f[key], nil
+}
+
+func (f fakeSysctl) SetSysctl(key string, value int) error {
+	f[key] = value
+	return nil
+}
+
+func TestARPSysctls(t *testing.T) {
+	sys := fakeSysctl{
+		"net/ipv4/conf/eth0/arp_ignore":   0,
+		"net/ipv4/conf/eth0/arp_announce": 2,
+	}
+	b := &bgpAnnouncer{iface: "eth0", sysctl: sys}
+
+	err := b.setARPSysctls()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := fakeSysctl{
+		"net/ipv4/conf/eth0/arp_ignore":   1,
+		"net/ipv4/conf/eth0/arp_announce": 2,
+	}
+	if !reflect.DeepEqual(sys, expected) {
+		t.Errorf("expected %v but returned %v", expected, sys)
+	}
+
+	b.restoreARPSysctls()
+	expected = fakeSysctl{
+		"net/ipv4/conf/eth0/arp_ignore":   0,
+		"net/ipv4/conf/eth0/arp_announce": 2,
+	}
+	if !reflect.DeepEqual(sys, expected) {
+		t.Errorf("expected %v after restoring but returned %v", expected, sys)
+	}
+}
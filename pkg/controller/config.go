@@ -0,0 +1,578 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	modeTCP  = "tcp"
+	modeHTTP = "http"
+	// modeSNI is used by the VIPs that route TLS connections using SNI
+	modeSNI = "sni"
+
+	// httpPort and httpsPort are the ports used by the VIPs in http mode
+	httpPort  = 80
+	httpsPort = 443
+	// sniPort is the port used by the sni rules
+	sniPort = 443
+
+	// defaultGroup is the VRRP instance of the VIPs without group
+	defaultGroup = "vips"
+
+	defaultScheduler   = "wlc"
+	defaultPersistence = 1800
+
+	checkTCP   = "tcp"
+	checkHTTP  = "http"
+	checkHTTPS = "https"
+	checkNone  = "none"
+
+	defaultCheckInterval = 5
+	defaultCheckTimeout  = 3
+)
+
+var (
+	// lvsSchedulers contains the IPVS schedulers supported by keepalived
+	lvsSchedulers = []string{"rr", "wrr", "lc", "wlc", "lblc", "lblcr", "dh", "sh", "sed", "nq", "fo", "ovf", "mh"}
+
+	groupRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+	// yamlKeyRegex matches the key of a YAML mapping or a JSON object
+	yamlKeyRegex = regexp.MustCompile(`^\s*(?:-\s+)?"?([^":\s]+)"?\s*:`)
+	// jsonFieldRegex extracts the field of the errors returned by encoding/json
+	jsonFieldRegex   = regexp.MustCompile(`unknown field "([^"]+)"`)
+	jsonTypeRegex    = regexp.MustCompile(`cannot unmarshal (\S+) into Go struct field \w*\.(\S+) of type (\S+)`)
+	yamlSyntaxPrefix = regexp.MustCompile(`^error converting YAML to JSON: yaml: `)
+)
+
+// vipConfig contains the configuration of one entry of the services
+// ConfigMap. The value of the entry can use the short format
+// namespace/service name[:NAT|DR|PROXY] or a YAML (or JSON) document.
+type vipConfig struct {
+	// Service to expose with the format namespace/service name
+	Service string `json:"service,omitempty"`
+	// Method is the LVS forwarding method (NAT, DR or PROXY)
+	Method string `json:"method,omitempty"`
+	// Mode is the HAProxy mode (tcp or http) used in proxy mode
+	Mode string `json:"mode,omitempty"`
+	// Rules contains the HTTP routing rules used in http mode
+	Rules []httpRule `json:"rules,omitempty"`
+	// TLS contains the secrets (namespace/name) with the certificates
+	// used to terminate TLS in http mode
+	TLS []string `json:"tls,omitempty"`
+	// SNI routes TLS connections in the port 443 to services using the
+	// server name, without terminating TLS
+	SNI []sniRule `json:"sni,omitempty"`
+	// TrackBackends changes the state of the VRRP instance when the VIP
+	// has no healthy backends: fault or priority
+	TrackBackends string `json:"trackBackends,omitempty"`
+	// TrackWeight is subtracted from the priority in priority mode
+	TrackWeight int `json:"trackWeight,omitempty"`
+	// Ports contains the ports of the service (number or name) exposed in
+	// the VIP. Empty exposes all the ports
+	Ports []intstr.IntOrString `json:"ports,omitempty"`
+	// Scheduler is the IPVS scheduler (lvs_sched). Default wlc
+	Scheduler string `json:"scheduler,omitempty"`
+	// Persistence is the timeout (seconds) of the persistent connections
+	// of a client to the same backend. Zero disables it. Default 1800
+	Persistence *int `json:"persistence,omitempty"`
+	// HealthCheck configures the check of the backends done by keepalived
+	HealthCheck *healthCheck `json:"healthCheck,omitempty"`
+	// Group is the VRRP instance announcing the VIP. Default vips
+	Group string `json:"group,omitempty"`
+	// Pool is the pool of the VIP. Entries with a name instead of an
+	// address get a VIP allocated from the pool
+	Pool string `json:"pool,omitempty"`
+	// Interface is the network interface of the VIP or a CIDR of an address
+	// of the interface. Default the interface of the VRRP group
+	Interface string `json:"interface,omitempty"`
+	// Prefix is the prefix length used to add the VIP, creating the route
+	// of the subnet. Default 32 (128 in IPv6)
+	Prefix int `json:"prefix,omitempty"`
+	// Label of the VIP in the interface. The interface name is added when
+	// it does not contain it (eth0:vip)
+	Label string `json:"label,omitempty"`
+	// Scope of the VIP (global, site, link, host or nowhere). Default global
+	Scope string `json:"scope,omitempty"`
+}
+
+// healthCheck is the check of the backends of a virtual server
+type healthCheck struct {
+	// Type of the check: tcp, http, https or none. Default tcp
+	Type string `json:"type,omitempty"`
+	// Path of the request in http and https checks. Default /
+	Path string `json:"path,omitempty"`
+	// Status is the status code expected in http and https checks. Default 200
+	Status int `json:"status,omitempty"`
+	// Interval is the time (seconds) between checks (delay_loop). Default 5
+	Interval int `json:"interval,omitempty"`
+	// Timeout is the connection timeout (seconds). Default 3
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// httpRule routes the HTTP requests with a host and path to a service
+type httpRule struct {
+	// Host is the value of the Host header. Empty matches any host
+	Host string `json:"host,omitempty"`
+	// Path is the prefix of the path of the request. Empty matches any path
+	Path string `json:"path,omitempty"`
+	// Service with the format namespace/service name
+	Service string `json:"service"`
+	// Port of the service (number or name). Empty uses the first port
+	Port intstr.IntOrString `json:"port,omitempty"`
+}
+
+// sniRule routes the TLS connections with a server name to a service
+type sniRule struct {
+	// Host is the server name sent by the client. Empty matches any name
+	Host string `json:"host,omitempty"`
+	// Service with the format namespace/service name
+	Service string `json:"service"`
+	// Port of the service (number or name). Empty uses the first port
+	Port intstr.IntOrString `json:"port,omitempty"`
+}
+
+// isStructuredValue returns true if the value of an entry of the services
+// ConfigMap is a YAML or JSON document instead of the short format
+func isStructuredValue(value string) bool {
+	value = strings.TrimSpace(value)
+	return strings.HasPrefix(value, "{") ||
+		strings.Contains(value, "\n") ||
+		strings.Contains(value, ": ")
+}
+
+// fieldError is an invalid field of a structured value. Path contains the
+// keys (and indexes of lists) separated by dots
+type fieldError struct {
+	Path string
+	Msg  string
+}
+
+func (e *fieldError) Error() string {
+	return e.Msg
+}
+
+func fieldErrorf(path, format string, args ...interface{}) error {
+	return &fieldError{Path: path, Msg: fmt.Sprintf(format, args...)}
+}
+
+// parseVIPConfig parses the value of an entry of the services ConfigMap.
+// Errors in structured values contain the line of the invalid field.
+func parseVIPConfig(value string) (*vipConfig, error) {
+	if !isStructuredValue(value) {
+		ns, svc, lvsm, err := parseNsSvcLVS(value)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := &vipConfig{
+			Service: fmt.Sprintf("%v/%v", ns, svc),
+			Method:  lvsm,
+			Mode:    modeTCP,
+		}
+		cfg.setDefaults()
+		return cfg, nil
+	}
+
+	cfg := &vipConfig{}
+	err := yaml.UnmarshalStrict([]byte(value), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", unmarshalError(value, err))
+	}
+
+	cfg.setDefaults()
+
+	err = cfg.validate()
+	if fe, ok := err.(*fieldError); ok {
+		if line := fieldLine(value, fe.Path); line > 0 {
+			return nil, fmt.Errorf("line %v: %v", line, fe.Msg)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// setDefaults sets the value of the empty fields
+func (cfg *vipConfig) setDefaults() {
+	if cfg.Mode == "" {
+		cfg.Mode = modeTCP
+	}
+
+	if cfg.Method == "" {
+		cfg.Method = "NAT"
+	}
+
+	if cfg.Scheduler == "" {
+		cfg.Scheduler = defaultScheduler
+	}
+
+	if cfg.Persistence == nil {
+		persistence := defaultPersistence
+		cfg.Persistence = &persistence
+	}
+
+	if cfg.HealthCheck == nil {
+		cfg.HealthCheck = &healthCheck{}
+	}
+
+	check := cfg.HealthCheck
+	if check.Type == "" {
+		check.Type = checkTCP
+	}
+	if check.Interval == 0 {
+		check.Interval = defaultCheckInterval
+	}
+	if check.Timeout == 0 {
+		check.Timeout = defaultCheckTimeout
+	}
+	if check.Type == checkHTTP || check.Type == checkHTTPS {
+		if check.Path == "" {
+			check.Path = "/"
+		}
+		if check.Status == 0 {
+			check.Status = 200
+		}
+	}
+
+	if cfg.Group == "" {
+		cfg.Group = defaultGroup
+	}
+}
+
+// validate checks the fields of the entry
+func (cfg *vipConfig) validate() error {
+	if !lvsRegex.MatchString(cfg.Method) {
+		return fieldErrorf("method", "invalid LVS method. Only NAT,DR and PROXY are supported: %v", cfg.Method)
+	}
+
+	switch cfg.Mode {
+	case modeTCP:
+		if cfg.Service == "" && len(cfg.SNI) == 0 {
+			return fieldErrorf("mode", "service or sni is required in tcp mode")
+		}
+		if len(cfg.Rules) > 0 {
+			return fieldErrorf("rules", "rules and tls are only supported in http mode")
+		}
+		if len(cfg.TLS) > 0 {
+			return fieldErrorf("tls", "rules and tls are only supported in http mode")
+		}
+	case modeHTTP:
+		if cfg.Service != "" {
+			cfg.Rules = append(cfg.Rules, httpRule{Service: cfg.Service})
+			cfg.Service = ""
+		}
+		if len(cfg.Rules) == 0 {
+			return fieldErrorf("mode", "at least one rule is required in http mode")
+		}
+		if len(cfg.TLS) > 0 && len(cfg.SNI) > 0 {
+			return fieldErrorf("sni", "tls and sni cannot be used in the same VIP")
+		}
+		if len(cfg.Ports) > 0 {
+			return fieldErrorf("ports", "ports is only supported in tcp mode, use the port of the rules")
+		}
+	default:
+		return fieldErrorf("mode", "invalid mode %v. Only tcp and http are supported", cfg.Mode)
+	}
+
+	if cfg.Service != "" {
+		if _, _, err := parseNsName(cfg.Service); err != nil {
+			return fieldErrorf("service", "%v", err)
+		}
+	}
+
+	defaultRule := false
+	for i, rule := range cfg.Rules {
+		if _, _, err := parseNsName(rule.Service); err != nil {
+			return fieldErrorf(fmt.Sprintf("rules.%v.service", i), "invalid rule: %v", err)
+		}
+		if rule.Path != "" && !strings.HasPrefix(rule.Path, "/") {
+			return fieldErrorf(fmt.Sprintf("rules.%v.path", i), "invalid rule: path %v must start with /", rule.Path)
+		}
+		if rule.Host == "" && rule.Path == "" {
+			if defaultRule {
+				return fieldErrorf(fmt.Sprintf("rules.%v", i), "invalid rule: only one rule without host and path is allowed")
+			}
+			defaultRule = true
+		}
+	}
+
+	defaultSNI := false
+	for i, rule := range cfg.SNI {
+		if _, _, err := parseNsName(rule.Service); err != nil {
+			return fieldErrorf(fmt.Sprintf("sni.%v.service", i), "invalid sni rule: %v", err)
+		}
+		if rule.Host == "" {
+			if defaultSNI {
+				return fieldErrorf(fmt.Sprintf("sni.%v", i), "invalid sni rule: only one rule without host is allowed")
+			}
+			defaultSNI = true
+		}
+	}
+
+	switch cfg.TrackBackends {
+	case "", trackFault:
+		if cfg.TrackWeight != 0 {
+			return fieldErrorf("trackWeight", "trackWeight requires trackBackends: %v", trackPriority)
+		}
+	case trackPriority:
+		if cfg.TrackWeight < 0 || cfg.TrackWeight > 253 {
+			return fieldErrorf("trackWeight", "invalid trackWeight %v (1-253)", cfg.TrackWeight)
+		}
+	default:
+		return fieldErrorf("trackBackends", "invalid trackBackends %v. Only fault and priority are supported", cfg.TrackBackends)
+	}
+
+	for i, secret := range cfg.TLS {
+		if _, _, err := parseNsName(secret); err != nil {
+			return fieldErrorf(fmt.Sprintf("tls.%v", i), "invalid tls secret: %v", err)
+		}
+	}
+
+	for i, port := range cfg.Ports {
+		if port.Type == intstr.Int && (port.IntVal < 1 || port.IntVal > 65535) {
+			return fieldErrorf(fmt.Sprintf("ports.%v", i), "invalid port %v", port.IntVal)
+		}
+		if port.Type == intstr.String && port.StrVal == "" {
+			return fieldErrorf(fmt.Sprintf("ports.%v", i), "invalid empty port name")
+		}
+	}
+
+	// the port 443 of the VIP is used by the sni rules
+	if cfg.Service != "" && len(cfg.SNI) > 0 {
+		if len(cfg.Ports) == 0 {
+			return fieldErrorf("ports", "ports is required to use a service with sni rules")
+		}
+		for i, port := range cfg.Ports {
+			if port.Type == intstr.Int && port.IntVal == sniPort {
+				return fieldErrorf(fmt.Sprintf("ports.%v", i), "port %v is used by the sni rules", sniPort)
+			}
+		}
+	}
+
+	if !contains(lvsSchedulers, cfg.Scheduler) {
+		return fieldErrorf("scheduler", "invalid scheduler %v. Only %v are supported", cfg.Scheduler, strings.Join(lvsSchedulers, ","))
+	}
+
+	if *cfg.Persistence < 0 {
+		return fieldErrorf("persistence", "persistence must not be negative")
+	}
+
+	check := cfg.HealthCheck
+	switch check.Type {
+	case checkTCP, checkNone:
+		if check.Path != "" || check.Status != 0 {
+			return fieldErrorf("healthCheck.type", "path and status require an http or https check")
+		}
+	case checkHTTP, checkHTTPS:
+		if !strings.HasPrefix(check.Path, "/") {
+			return fieldErrorf("healthCheck.path", "path %v must start with /", check.Path)
+		}
+		if check.Status < 100 || check.Status > 599 {
+			return fieldErrorf("healthCheck.status", "invalid status code %v", check.Status)
+		}
+	default:
+		return fieldErrorf("healthCheck.type", "invalid health check %v. Only tcp, http, https and none are supported", check.Type)
+	}
+
+	if check.Interval < 0 {
+		return fieldErrorf("healthCheck.interval", "interval must not be negative")
+	}
+	if check.Timeout < 0 {
+		return fieldErrorf("healthCheck.timeout", "timeout must not be negative")
+	}
+
+	if !groupRegex.MatchString(cfg.Group) {
+		return fieldErrorf("group", "invalid group %v, only lowercase alphanumeric characters and - are allowed", cfg.Group)
+	}
+
+	if cfg.Interface != "" {
+		if err := validateInterface(cfg.Interface); err != nil {
+			return fieldErrorf("interface", "%v", err)
+		}
+	}
+
+	if cfg.Prefix < 0 || cfg.Prefix > 128 {
+		return fieldErrorf("prefix", "invalid prefix length %v", cfg.Prefix)
+	}
+
+	if cfg.Label != "" && !labelRegex.MatchString(cfg.Label) {
+		return fieldErrorf("label", "invalid label %v", cfg.Label)
+	}
+
+	if err := validateAddressScope(cfg.Scope); err != nil {
+		return fieldErrorf("scope", "%v", err)
+	}
+
+	return nil
+}
+
+// validateAddress checks the configuration depending on the VIP
+func (cfg *vipConfig) validateAddress(ip net.IP) error {
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+
+	if cfg.Prefix > bits {
+		return fmt.Errorf("invalid prefix length %v for VIP %v", cfg.Prefix, ip)
+	}
+
+	return nil
+}
+
+// unmarshalError adds the line of the field to the errors decoding a
+// structured value. YAML syntax errors already contain the line.
+func unmarshalError(value string, err error) error {
+	msg := yamlSyntaxPrefix.ReplaceAllString(err.Error(), "")
+
+	if m := jsonFieldRegex.FindStringSubmatch(msg); m != nil {
+		if line := fieldLine(value, m[1]); line > 0 {
+			return fmt.Errorf("line %v: unknown field %q", line, m[1])
+		}
+		return fmt.Errorf("unknown field %q", m[1])
+	}
+
+	if m := jsonTypeRegex.FindStringSubmatch(msg); m != nil {
+		msg := fmt.Sprintf("%v: cannot use a %v as %v", m[2], m[1], m[3])
+		if line := fieldLine(value, m[2]); line > 0 {
+			return fmt.Errorf("line %v: %v", line, msg)
+		}
+		return fmt.Errorf("%v", msg)
+	}
+
+	return fmt.Errorf("%v", msg)
+}
+
+// fieldLine returns the line (starting at 1) of a field of a YAML or JSON
+// document, or zero if it is not found. The path contains the keys and the
+// indexes of the lists separated by dots, like rules.1.path
+func fieldLine(value, path string) int {
+	lines := strings.Split(value, "\n")
+	start, end := 0, len(lines)
+	found := -1
+
+	for _, segment := range strings.Split(path, ".") {
+		if index, err := strconv.Atoi(segment); err == nil {
+			start, end = listItem(lines, start, end, index)
+			if start < 0 {
+				return 0
+			}
+			found = start
+			continue
+		}
+
+		line := -1
+		for i := start; i < end; i++ {
+			if m := yamlKeyRegex.FindStringSubmatch(lines[i]); m != nil && m[1] == segment {
+				line = i
+				break
+			}
+		}
+		if line < 0 {
+			// JSON documents can contain more than one key per line
+			for i := start; i < end; i++ {
+				if strings.Contains(lines[i], fmt.Sprintf("%q", segment)) {
+					line = i
+					break
+				}
+			}
+		}
+		if line < 0 {
+			return 0
+		}
+
+		found = line
+		start = line
+	}
+
+	return found + 1
+}
+
+// listItem returns the first and last line of an item of the first YAML
+// list found between two lines, or -1 if the item does not exist
+func listItem(lines []string, start, end, index int) (int, int) {
+	indent := -1
+	item := -1
+	first := -1
+	for i := start; i < end; i++ {
+		trimmed := strings.TrimLeft(lines[i], " ")
+		if trimmed == "" {
+			continue
+		}
+
+		current := len(lines[i]) - len(trimmed)
+		if !strings.HasPrefix(trimmed, "- ") && trimmed != "-" {
+			if indent >= 0 && current <= indent {
+				break
+			}
+			continue
+		}
+
+		if indent < 0 {
+			indent = current
+		}
+		if current != indent {
+			if current < indent {
+				break
+			}
+			continue
+		}
+
+		item++
+		if item == index {
+			first = i
+		} else if item == index+1 {
+			return first, i
+		}
+	}
+
+	if first < 0 {
+		return -1, -1
+	}
+
+	return first, end
+}
+
+// services returns the services (namespace/name) referenced by the entry
+func (cfg *vipConfig) services() []string {
+	svcs := []string{}
+	if cfg.Service != "" {
+		svcs = append(svcs, cfg.Service)
+	}
+
+	for _, rule := range cfg.Rules {
+		svcs = appendIfMissing(svcs, rule.Service)
+	}
+
+	for _, rule := range cfg.SNI {
+		svcs = appendIfMissing(svcs, rule.Service)
+	}
+
+	return svcs
+}
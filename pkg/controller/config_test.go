@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseVIPConfig(t *testing.T) {
+	testcases := map[string]struct {
+		Input         string
+		Service       string
+		Method        string
+		Mode          string
+		Rules         int
+		ErrorExpected bool
+	}{
+		"short format":             {"default/echoheaders:DR", "default/echoheaders", "DR", modeTCP, 0, false},
+		"invalid short format":     {"echoheaders", "", "", "", 0, true},
+		"yaml":                     {"service: default/echoheaders\nmethod: PROXY", "default/echoheaders", "PROXY", modeTCP, 0, false},
+		"json":                     {`{"service": "default/echoheaders"}`, "default/echoheaders", "NAT", modeTCP, 0, false},
+		"unknown field":            {"service: default/echoheaders\nmethd: DR", "", "", "", 0, true},
+		"invalid method":           {"service: default/echoheaders\nmethod: AJAX", "", "", "", 0, true},
+		"tcp without service":      {"method: DR\n", "", "", "", 0, true},
+		"rules in tcp mode":        {"service: default/echoheaders\nrules:\n- service: default/other", "", "", "", 0, true},
+		"http without rules":       {"mode: http\ntls: [default/cert]", "", "", "", 0, true},
+		"http with service":        {"mode: http\nservice: default/echoheaders", "", "NAT", modeHTTP, 1, false},
+		"http with invalid path":   {"mode: http\nrules:\n- service: default/echoheaders\n  path: api", "", "", "", 0, true},
+		"http with invalid rule":   {"mode: http\nrules:\n- service: echoheaders", "", "", "", 0, true},
+		"invalid mode":             {"mode: udp\nservice: default/echoheaders", "", "", "", 0, true},
+		"sni":                      {"sni:\n- host: example.com\n  service: default/echoheaders\n- service: default/other", "", "NAT", modeTCP, 0, false},
+		"sni and service":          {"service: default/echoheaders\nports: [80]\nsni:\n- service: default/other", "default/echoheaders", "NAT", modeTCP, 0, false},
+		"sni and service no ports": {"service: default/echoheaders\nsni:\n- service: default/other", "", "", "", 0, true},
+		"sni and service port 443": {"service: default/echoheaders\nports: [80, 443]\nsni:\n- service: default/other", "", "", "", 0, true},
+		"sni with two defaults":    {"sni:\n- service: default/echoheaders\n- service: default/other", "", "", "", 0, true},
+		"http with two defaults":   {"mode: http\nrules:\n- service: default/echoheaders\n- service: default/other", "", "", "", 0, true},
+		"http service and rule":    {"mode: http\nservice: default/echoheaders\nrules:\n- service: default/other", "", "", "", 0, true},
+		"http with sni and tls":    {"mode: http\ntls: [default/cert]\nservice: default/echoheaders\nsni:\n- service: default/other", "", "", "", 0, true},
+		"track backends":           {"service: default/echoheaders\ntrackBackends: priority\ntrackWeight: 20", "default/echoheaders", "NAT", modeTCP, 0, false},
+		"invalid track mode":       {"service: default/echoheaders\ntrackBackends: drop", "", "", "", 0, true},
+		"weight in fault mode":     {"service: default/echoheaders\ntrackBackends: fault\ntrackWeight: 20", "", "", "", 0, true},
+		"invalid track weight":     {"service: default/echoheaders\ntrackBackends: priority\ntrackWeight: 300", "", "", "", 0, true},
+		"ports and scheduler":      {"service: default/echoheaders\nports: [80, https]\nscheduler: rr\npersistence: 0", "default/echoheaders", "NAT", modeTCP, 0, false},
+		"http health check":        {"service: default/echoheaders\nhealthCheck:\n  type: http\n  path: /healthz", "default/echoheaders", "NAT", modeTCP, 0, false},
+		"invalid scheduler":        {"service: default/echoheaders\nscheduler: random", "", "", "", 0, true},
+		"negative persistence":     {"service: default/echoheaders\npersistence: -1", "", "", "", 0, true},
+		"invalid port":             {"service: default/echoheaders\nports: [0]", "", "", "", 0, true},
+		"ports in http mode":       {"mode: http\nservice: default/echoheaders\nports: [80]", "", "", "", 0, true},
+		"path in tcp check":        {"service: default/echoheaders\nhealthCheck:\n  path: /healthz", "", "", "", 0, true},
+		"invalid check":            {"service: default/echoheaders\nhealthCheck:\n  type: icmp", "", "", "", 0, true},
+		"invalid group":            {"service: default/echoheaders\ngroup: Public_VIPs", "", "", "", 0, true},
+		"interface cidr":           {"service: default/echoheaders\ninterface: 192.168.10.0/24", "default/echoheaders", "NAT", modeTCP, 0, false},
+		"invalid interface":        {"service: default/echoheaders\ninterface: eth 1", "", "", "", 0, true},
+		"prefix, label and scope":  {"service: default/echoheaders\nprefix: 24\nlabel: eth0:vip\nscope: link", "default/echoheaders", "NAT", modeTCP, 0, false},
+		"invalid prefix":           {"service: default/echoheaders\nprefix: 129", "", "", "", 0, true},
+		"invalid label":            {"service: default/echoheaders\nlabel: eth0:my vip", "", "", "", 0, true},
+		"invalid scope":            {"service: default/echoheaders\nscope: universe", "", "", "", 0, true},
+		"http with rules and tls":  {"mode: http\ntls: [default/cert]\nrules:\n- host: example.com\n  service: default/echoheaders\n  port: http\n- service: default/other\n  port: 8080", "", "NAT", modeHTTP, 2, false},
+	}
+
+	for k, tc := range testcases {
+		cfg, err := parseVIPConfig(tc.Input)
+		if tc.ErrorExpected {
+			if err == nil {
+				t.Errorf("%s: expected an error but valid information returned: %+v", k, cfg)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", k, err)
+			continue
+		}
+
+		if cfg.Service != tc.Service || cfg.Method != tc.Method || cfg.Mode != tc.Mode || len(cfg.Rules) != tc.Rules {
+			t.Errorf("%s: unexpected configuration %+v - input %v", k, cfg, tc.Input)
+		}
+	}
+}
+
+func TestParseVIPConfigDefaults(t *testing.T) {
+	cfg, err := parseVIPConfig("default/echoheaders")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.Scheduler != defaultScheduler || *cfg.Persistence != defaultPersistence || cfg.Group != defaultGroup {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+
+	check := healthCheck{Type: checkTCP, Interval: defaultCheckInterval, Timeout: defaultCheckTimeout}
+	if *cfg.HealthCheck != check {
+		t.Errorf("expected health check %+v but returned %+v", check, *cfg.HealthCheck)
+	}
+
+	cfg, err = parseVIPConfig("service: default/echoheaders\nhealthCheck:\n  type: https")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.HealthCheck.Path != "/" || cfg.HealthCheck.Status != 200 {
+		t.Errorf("unexpected https health check %+v", *cfg.HealthCheck)
+	}
+}
+
+func TestParseVIPConfigErrorLine(t *testing.T) {
+	testcases := map[string]struct {
+		Input string
+		Error string
+	}{
+		"unknown field":   {"service: default/echoheaders\nmethd: DR", `line 2: unknown field "methd"`},
+		"invalid type":    {"service: default/echoheaders\nhealthCheck:\n  timeout: soon", "line 3: healthCheck.timeout: cannot use a string as int"},
+		"syntax":          {"service: default/echoheaders\n  method: DR: NAT", "line 2: mapping values are not allowed in this context"},
+		"invalid method":  {"service: default/echoheaders\nmethod: AJAX", "line 2: invalid LVS method"},
+		"invalid rule":    {"mode: http\nrules:\n- service: default/web\n  path: /\n- service: default/api\n  path: api", "line 6: invalid rule: path api must start with /"},
+		"invalid check":   {"service: default/echoheaders\nhealthCheck:\n  type: http\n  status: 999", "line 4: invalid status code 999"},
+		"json":            {`{"service": "default/echoheaders", "scheduler": "random"}`, "line 1: invalid scheduler random"},
+		"sni after rules": {"mode: http\nrules:\n- service: default/web\ntls: [default/cert]\nsni:\n- service: other", "line 5: tls and sni cannot be used in the same VIP"},
+	}
+
+	for k, tc := range testcases {
+		_, err := parseVIPConfig(tc.Input)
+		if err == nil {
+			t.Errorf("%s: expected an error", k)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), tc.Error) {
+			t.Errorf("%s: expected error %q but returned %q", k, tc.Error, err)
+		}
+	}
+}
+
+func TestFieldLine(t *testing.T) {
+	value := "mode: http\nrules:\n- service: default/web\n  path: /\n- host: example.com\n  service: default/api\nsni:\n- service: default/other"
+	testcases := map[string]int{
+		"mode":            1,
+		"rules":           2,
+		"rules.0.service": 3,
+		"rules.1":         5,
+		"rules.1.service": 6,
+		"sni.0.service":   8,
+		"rules.2":         0,
+		"tls":             0,
+	}
+
+	for path, line := range testcases {
+		if got := fieldLine(value, path); got != line {
+			t.Errorf("%v: expected line %v but returned %v", path, line, got)
+		}
+	}
+}
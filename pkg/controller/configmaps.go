@@ -0,0 +1,280 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// configMapServices contains the VIPs defined in a services ConfigMap
+type configMapServices struct {
+	// Key is the namespace/name of the ConfigMap
+	Key    string
+	VIPs   []vip
+	Tracks []backendTrack
+}
+
+// vipConflict is a VIP and port defined in more than one ConfigMap
+type vipConflict struct {
+	VIP  string
+	Port int
+	// Winner is the ConfigMap that uses the VIP and Loser the ignored one
+	Winner string
+	Loser  string
+}
+
+func (c vipConflict) String() string {
+	port := "all ports"
+	if c.Port != 0 {
+		port = fmt.Sprintf("port %v", c.Port)
+	}
+
+	return fmt.Sprintf("VIP %v (%v) of configmap %v is already used by configmap %v", c.VIP, port, c.Loser, c.Winner)
+}
+
+func (c vipConflict) configMap() string {
+	return c.Loser
+}
+
+func (c vipConflict) reason() string {
+	return "VIPConflict"
+}
+
+// configMapConflict is a VIP of a ConfigMap ignored due to a conflict
+type configMapConflict interface {
+	String() string
+	// configMap returns the ConfigMap that lost the VIP
+	configMap() string
+	// reason returns the reason of the event
+	reason() string
+}
+
+func configMapKey(cfgMap *apiv1.ConfigMap) string {
+	return fmt.Sprintf("%v/%v", cfgMap.Namespace, cfgMap.Name)
+}
+
+// isServicesConfigMap returns true if the ConfigMap contains VIPs
+func (ipvsc *ipvsControllerController) isServicesConfigMap(cfgMap *apiv1.ConfigMap) bool {
+	if contains(ipvsc.configMapNames, configMapKey(cfgMap)) {
+		return true
+	}
+
+	return ipvsc.configMapSelector != nil && ipvsc.configMapSelector.Matches(labels.Set(cfgMap.Labels))
+}
+
+// checkReferences returns an error if a ConfigMap selected by the label
+// selector references services or secrets of other namespaces. The
+// ConfigMaps listed by name can reference any namespace.
+func (ipvsc *ipvsControllerController) checkReferences(cfgMap *apiv1.ConfigMap, cfg *vipConfig) error {
+	if ipvsc.configMapSelector == nil || ipvsc.configMapCrossNamespace || contains(ipvsc.configMapNames, configMapKey(cfgMap)) {
+		return nil
+	}
+
+	for _, ref := range append(cfg.services(), cfg.TLS...) {
+		ns, _, err := parseNsName(ref)
+		if err != nil {
+			return err
+		}
+
+		if ns != cfgMap.Namespace {
+			return fmt.Errorf("%v is not in the namespace of configmap %v (see --services-configmap-cross-namespace)", ref, configMapKey(cfgMap))
+		}
+	}
+
+	return nil
+}
+
+// getServicesConfigMaps returns the ConfigMaps with VIPs. The oldest
+// ConfigMaps are first, so they keep the VIPs used by newer ones.
+func (ipvsc *ipvsControllerController) getServicesConfigMaps() ([]*apiv1.ConfigMap, error) {
+	cfgMaps := []*apiv1.ConfigMap{}
+	seen := map[string]bool{}
+	for _, lister := range ipvsc.mapListers {
+		for _, obj := range lister.Store.List() {
+			cfgMap := obj.(*apiv1.ConfigMap)
+			key := configMapKey(cfgMap)
+			if seen[key] || !ipvsc.isServicesConfigMap(cfgMap) {
+				continue
+			}
+
+			seen[key] = true
+			cfgMaps = append(cfgMaps, cfgMap)
+		}
+	}
+
+	if ipvsc.configMapSelector == nil && len(cfgMaps) == 0 {
+		return nil, fmt.Errorf("configmaps %v were not found", ipvsc.configMapNames)
+	}
+
+	for _, name := range ipvsc.configMapNames {
+		if !seen[name] {
+			glog.Warningf("configmap %v was not found", name)
+		}
+	}
+
+	sortConfigMaps(cfgMaps)
+	return cfgMaps, nil
+}
+
+// sortConfigMaps sorts ConfigMaps by creation time and namespace/name
+func sortConfigMaps(cfgMaps []*apiv1.ConfigMap) {
+	sort.SliceStable(cfgMaps, func(i, j int) bool {
+		ti := cfgMaps[i].CreationTimestamp
+		tj := cfgMaps[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+
+		return configMapKey(cfgMaps[i]) < configMapKey(cfgMaps[j])
+	})
+}
+
+// mergeServices returns the VIPs of all the ConfigMaps. A VIP and port
+// used by more than one ConfigMap is kept in the first ConfigMap of the
+// list. Entries without services (VIP only) use all the ports of the VIP.
+func mergeServices(sources []configMapServices) ([]vip, []backendTrack, []vipConflict) {
+	// owners contains the ConfigMap using each VIP and port. Port 0
+	// means all the ports
+	owners := map[string]map[int]string{}
+	svcs := []vip{}
+	tracks := []backendTrack{}
+	conflicts := []vipConflict{}
+
+	for _, source := range sources {
+		claimed := map[string]bool{}
+		for _, svc := range source.VIPs {
+			ip := normalizeIP(svc.IP)
+			ports := svc.bindPorts()
+			if svc.LVSMethod == "VIP" {
+				ports = []int{0}
+			}
+
+			conflict := false
+			for _, port := range ports {
+				if winner := portOwner(owners[ip], port, source.Key); winner != "" {
+					conflicts = appendConflict(conflicts, vipConflict{VIP: svc.IP, Port: port, Winner: winner, Loser: source.Key})
+					conflict = true
+					break
+				}
+			}
+			if conflict {
+				continue
+			}
+
+			if owners[ip] == nil {
+				owners[ip] = map[int]string{}
+			}
+			for _, port := range ports {
+				owners[ip][port] = source.Key
+			}
+			claimed[ip] = true
+			svcs = append(svcs, svc)
+		}
+
+		for _, track := range source.Tracks {
+			if claimed[normalizeIP(track.VIP)] {
+				tracks = append(tracks, track)
+			}
+		}
+	}
+
+	sort.Sort(vipByNameIPPort(svcs))
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].VIP < tracks[j].VIP
+	})
+
+	return svcs, tracks, conflicts
+}
+
+// portOwner returns the ConfigMap, other than the given one, that uses the
+// port of a VIP
+func portOwner(ports map[int]string, port int, key string) string {
+	used := []int{}
+	for p := range ports {
+		used = append(used, p)
+	}
+	sort.Ints(used)
+
+	for _, p := range used {
+		owner := ports[p]
+		if owner == key {
+			continue
+		}
+
+		if p == port || p == 0 || port == 0 {
+			return owner
+		}
+	}
+
+	return ""
+}
+
+func appendConflict(conflicts []vipConflict, conflict vipConflict) []vipConflict {
+	for _, c := range conflicts {
+		if c == conflict {
+			return conflicts
+		}
+	}
+
+	return append(conflicts, conflict)
+}
+
+func normalizeIP(ip string) string {
+	if addr := net.ParseIP(ip); addr != nil {
+		return addr.String()
+	}
+
+	return ip
+}
+
+// reportConflicts logs the VIPs ignored due to conflicts and creates an
+// event in the ConfigMap that lost the VIP the first time it is found
+func (ipvsc *ipvsControllerController) reportConflicts(conflicts []configMapConflict, cfgMaps []*apiv1.ConfigMap) {
+	byKey := map[string]*apiv1.ConfigMap{}
+	for _, cfgMap := range cfgMaps {
+		byKey[configMapKey(cfgMap)] = cfgMap
+	}
+
+	current := map[string]bool{}
+	for _, conflict := range conflicts {
+		msg := conflict.String()
+		current[msg] = true
+		if ipvsc.vipConflicts[msg] {
+			continue
+		}
+
+		glog.Warning(msg)
+		if cfgMap, ok := byKey[conflict.configMap()]; ok {
+			ipvsc.recordEventFor(apiv1.ObjectReference{
+				Kind:       "ConfigMap",
+				APIVersion: "v1",
+				Namespace:  cfgMap.Namespace,
+				Name:       cfgMap.Name,
+				UID:        cfgMap.UID,
+			}, apiv1.EventTypeWarning, conflict.reason(), msg)
+		}
+	}
+
+	ipvsc.vipConflicts = current
+}
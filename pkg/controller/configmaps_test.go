@@ -0,0 +1,200 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestMergeServices(t *testing.T) {
+	testcases := map[string]struct {
+		Sources   []configMapServices
+		VIPs      []string
+		Conflicts []vipConflict
+	}{
+		"different VIPs": {
+			[]configMapServices{
+				{Key: "a/vips", VIPs: []vip{{IP: "10.0.0.1", Port: 80, LVSMethod: "NAT"}}},
+				{Key: "b/vips", VIPs: []vip{{IP: "10.0.0.2", Port: 80, LVSMethod: "NAT"}}},
+			},
+			[]string{"10.0.0.1:80", "10.0.0.2:80"},
+			[]vipConflict{},
+		},
+		"same VIP different ports": {
+			[]configMapServices{
+				{Key: "a/vips", VIPs: []vip{{IP: "10.0.0.1", Port: 80, LVSMethod: "NAT"}}},
+				{Key: "b/vips", VIPs: []vip{{IP: "10.0.0.1", Port: 443, LVSMethod: "NAT"}}},
+			},
+			[]string{"10.0.0.1:80", "10.0.0.1:443"},
+			[]vipConflict{},
+		},
+		"same VIP and port": {
+			[]configMapServices{
+				{Key: "a/vips", VIPs: []vip{{IP: "10.0.0.1", Port: 80, LVSMethod: "NAT"}}},
+				{Key: "b/vips", VIPs: []vip{{IP: "10.0.0.1", Port: 80, LVSMethod: "DR"}}},
+			},
+			[]string{"10.0.0.1:80"},
+			[]vipConflict{{VIP: "10.0.0.1", Port: 80, Winner: "a/vips", Loser: "b/vips"}},
+		},
+		"VIP only uses all the ports": {
+			[]configMapServices{
+				{Key: "a/vips", VIPs: []vip{{IP: "10.0.0.1", LVSMethod: "VIP"}}},
+				{Key: "b/vips", VIPs: []vip{{IP: "10.0.0.1", Port: 80, LVSMethod: "NAT"}}},
+			},
+			[]string{"10.0.0.1:0"},
+			[]vipConflict{{VIP: "10.0.0.1", Port: 80, Winner: "a/vips", Loser: "b/vips"}},
+		},
+		"http with TLS uses the HTTPS port": {
+			[]configMapServices{
+				{Key: "a/vips", VIPs: []vip{{IP: "10.0.0.1", Port: 80, LVSMethod: "NAT", Mode: modeHTTP,
+					Certificates: []certificate{{Name: "default/cert"}}}}},
+				{Key: "b/vips", VIPs: []vip{{IP: "10.0.0.1", Port: 443, LVSMethod: "NAT", Mode: modeSNI}}},
+			},
+			[]string{"10.0.0.1:80"},
+			[]vipConflict{{VIP: "10.0.0.1", Port: 443, Winner: "a/vips", Loser: "b/vips"}},
+		},
+		"HTTPS port used before http with TLS": {
+			[]configMapServices{
+				{Key: "a/vips", VIPs: []vip{{IP: "10.0.0.1", Port: 443, LVSMethod: "NAT", Mode: modeTCP}}},
+				{Key: "b/vips", VIPs: []vip{{IP: "10.0.0.1", Port: 80, LVSMethod: "NAT", Mode: modeHTTP,
+					Certificates: []certificate{{Name: "default/cert"}}}}},
+			},
+			[]string{"10.0.0.1:443"},
+			[]vipConflict{{VIP: "10.0.0.1", Port: 443, Winner: "a/vips", Loser: "b/vips"}},
+		},
+		"IPv6 in different formats": {
+			[]configMapServices{
+				{Key: "a/vips", VIPs: []vip{{IP: "fd00::1", Port: 80, LVSMethod: "NAT"}}},
+				{Key: "b/vips", VIPs: []vip{{IP: "fd00:0::1", Port: 80, LVSMethod: "NAT"}}},
+			},
+			[]string{"fd00::1:80"},
+			[]vipConflict{{VIP: "fd00:0::1", Port: 80, Winner: "a/vips", Loser: "b/vips"}},
+		},
+	}
+
+	for k, tc := range testcases {
+		svcs, _, conflicts := mergeServices(tc.Sources)
+
+		vips := []string{}
+		for _, svc := range svcs {
+			vips = append(vips, fmt.Sprintf("%v:%v", svc.IP, svc.Port))
+		}
+
+		if !reflect.DeepEqual(vips, tc.VIPs) {
+			t.Errorf("%s: expected VIPs %v but returned %v", k, tc.VIPs, vips)
+		}
+		if !reflect.DeepEqual(conflicts, tc.Conflicts) {
+			t.Errorf("%s: expected conflicts %v but returned %v", k, tc.Conflicts, conflicts)
+		}
+	}
+}
+
+func TestMergeServicesTracks(t *testing.T) {
+	sources := []configMapServices{
+		{
+			Key:    "a/vips",
+			VIPs:   []vip{{IP: "10.0.0.1", Port: 80, LVSMethod: "NAT"}},
+			Tracks: []backendTrack{{VIP: "10.0.0.1", Mode: trackFault}},
+		},
+		{
+			Key:    "b/vips",
+			VIPs:   []vip{{IP: "10.0.0.1", Port: 80, LVSMethod: "NAT"}},
+			Tracks: []backendTrack{{VIP: "10.0.0.1", Mode: trackPriority, Weight: 10}},
+		},
+	}
+
+	_, tracks, _ := mergeServices(sources)
+	expected := []backendTrack{{VIP: "10.0.0.1", Mode: trackFault}}
+	if !reflect.DeepEqual(tracks, expected) {
+		t.Errorf("expected tracks %v but returned %v", expected, tracks)
+	}
+}
+
+func TestSortConfigMaps(t *testing.T) {
+	now := time.Now()
+	newConfigMap := func(ns, name string, created time.Time) *apiv1.ConfigMap {
+		return &apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         ns,
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(created),
+			},
+		}
+	}
+
+	cfgMaps := []*apiv1.ConfigMap{
+		newConfigMap("b", "vips", now),
+		newConfigMap("c", "vips", now.Add(-time.Hour)),
+		newConfigMap("a", "vips", now),
+	}
+
+	sortConfigMaps(cfgMaps)
+
+	keys := []string{}
+	for _, cfgMap := range cfgMaps {
+		keys = append(keys, configMapKey(cfgMap))
+	}
+
+	expected := []string{"c/vips", "a/vips", "b/vips"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v but returned %v", expected, keys)
+	}
+}
+
+func TestCheckReferences(t *testing.T) {
+	testcases := map[string]struct {
+		ConfigMap      string
+		CrossNamespace bool
+		Value          string
+		Valid          bool
+	}{
+		"same namespace":         {"team-a/vips", false, "team-a/echoheaders", true},
+		"other namespace":        {"team-a/vips", false, "team-b/echoheaders", false},
+		"other namespace rule":   {"team-a/vips", false, "mode: http\nrules:\n- service: team-b/echoheaders\n  port: 80", false},
+		"other namespace secret": {"team-a/vips", false, "mode: http\nrules:\n- service: team-a/echoheaders\n  port: 80\ntls: [team-b/cert]", false},
+		"cross namespace":        {"team-a/vips", true, "team-b/echoheaders", true},
+		"listed configmap":       {"default/vip-configmap", false, "team-b/echoheaders", true},
+	}
+
+	for k, tc := range testcases {
+		ipvsc := &ipvsControllerController{
+			configMapNames:          []string{"default/vip-configmap"},
+			configMapSelector:       labels.SelectorFromSet(labels.Set{"keepalived-vip/vips": "true"}),
+			configMapCrossNamespace: tc.CrossNamespace,
+		}
+
+		ns, name, _ := parseNsName(tc.ConfigMap)
+		cfgMap := &apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+
+		cfg, err := parseVIPConfig(tc.Value)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", k, err)
+		}
+
+		err = ipvsc.checkReferences(cfgMap, cfg)
+		if (err == nil) != tc.Valid {
+			t.Errorf("%s: expected valid %v but returned %v", k, tc.Valid, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// clusterConflict is a VIP of a ConfigMap used by other object of the cluster
+type clusterConflict struct {
+	VIP       string
+	ConfigMap string
+	// Object describes the object and the field using the VIP
+	Object string
+}
+
+func (c clusterConflict) String() string {
+	return fmt.Sprintf("VIP %v of configmap %v conflicts with the %v", c.VIP, c.ConfigMap, c.Object)
+}
+
+func (c clusterConflict) configMap() string {
+	return c.ConfigMap
+}
+
+func (c clusterConflict) reason() string {
+	return "VIPClusterConflict"
+}
+
+// clusterAddress is an address or range used by an object of the cluster
+type clusterAddress struct {
+	Object string
+	// Service is the name of the service (namespace-name) using the address.
+	// A VIP can use the addresses of the service it exposes
+	Service string
+	Net     *net.IPNet
+}
+
+// clusterAddresses returns the external IPs and load balancer IPs of the
+// services of all the namespaces and the addresses and pod CIDRs of the
+// nodes, sorted by object
+func (ipvsc *ipvsControllerController) clusterAddresses() []clusterAddress {
+	addresses := []clusterAddress{}
+	add := func(object, service, addr string) {
+		if addr == "" {
+			return
+		}
+
+		ipNet, err := parseCIDROrIP(addr)
+		if err != nil {
+			glog.V(2).Infof("ignoring address %v of the %v: %v", addr, object, err)
+			return
+		}
+
+		addresses = append(addresses, clusterAddress{Object: object, Service: service, Net: ipNet})
+	}
+
+	// svcLister contains all the services when they are not filtered
+	svcStore := ipvsc.svcLister.Store
+	if ipvsc.allSvcLister.Store != nil {
+		svcStore = ipvsc.allSvcLister.Store
+	}
+
+	for _, obj := range svcStore.List() {
+		s := obj.(*apiv1.Service)
+		key := fmt.Sprintf("%v/%v", s.Namespace, s.Name)
+		name := fmt.Sprintf("%v-%v", s.Namespace, s.Name)
+
+		for _, ip := range s.Spec.ExternalIPs {
+			add(fmt.Sprintf("externalIPs of service %v", key), name, ip)
+		}
+		add(fmt.Sprintf("loadBalancerIP of service %v", key), name, s.Spec.LoadBalancerIP)
+		for _, ingress := range s.Status.LoadBalancer.Ingress {
+			add(fmt.Sprintf("load balancer ingress of service %v", key), name, ingress.IP)
+		}
+	}
+
+	if ipvsc.nodeLister.Store != nil {
+		for _, obj := range ipvsc.nodeLister.Store.List() {
+			node := obj.(*apiv1.Node)
+			for _, address := range node.Status.Addresses {
+				if address.Type == apiv1.NodeInternalIP || address.Type == apiv1.NodeExternalIP {
+					add(fmt.Sprintf("%v of node %v", address.Type, node.Name), "", address.Address)
+				}
+			}
+			add(fmt.Sprintf("pod CIDR of node %v", node.Name), "", node.Spec.PodCIDR)
+		}
+	}
+
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return addresses[i].Object < addresses[j].Object
+	})
+
+	return addresses
+}
+
+// findClusterConflicts removes from the ConfigMaps the VIPs used by other
+// objects of the cluster. All the entries of a conflicting VIP are removed.
+func findClusterConflicts(sources []configMapServices, addresses []clusterAddress) ([]configMapServices, []clusterConflict) {
+	conflicts := []clusterConflict{}
+	result := []configMapServices{}
+
+	for _, source := range sources {
+		// services exposed by each VIP of the ConfigMap
+		exposed := map[string]map[string]bool{}
+		ips := []string{}
+		for _, svc := range source.VIPs {
+			ip := normalizeIP(svc.IP)
+			if exposed[ip] == nil {
+				exposed[ip] = map[string]bool{}
+				ips = append(ips, ip)
+			}
+			exposed[ip][svc.Name] = true
+		}
+		sort.Strings(ips)
+
+		skip := map[string]bool{}
+		for _, ip := range ips {
+			addr := net.ParseIP(ip)
+			if addr == nil {
+				continue
+			}
+
+			for _, address := range addresses {
+				if address.Service != "" && exposed[ip][address.Service] {
+					continue
+				}
+
+				if address.Net.Contains(addr) {
+					skip[ip] = true
+					conflicts = append(conflicts, clusterConflict{VIP: ip, ConfigMap: source.Key, Object: address.Object})
+					break
+				}
+			}
+		}
+
+		filtered := configMapServices{Key: source.Key, VIPs: []vip{}, Tracks: []backendTrack{}}
+		for _, svc := range source.VIPs {
+			if !skip[normalizeIP(svc.IP)] {
+				filtered.VIPs = append(filtered.VIPs, svc)
+			}
+		}
+		for _, track := range source.Tracks {
+			if !skip[normalizeIP(track.VIP)] {
+				filtered.Tracks = append(filtered.Tracks, track)
+			}
+		}
+
+		result = append(result, filtered)
+	}
+
+	return result, conflicts
+}
+
+// parseCIDROrIP returns the network of a CIDR or an IP address
+func parseCIDROrIP(value string) (*net.IPNet, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address or CIDR %v", value)
+	}
+
+	return ipNet, nil
+}
+
+// serviceAddressesChanged returns true if the external or load balancer
+// addresses of a service changed
+func serviceAddressesChanged(old, cur *apiv1.Service) bool {
+	return !reflect.DeepEqual(old.Spec.ExternalIPs, cur.Spec.ExternalIPs) ||
+		old.Spec.LoadBalancerIP != cur.Spec.LoadBalancerIP ||
+		!reflect.DeepEqual(old.Status.LoadBalancer, cur.Status.LoadBalancer)
+}
+
+// nodeAddressesChanged returns true if the addresses or the pod CIDR of a
+// node changed
+func nodeAddressesChanged(old, cur *apiv1.Node) bool {
+	return !reflect.DeepEqual(old.Status.Addresses, cur.Status.Addresses) ||
+		old.Spec.PodCIDR != cur.Spec.PodCIDR
+}
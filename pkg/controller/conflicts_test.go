@@ -0,0 +1,145 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestClusterConflicts(t *testing.T) {
+	ipvsc := &ipvsControllerController{}
+	ipvsc.svcLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	ipvsc.nodeLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+	ipvsc.svcLister.Store.Add(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "echoheaders"},
+		Spec:       apiv1.ServiceSpec{ExternalIPs: []string{"10.4.0.50"}},
+	})
+	ipvsc.svcLister.Store.Add(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other-lb"},
+		Spec:       apiv1.ServiceSpec{Type: apiv1.ServiceTypeLoadBalancer, LoadBalancerIP: "10.4.0.51"},
+		Status: apiv1.ServiceStatus{LoadBalancer: apiv1.LoadBalancerStatus{
+			Ingress: []apiv1.LoadBalancerIngress{{IP: "10.4.0.52"}},
+		}},
+	})
+	ipvsc.nodeLister.Store.Add(&apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       apiv1.NodeSpec{PodCIDR: "10.244.1.0/24"},
+		Status: apiv1.NodeStatus{Addresses: []apiv1.NodeAddress{
+			{Type: apiv1.NodeInternalIP, Address: "10.4.0.2"},
+			{Type: apiv1.NodeHostName, Address: "node1"},
+		}},
+	})
+
+	sources := []configMapServices{
+		{
+			Key: "default/vip-configmap",
+			VIPs: []vip{
+				// the VIP of the exposed service can be an external IP of the service
+				{Name: "default-echoheaders", IP: "10.4.0.50", Port: 80},
+				{Name: "default-echoheaders", IP: "10.4.0.51", Port: 80},
+				{Name: "default-echoheaders", IP: "10.4.0.51", Port: 443},
+				{Name: "default-echoheaders", IP: "10.4.0.60", Port: 80},
+			},
+			Tracks: []backendTrack{{VIP: "10.4.0.51"}, {VIP: "10.4.0.60"}},
+		},
+		{
+			Key: "team-a/vips",
+			VIPs: []vip{
+				{Name: "team-a-app", IP: "10.4.0.50", Port: 8080},
+				{IP: "10.4.0.2", LVSMethod: "VIP"},
+				{Name: "team-a-app", IP: "10.244.1.10", Port: 80},
+				{Name: "team-a-app", IP: "10.4.0.52", Port: 80},
+			},
+		},
+	}
+
+	result, conflicts := findClusterConflicts(sources, ipvsc.clusterAddresses())
+
+	expected := []clusterConflict{
+		{VIP: "10.4.0.51", ConfigMap: "default/vip-configmap", Object: "loadBalancerIP of service default/other-lb"},
+		{VIP: "10.244.1.10", ConfigMap: "team-a/vips", Object: "pod CIDR of node node1"},
+		{VIP: "10.4.0.2", ConfigMap: "team-a/vips", Object: "InternalIP of node node1"},
+		{VIP: "10.4.0.50", ConfigMap: "team-a/vips", Object: "externalIPs of service default/echoheaders"},
+		{VIP: "10.4.0.52", ConfigMap: "team-a/vips", Object: "load balancer ingress of service default/other-lb"},
+	}
+	if !reflect.DeepEqual(conflicts, expected) {
+		t.Errorf("expected %v but returned %v", expected, conflicts)
+	}
+
+	vips := [][]string{getVIPs(result[0].VIPs), getVIPs(result[1].VIPs)}
+	if !reflect.DeepEqual(vips, [][]string{{"10.4.0.50", "10.4.0.60"}, {}}) {
+		t.Errorf("unexpected VIPs %v", vips)
+	}
+
+	if !reflect.DeepEqual(result[0].Tracks, []backendTrack{{VIP: "10.4.0.60"}}) {
+		t.Errorf("unexpected tracks %v", result[0].Tracks)
+	}
+}
+
+func TestParseCIDROrIP(t *testing.T) {
+	testcases := map[string]string{
+		"10.4.0.50":     "10.4.0.50/32",
+		"fd00::1":       "fd00::1/128",
+		"10.244.1.0/24": "10.244.1.0/24",
+		"10.244.1.1/24": "10.244.1.0/24",
+	}
+
+	for value, expected := range testcases {
+		ipNet, err := parseCIDROrIP(value)
+		if err != nil || ipNet.String() != expected {
+			t.Errorf("%v: expected %v but returned %v (%v)", value, expected, ipNet, err)
+		}
+	}
+
+	if _, err := parseCIDROrIP("node1"); err == nil {
+		t.Errorf("expected an error parsing node1")
+	}
+}
+
+func TestClusterAddressesFilteredServices(t *testing.T) {
+	ipvsc := &ipvsControllerController{}
+	ipvsc.svcLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	ipvsc.allSvcLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+	watched := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "echoheaders"},
+		Spec:       apiv1.ServiceSpec{ExternalIPs: []string{"10.4.0.50"}},
+	}
+	ipvsc.svcLister.Store.Add(watched)
+	ipvsc.allSvcLister.Store.Add(watched)
+	// service outside the watched namespaces
+	ipvsc.allSvcLister.Store.Add(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "web"},
+		Spec:       apiv1.ServiceSpec{ExternalIPs: []string{"10.4.0.51"}},
+	})
+
+	objects := []string{}
+	for _, address := range ipvsc.clusterAddresses() {
+		objects = append(objects, address.Object)
+	}
+
+	expected := []string{"externalIPs of service default/echoheaders", "externalIPs of service team-b/web"}
+	if !reflect.DeepEqual(objects, expected) {
+		t.Errorf("expected %v but returned %v", expected, objects)
+	}
+}
@@ -0,0 +1,573 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/aledbf/kube-keepalived-vip/pkg/k8s"
+)
+
+const (
+	// dadProbes is the number of probes sent for each VIP
+	dadProbes        = 3
+	dadProbeInterval = 200 * time.Millisecond
+	// dadWait is the time to wait for answers after the first probe
+	dadWait = time.Second
+	// dadRetryInterval is the time to wait before probing again a VIP
+	// used by other host
+	dadRetryInterval = 30 * time.Second
+)
+
+var (
+	zeroMAC = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+	// vrrpMACPrefix is the prefix of the virtual MAC addresses used by VRRP
+	// (00:00:5e:00:01:<vrid> for IPv4 and 00:00:5e:00:02:<vrid> for IPv6)
+	vrrpMACPrefix = []byte{0, 0, 0x5e, 0}
+)
+
+// addressProbe returns the MAC address of the hosts, other than the nodes
+// of the cluster, answering for the VIPs
+type addressProbe func(iface string, vips, neighbors []string, vrids []int) (map[string]string, error)
+
+// dadResult is the result of the duplicate address detection of a VIP
+type dadResult struct {
+	// MAC is the address of the host using the VIP. Empty if the VIP is free
+	MAC     string
+	checked time.Time
+}
+
+// checkDuplicateAddresses probes the VIPs not announced yet and returns the
+// services without the VIPs used by other hosts of the network. The VIPs
+// already announced are not probed again.
+func (ipvsc *ipvsControllerController) checkDuplicateAddresses(svcs []vip) []vip {
+	if !ipvsc.duplicateAddressDetection {
+		return svcs
+	}
+
+	k := ipvsc.keepalived
+	now := time.Now()
+
+	peers := ipvsc.peerVIPs()
+
+	ipvsc.dadLock.Lock()
+	results := map[string]*dadResult{}
+	probe := []string{}
+	// VIPs to probe in each interface
+	ifaces := map[string][]string{}
+	for _, svc := range svcs {
+		ip := svc.IP
+		if _, ok := results[ip]; ok || contains(probe, ip) {
+			continue
+		}
+
+		// the VIPs held by other nodes of the cluster are not probed, the
+		// MAC address of the node can be unknown (like in other subnet)
+		if peers[normalizeIP(ip)] {
+			glog.V(2).Infof("VIP %v is held by other node, skipping the probe", ip)
+			results[ip] = &dadResult{checked: now}
+			continue
+		}
+
+		result, ok := ipvsc.dadResults[ip]
+		if ok && (result.MAC == "" || now.Sub(result.checked) < dadRetryInterval) {
+			results[ip] = result
+			continue
+		}
+
+		iface := svc.Interface
+		if iface == "" {
+			iface = k.iface
+		}
+		probe = append(probe, ip)
+		ifaces[iface] = append(ifaces[iface], ip)
+	}
+	ipvsc.dadLock.Unlock()
+
+	if len(probe) > 0 {
+		vrids := []int{k.vrid}
+		for _, group := range k.getGroups() {
+			vrids = append(vrids, group.VRID)
+		}
+
+		neighbors := ipvsc.neighborAddresses()
+
+		names := []string{}
+		for iface := range ifaces {
+			names = append(names, iface)
+		}
+		sort.Strings(names)
+
+		conflicts := map[string]string{}
+		for _, iface := range names {
+			glog.V(2).Infof("probing VIPs %v in %v", ifaces[iface], iface)
+			found, err := ipvsc.addressProbe(iface, ifaces[iface], neighbors, vrids)
+			if err != nil {
+				// the VIPs are announced if the probe fails
+				glog.Warningf("error probing VIPs in %v: %v", iface, err)
+				continue
+			}
+
+			for ip, mac := range found {
+				conflicts[ip] = mac
+			}
+		}
+
+		for _, ip := range probe {
+			previous := results[ip]
+			if previous == nil {
+				previous = ipvsc.dadResults[ip]
+			}
+			result := &dadResult{MAC: conflicts[ip], checked: now}
+			results[ip] = result
+
+			switch {
+			case result.MAC != "" && (previous == nil || previous.MAC != result.MAC):
+				msg := fmt.Sprintf("VIP %v is used by other host (%v), it will not be announced", ip, result.MAC)
+				glog.Warning(msg)
+				ipvsc.recordEvent(apiv1.EventTypeWarning, "DuplicateAddress", msg)
+			case result.MAC == "" && previous != nil && previous.MAC != "":
+				msg := fmt.Sprintf("VIP %v is not used by other host anymore", ip)
+				glog.Info(msg)
+				ipvsc.recordEvent(apiv1.EventTypeNormal, "DuplicateAddressResolved", msg)
+			}
+		}
+	}
+
+	// VIPs removed from the configuration are probed again if added
+	ipvsc.dadLock.Lock()
+	ipvsc.dadResults = results
+	ipvsc.dadLock.Unlock()
+
+	filtered := []vip{}
+	held := false
+	for _, svc := range svcs {
+		if results[svc.IP].MAC == "" {
+			filtered = append(filtered, svc)
+		} else {
+			held = true
+		}
+	}
+
+	if held && ipvsc.syncQueue != nil {
+		if ipvsc.dadTimer != nil {
+			ipvsc.dadTimer.Stop()
+		}
+		ipvsc.dadTimer = time.AfterFunc(dadRetryInterval, func() {
+			ipvsc.syncQueue.Enqueue(cache.ExplicitKey(fmt.Sprintf("%v/%v", ipvsc.podNamespace, ipvsc.podName)))
+		})
+	}
+
+	return filtered
+}
+
+// peerVIPs returns the VIPs held by other nodes of the cluster, published
+// in the leases of the split brain detection or of the lease mode
+func (ipvsc *ipvsControllerController) peerVIPs() map[string]bool {
+	peers := map[string]bool{}
+
+	ipvsc.splitBrainLock.Lock()
+	for ip := range ipvsc.peerMasters {
+		peers[ip] = true
+	}
+	ipvsc.splitBrainLock.Unlock()
+
+	if l, ok := ipvsc.announcer.(*leaseAnnouncer); ok {
+		for ip := range l.heldByOthers() {
+			peers[ip] = true
+		}
+	}
+
+	return peers
+}
+
+// neighborAddresses returns the addresses of the other nodes of the
+// cluster. The VIPs can be held by these nodes.
+func (ipvsc *ipvsControllerController) neighborAddresses() []string {
+	neighbors := append([]string{}, ipvsc.keepalived.neighbors...)
+	if ipvsc.nodeLister.Store == nil {
+		return neighbors
+	}
+
+	for _, obj := range ipvsc.nodeLister.Store.List() {
+		node := obj.(*apiv1.Node)
+		if node.Name == ipvsc.nodeName {
+			continue
+		}
+
+		for _, address := range node.Status.Addresses {
+			if address.Type == apiv1.NodeInternalIP || address.Type == apiv1.NodeExternalIP {
+				neighbors = appendIfMissing(neighbors, address.Address)
+			}
+		}
+
+		if ipvsc.nodeAddressPolicy != nil {
+			if address := k8s.NodeAddress(node, ipvsc.nodeAddressPolicy); address != "" {
+				neighbors = appendIfMissing(neighbors, address)
+			}
+		}
+	}
+
+	return neighbors
+}
+
+// duplicateAddresses returns the VIPs used by other hosts
+func (ipvsc *ipvsControllerController) duplicateAddresses() map[string]string {
+	ipvsc.dadLock.Lock()
+	defer ipvsc.dadLock.Unlock()
+
+	duplicates := map[string]string{}
+	for ip, result := range ipvsc.dadResults {
+		if result.MAC != "" {
+			duplicates[ip] = result.MAC
+		}
+	}
+
+	return duplicates
+}
+
+// arpRequest returns an ethernet frame with an ARP request. A probe uses
+// the unspecified address as sender (RFC 5227)
+func arpRequest(mac net.HardwareAddr, sender, target net.IP) []byte {
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcastMAC...)
+	frame = append(frame, mac...)
+	frame = append(frame, 0x08, 0x06)
+
+	frame = append(frame, 0, 1, 0x08, 0x00, 6, 4, 0, 1)
+	frame = append(frame, mac...)
+	frame = append(frame, sender.To4()...)
+	frame = append(frame, zeroMAC...)
+	frame = append(frame, target.To4()...)
+
+	return frame
+}
+
+// parseARP returns the sender of an ethernet frame with an ARP packet
+func parseARP(frame []byte) (net.HardwareAddr, net.IP, bool) {
+	if len(frame) < 42 || frame[12] != 0x08 || frame[13] != 0x06 {
+		return nil, nil, false
+	}
+
+	arp := frame[14:]
+	if arp[4] != 6 || arp[5] != 4 {
+		return nil, nil, false
+	}
+
+	return net.HardwareAddr(arp[8:14]), net.IP(arp[14:18]), true
+}
+
+// neighborSolicitation returns an ICMPv6 neighbor solicitation for the
+// target with the link-layer address of the interface
+func neighborSolicitation(mac net.HardwareAddr, target net.IP) []byte {
+	msg := make([]byte, 0, 32)
+	// type 135 (neighbor solicitation), code, checksum and reserved
+	msg = append(msg, 135, 0, 0, 0, 0, 0, 0, 0)
+	msg = append(msg, target.To16()...)
+	// source link-layer address option
+	msg = append(msg, 1, 1)
+	msg = append(msg, mac...)
+
+	return msg
+}
+
+// parseNeighborAdvert returns the target and the link-layer address of an
+// ICMPv6 neighbor advertisement
+func parseNeighborAdvert(msg []byte) (net.IP, net.HardwareAddr, bool) {
+	if len(msg) < 24 || msg[0] != 136 {
+		return nil, nil, false
+	}
+
+	target := net.IP(msg[8:24])
+	options := msg[24:]
+	for len(options) >= 8 {
+		length := int(options[1]) * 8
+		if length == 0 || length > len(options) {
+			break
+		}
+
+		if options[0] == 2 && length >= 8 {
+			return target, net.HardwareAddr(options[2:8]), true
+		}
+		options = options[length:]
+	}
+
+	return target, nil, true
+}
+
+// solicitedNodeAddress returns the solicited-node multicast address of an
+// IPv6 address
+func solicitedNodeAddress(ip net.IP) net.IP {
+	addr := net.ParseIP("ff02::1:ff00:0")
+	copy(addr[13:], ip.To16()[13:])
+	return addr
+}
+
+// isVRRPMAC returns true if the address is the virtual MAC of one of the VRIDs
+func isVRRPMAC(mac net.HardwareAddr, vrids []int) bool {
+	if len(mac) != 6 || !bytes.Equal(mac[:4], vrrpMACPrefix) || (mac[4] != 1 && mac[4] != 2) {
+		return false
+	}
+
+	for _, vrid := range vrids {
+		if int(mac[5]) == vrid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// probeAddresses sends ARP probes (IPv4) and neighbor solicitations (IPv6)
+// for the VIPs in the interface, and ARP requests or neighbor solicitations
+// to the neighbors to learn the MAC addresses of the nodes. The VIPs answered by a MAC address that
+// is not from the node, other node or VRRP are returned.
+func probeAddresses(ifaceName string, vips, neighbors []string, vrids []int) (map[string]string, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("interface %v does not have an ethernet address", ifaceName)
+	}
+
+	vips4, vips6 := splitFamilies(vips)
+	neighbors4, neighbors6 := splitFamilies(neighbors)
+
+	arpFd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return nil, fmt.Errorf("error creating ARP socket: %v", err)
+	}
+	defer unix.Close(arpFd)
+
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], broadcastMAC)
+
+	err = unix.Bind(arpFd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: iface.Index})
+	if err != nil {
+		return nil, fmt.Errorf("error binding ARP socket: %v", err)
+	}
+
+	// the IPv6 neighbors are probed to learn the MAC addresses of the
+	// nodes, used by the answers for the VIPs of both families
+	icmpFd := -1
+	if len(vips6) > 0 || len(neighbors6) > 0 {
+		icmpFd, err = newICMPv6Socket(iface)
+		if err != nil && len(vips6) > 0 {
+			return nil, err
+		}
+		if err != nil {
+			glog.V(2).Infof("unable to probe IPv6 neighbors: %v", err)
+			icmpFd = -1
+		} else {
+			defer unix.Close(icmpFd)
+		}
+	}
+
+	timeout := unix.NsecToTimeval(int64(50 * time.Millisecond))
+	for _, fd := range []int{arpFd, icmpFd} {
+		if fd != -1 {
+			unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout)
+		}
+	}
+
+	answers := newProbeAnswers(iface.HardwareAddr, vips, neighbors)
+
+	sendNS := func(target net.IP) {
+		dst := &unix.SockaddrInet6{ZoneId: uint32(iface.Index)}
+		copy(dst.Addr[:], solicitedNodeAddress(target))
+		unix.Sendto(icmpFd, neighborSolicitation(iface.HardwareAddr, target), 0, dst)
+	}
+
+	send := func() {
+		// the neighbors are probed too, so the request does not depend on
+		// the subnet of the address of the node in the interface
+		for _, ip := range neighbors4 {
+			unix.Sendto(arpFd, arpRequest(iface.HardwareAddr, net.IPv4zero, ip), 0, addr)
+		}
+
+		for _, ip := range vips4 {
+			unix.Sendto(arpFd, arpRequest(iface.HardwareAddr, net.IPv4zero, ip), 0, addr)
+		}
+
+		if icmpFd == -1 {
+			return
+		}
+
+		for _, ip := range neighbors6 {
+			sendNS(ip)
+		}
+
+		for _, ip := range vips6 {
+			sendNS(ip)
+		}
+	}
+
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(dadWait)
+	next := time.Now()
+	for sent := 0; time.Now().Before(deadline); {
+		if sent < dadProbes && !time.Now().Before(next) {
+			send()
+			sent++
+			next = time.Now().Add(dadProbeInterval)
+		}
+
+		n, _, err := unix.Recvfrom(arpFd, buf, 0)
+		if err == nil {
+			if mac, ip, ok := parseARP(buf[:n]); ok {
+				answers.add(ip, mac)
+			}
+		}
+
+		if icmpFd == -1 {
+			continue
+		}
+
+		n, _, err = unix.Recvfrom(icmpFd, buf, 0)
+		if err == nil {
+			if target, mac, ok := parseNeighborAdvert(buf[:n]); ok && mac != nil {
+				answers.add(target, mac)
+			}
+		}
+	}
+
+	return answers.conflicts(vrids), nil
+}
+
+// splitFamilies returns the IPv4 and IPv6 addresses of the list
+func splitFamilies(addresses []string) ([]net.IP, []net.IP) {
+	ips4 := []net.IP{}
+	ips6 := []net.IP{}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			ips4 = append(ips4, ip)
+		default:
+			ips6 = append(ips6, ip)
+		}
+	}
+
+	return ips4, ips6
+}
+
+// probeAnswers contains the answers (ARP replies or neighbor
+// advertisements) received while probing the VIPs
+type probeAnswers struct {
+	vips      map[string]bool
+	neighbors map[string]bool
+	// nodeMACs contains the MAC addresses of the node and the neighbors
+	nodeMACs map[string]bool
+	// macs contains the MAC addresses answering for each VIP
+	macs map[string]map[string]bool
+}
+
+func newProbeAnswers(own net.HardwareAddr, vips, neighbors []string) *probeAnswers {
+	p := &probeAnswers{
+		vips:      map[string]bool{},
+		neighbors: map[string]bool{},
+		nodeMACs:  map[string]bool{own.String(): true},
+		macs:      map[string]map[string]bool{},
+	}
+
+	for _, ip := range vips {
+		p.vips[normalizeIP(ip)] = true
+	}
+	for _, ip := range neighbors {
+		p.neighbors[normalizeIP(ip)] = true
+	}
+
+	return p
+}
+
+// add records the MAC address answering for an address, a neighbor or a VIP
+func (p *probeAnswers) add(ip net.IP, mac net.HardwareAddr) {
+	switch {
+	case p.neighbors[ip.String()]:
+		p.nodeMACs[mac.String()] = true
+	case p.vips[ip.String()]:
+		if p.macs[ip.String()] == nil {
+			p.macs[ip.String()] = map[string]bool{}
+		}
+		p.macs[ip.String()][mac.String()] = true
+	}
+}
+
+// conflicts returns the VIPs answered by a MAC address that is not from
+// the node, other node or VRRP
+func (p *probeAnswers) conflicts(vrids []int) map[string]string {
+	conflicts := map[string]string{}
+	for ip, macs := range p.macs {
+		others := []string{}
+		for mac := range macs {
+			hw, _ := net.ParseMAC(mac)
+			if !p.nodeMACs[mac] && !isVRRPMAC(hw, vrids) {
+				others = append(others, mac)
+			}
+		}
+
+		if len(others) > 0 {
+			sort.Strings(others)
+			conflicts[ip] = others[0]
+		}
+	}
+
+	return conflicts
+}
+
+// newICMPv6Socket returns a socket to send neighbor solicitations in the
+// interface and receive the advertisements
+func newICMPv6Socket(iface *net.Interface) (int, error) {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		return -1, fmt.Errorf("error creating ICMPv6 socket: %v", err)
+	}
+
+	// neighbor discovery messages must use a hop limit of 255
+	for _, opt := range []int{unix.IPV6_MULTICAST_HOPS, unix.IPV6_UNICAST_HOPS} {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, opt, 255)
+		if err != nil {
+			unix.Close(fd)
+			return -1, err
+		}
+	}
+
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, iface.Index)
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+
+	return fd, nil
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestARPRequest(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	frame := arpRequest(mac, net.IPv4zero, net.ParseIP("10.4.0.50"))
+
+	expected := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x42, 0xac, 0x11, 0x00, 0x02, 0x08, 0x06,
+		0x00, 0x01, 0x08, 0x00, 0x06, 0x04, 0x00, 0x01,
+		0x02, 0x42, 0xac, 0x11, 0x00, 0x02, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 10, 4, 0, 50,
+	}
+	if !bytes.Equal(frame, expected) {
+		t.Errorf("expected %x but returned %x", expected, frame)
+	}
+
+	sender, ip, ok := parseARP(frame)
+	if !ok || sender.String() != "02:42:ac:11:00:02" || !ip.Equal(net.IPv4zero) {
+		t.Errorf("unexpected result parsing the frame: %v %v %v", sender, ip, ok)
+	}
+
+	if _, _, ok := parseARP(frame[:30]); ok {
+		t.Errorf("expected an error parsing a short frame")
+	}
+}
+
+func TestNeighborAdvert(t *testing.T) {
+	msg := []byte{136, 0, 0, 0, 0x60, 0, 0, 0}
+	msg = append(msg, net.ParseIP("fd00::50")...)
+	msg = append(msg, 2, 1, 0x02, 0x42, 0xac, 0x11, 0x00, 0x03)
+
+	target, mac, ok := parseNeighborAdvert(msg)
+	if !ok || target.String() != "fd00::50" || mac.String() != "02:42:ac:11:00:03" {
+		t.Errorf("unexpected result parsing the advertisement: %v %v %v", target, mac, ok)
+	}
+
+	if _, _, ok := parseNeighborAdvert(neighborSolicitation(mac, target)); ok {
+		t.Errorf("expected an error parsing a neighbor solicitation")
+	}
+
+	addr := solicitedNodeAddress(net.ParseIP("fd00::1:2:3"))
+	if addr.String() != "ff02::1:ff02:3" {
+		t.Errorf("expected ff02::1:ff02:3 but returned %v", addr)
+	}
+}
+
+func TestIsVRRPMAC(t *testing.T) {
+	testcases := map[string]bool{
+		"00:00:5e:00:01:32": true,
+		"00:00:5e:00:02:33": true,
+		"00:00:5e:00:01:34": false,
+		"02:42:ac:11:00:32": false,
+	}
+
+	for mac, expected := range testcases {
+		hw, _ := net.ParseMAC(mac)
+		if isVRRPMAC(hw, []int{50, 51}) != expected {
+			t.Errorf("%v: expected %v", mac, expected)
+		}
+	}
+}
+
+func TestCheckDuplicateAddresses(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	probed := [][]string{}
+	conflicts := map[string]string{"10.4.0.51": "02:42:ac:11:00:09"}
+
+	ipvsc := &ipvsControllerController{
+		client:                    client,
+		podNamespace:              "kube-system",
+		podName:                   "kube-keepalived-vip-abc",
+		keepalived:                &keepalived{vrid: 50, iface: "eth0", ip: "10.4.0.2"},
+		duplicateAddressDetection: true,
+		dadResults:                map[string]*dadResult{},
+		addressProbe: func(iface string, vips, neighbors []string, vrids []int) (map[string]string, error) {
+			probed = append(probed, vips)
+			return conflicts, nil
+		},
+	}
+
+	svcs := []vip{{IP: "10.4.0.50", Port: 80}, {IP: "10.4.0.51", Port: 80}}
+	filtered := ipvsc.checkDuplicateAddresses(svcs)
+	if !reflect.DeepEqual(getVIPs(filtered), []string{"10.4.0.50"}) {
+		t.Errorf("expected only 10.4.0.50 but returned %v", getVIPs(filtered))
+	}
+
+	if !reflect.DeepEqual(ipvsc.duplicateAddresses(), conflicts) {
+		t.Errorf("expected %v but returned %v", conflicts, ipvsc.duplicateAddresses())
+	}
+
+	// the VIPs are not probed again before the retry interval
+	ipvsc.checkDuplicateAddresses(svcs)
+	if len(probed) != 1 {
+		t.Fatalf("expected one probe but returned %v", probed)
+	}
+
+	// only the VIP used by other host is probed again
+	ipvsc.dadResults["10.4.0.51"].checked = time.Now().Add(-dadRetryInterval)
+	conflicts = map[string]string{}
+	filtered = ipvsc.checkDuplicateAddresses(svcs)
+	if !reflect.DeepEqual(probed[1], []string{"10.4.0.51"}) {
+		t.Errorf("expected a probe of 10.4.0.51 but returned %v", probed[1])
+	}
+	if len(filtered) != 2 || len(ipvsc.duplicateAddresses()) != 0 {
+		t.Errorf("expected both VIPs but returned %v", getVIPs(filtered))
+	}
+
+	// the fake client does not generate names, so the created events are
+	// read from the actions
+	reasons := []string{}
+	for _, action := range client.Actions() {
+		if create, ok := action.(k8stesting.CreateAction); ok {
+			reasons = append(reasons, create.GetObject().(*apiv1.Event).Reason)
+		}
+	}
+	if !reflect.DeepEqual(reasons, []string{"DuplicateAddress", "DuplicateAddressResolved"}) {
+		t.Errorf("unexpected events %v", reasons)
+	}
+
+	// VIPs removed from the configuration are forgotten
+	ipvsc.checkDuplicateAddresses(svcs[:1])
+	if _, ok := ipvsc.dadResults["10.4.0.51"]; ok {
+		t.Errorf("expected the result of 10.4.0.51 to be removed")
+	}
+}
+
+func TestProbeAnswers(t *testing.T) {
+	own, _ := net.ParseMAC("02:42:ac:11:00:02")
+	peer, _ := net.ParseMAC("02:42:ac:11:00:03")
+	other, _ := net.ParseMAC("02:42:ac:11:00:09")
+	vmac, _ := net.ParseMAC("00:00:5e:00:02:32")
+
+	testcases := map[string]struct {
+		VIPs      []string
+		Neighbors []string
+		Answers   map[string]net.HardwareAddr
+		Conflicts map[string]string
+	}{
+		"ipv6 peer answering for the VIP": {
+			VIPs:      []string{"fd00::50"},
+			Neighbors: []string{"fd00::3"},
+			Answers:   map[string]net.HardwareAddr{"fd00::3": peer, "fd00::50": peer},
+			Conflicts: map[string]string{},
+		},
+		"ipv4 peer learned from ipv6": {
+			VIPs:      []string{"10.4.0.50"},
+			Neighbors: []string{"fd00::3"},
+			Answers:   map[string]net.HardwareAddr{"fd00::3": peer, "10.4.0.50": peer},
+			Conflicts: map[string]string{},
+		},
+		"unknown ipv6 host": {
+			VIPs:      []string{"fd00::50"},
+			Neighbors: []string{"fd00::3"},
+			Answers:   map[string]net.HardwareAddr{"fd00::3": peer, "fd00::50": other},
+			Conflicts: map[string]string{"fd00::50": other.String()},
+		},
+		"peer not answering": {
+			VIPs:      []string{"fd00::50"},
+			Neighbors: []string{"fd00::3"},
+			Answers:   map[string]net.HardwareAddr{"fd00::50": peer},
+			Conflicts: map[string]string{"fd00::50": peer.String()},
+		},
+		"own and vrrp addresses": {
+			VIPs:      []string{"fd00::50", "fd00::51"},
+			Answers:   map[string]net.HardwareAddr{"fd00::50": own, "fd00::51": vmac},
+			Conflicts: map[string]string{},
+		},
+	}
+
+	for k, tc := range testcases {
+		answers := newProbeAnswers(own, tc.VIPs, tc.Neighbors)
+		for ip, mac := range tc.Answers {
+			answers.add(net.ParseIP(ip), mac)
+		}
+
+		if conflicts := answers.conflicts([]int{50}); !reflect.DeepEqual(conflicts, tc.Conflicts) {
+			t.Errorf("%s: expected %v but returned %v", k, tc.Conflicts, conflicts)
+		}
+	}
+}
+
+func TestCheckDuplicateAddressesPeers(t *testing.T) {
+	probed := [][]string{}
+	ipvsc := &ipvsControllerController{
+		client:                    fake.NewSimpleClientset(),
+		keepalived:                &keepalived{vrid: 50, iface: "eth0", ip: "10.4.0.2"},
+		duplicateAddressDetection: true,
+		dadResults:                map[string]*dadResult{},
+		peerMasters:               map[string]bool{"fd00::50": true},
+		addressProbe: func(iface string, vips, neighbors []string, vrids []int) (map[string]string, error) {
+			probed = append(probed, vips)
+			return map[string]string{"fd00::50": "02:42:ac:11:00:03"}, nil
+		},
+	}
+
+	svcs := []vip{{IP: "fd00:0::50", Port: 80}, {IP: "10.4.0.51", Port: 80}}
+	filtered := ipvsc.checkDuplicateAddresses(svcs)
+	if len(filtered) != 2 {
+		t.Errorf("expected both VIPs but returned %v", getVIPs(filtered))
+	}
+
+	if !reflect.DeepEqual(probed, [][]string{{"10.4.0.51"}}) {
+		t.Errorf("expected only a probe of 10.4.0.51 but returned %v", probed)
+	}
+}
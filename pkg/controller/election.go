@@ -0,0 +1,456 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	k8sexec "k8s.io/utils/exec"
+)
+
+const (
+	announceLease = "lease"
+
+	vipLeaseDuration = 10 * time.Second
+	vipLeaseRenew    = 2 * time.Second
+
+	// garpRepeat is the number of gratuitous ARP (or unsolicited neighbor
+	// advertisements) sent after acquiring a VIP, one in each renewal
+	garpRepeat = 3
+
+	// vipAnnotation contains the VIP of a lease
+	vipAnnotation = "kube-keepalived-vip/vip"
+)
+
+// leaseAnnouncer decides the node that holds each VIP using one Lease per
+// VIP instead of VRRP. The holder of the lease configures the address in
+// the interface and sends gratuitous ARP, the other nodes remove it.
+type leaseAnnouncer struct {
+	client    kubernetes.Interface
+	namespace string
+	// identity is the holder identity of the leases (node name)
+	identity string
+	iface    string
+	vrid     int
+
+	mu sync.Mutex
+	// vips contains the VIPs of the ConfigMap
+	vips []string
+	// addresses contains the address of each VIP and configured the
+	// address added for each held VIP
+	addresses  map[string]vipAddress
+	configured map[string]vipAddress
+	// held contains the VIPs configured in the node and the time of the
+	// last successful renewal of the lease
+	held map[string]time.Time
+	garp map[string]int
+	err  error
+	// others contains the VIPs with a lease held by other node
+	others map[string]bool
+	// updated is true after the first Update and cleaned once the
+	// addresses left by a previous pod were removed
+	updated bool
+	cleaned bool
+
+	started bool
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+func newLeaseAnnouncer(client kubernetes.Interface, namespace, identity, iface string, vrid int) *leaseAnnouncer {
+	return &leaseAnnouncer{
+		client:     client,
+		namespace:  namespace,
+		identity:   identity,
+		iface:      iface,
+		vrid:       vrid,
+		held:       map[string]time.Time{},
+		addresses:  map[string]vipAddress{},
+		configured: map[string]vipAddress{},
+		garp:       map[string]int{},
+		others:     map[string]bool{},
+		stopCh:     make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+}
+
+// Start starts the loop that acquires and renews the leases of the VIPs
+func (l *leaseAnnouncer) Start() error {
+	glog.Infof("using leases to announce VIPs (identity %v)", l.identity)
+	l.started = true
+	go func() {
+		defer close(l.doneCh)
+		wait.Until(l.sync, vipLeaseRenew, l.stopCh)
+	}()
+
+	return nil
+}
+
+// Update changes the VIPs announced by the node
+func (l *leaseAnnouncer) Update(svcs []vip) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.vips = getVIPs(svcs)
+	l.updated = true
+	l.addresses = map[string]vipAddress{}
+	for _, svc := range svcs {
+		if _, ok := l.addresses[svc.IP]; ok {
+			continue
+		}
+
+		addr := vipAddress{IP: svc.IP, Interface: svc.Interface, Prefix: svc.Prefix, Scope: svc.Scope}
+		if addr.Interface == "" {
+			addr.Interface = l.iface
+		}
+
+		label, err := addressLabel(svc.Label, addr.Interface)
+		if err != nil {
+			glog.Warningf("VIP %v: %v, ignoring the label", svc.IP, err)
+		}
+		addr.Label = label
+
+		l.addresses[svc.IP] = addr
+	}
+
+	return nil
+}
+
+// heldByOthers returns the VIPs with a lease held by other node
+func (l *leaseAnnouncer) heldByOthers() map[string]bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	others := map[string]bool{}
+	for ip := range l.others {
+		others[ip] = true
+	}
+
+	return others
+}
+
+// Healthy returns the last error found renewing the leases
+func (l *leaseAnnouncer) Healthy() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.err
+}
+
+// Stop releases the leases held by the node so other node can take over
+// the VIPs without waiting for the expiration of the leases
+func (l *leaseAnnouncer) Stop() {
+	close(l.stopCh)
+	if !l.started {
+		return
+	}
+	<-l.doneCh
+
+	l.mu.Lock()
+	released := []string{}
+	for ip := range l.held {
+		l.forget(ip)
+		released = append(released, ip)
+	}
+	l.mu.Unlock()
+
+	for _, ip := range released {
+		l.releaseLease(ip)
+	}
+}
+
+// leaseResult is the result of acquiring or renewing the lease of a VIP
+type leaseResult struct {
+	held bool
+	err  error
+}
+
+// sync acquires or renews the lease of each VIP and configures the
+// addresses held by the node. The lock is not held during the calls to the
+// API server, so Update and Healthy do not wait for them.
+func (l *leaseAnnouncer) sync() {
+	l.mu.Lock()
+	vips := append([]string{}, l.vips...)
+	l.mu.Unlock()
+
+	results := map[string]leaseResult{}
+	for _, ip := range vips {
+		held, err := l.acquireOrRenew(ip)
+		results[ip] = leaseResult{held, err}
+	}
+
+	l.mu.Lock()
+	l.removeStaleAddresses(vips, results)
+
+	l.others = map[string]bool{}
+	var lastErr error
+	for _, ip := range vips {
+		held, err := results[ip].held, results[ip].err
+		if !held && err == nil {
+			l.others[normalizeIP(ip)] = true
+		}
+		if err != nil {
+			lastErr = err
+			glog.Warningf("error renewing lease of VIP %v: %v", ip, err)
+
+			// keep the VIP while the lease is valid for the other nodes
+			renewed, ok := l.held[ip]
+			held = ok && time.Since(renewed) < vipLeaseDuration-2*vipLeaseRenew
+		}
+
+		if !held {
+			if _, ok := l.held[ip]; ok {
+				glog.Infof("VIP %v is held by other node", ip)
+				removeVIP(l.configured[ip])
+				delete(l.held, ip)
+				delete(l.configured, ip)
+			}
+			continue
+		}
+
+		if _, ok := l.held[ip]; !ok {
+			glog.Infof("acquired lease of VIP %v", ip)
+			addr := l.vipAddress(ip)
+			err := addAddress(addr)
+			if err != nil {
+				lastErr = err
+				glog.Errorf("%v", err)
+				continue
+			}
+			l.configured[ip] = addr
+			l.garp[ip] = garpRepeat
+		}
+
+		if err == nil {
+			l.held[ip] = time.Now()
+		}
+
+		if l.garp[ip] > 0 {
+			l.garp[ip]--
+			err := sendGratuitous(l.configured[ip].Interface, net.ParseIP(ip))
+			if err != nil {
+				glog.Warningf("error sending gratuitous ARP for VIP %v: %v", ip, err)
+			}
+		}
+	}
+
+	// VIPs removed from the ConfigMap
+	released := []string{}
+	for ip := range l.held {
+		if !contains(l.vips, ip) {
+			l.forget(ip)
+			released = append(released, ip)
+		}
+	}
+
+	l.err = lastErr
+	l.mu.Unlock()
+
+	for _, ip := range released {
+		l.releaseLease(ip)
+	}
+}
+
+// removeStaleAddresses removes, in the first sync after the VIPs are
+// known, the VIPs not held by the node that are configured in the
+// interface, like the ones left by a pod killed without releasing them.
+// Requires the lock.
+func (l *leaseAnnouncer) removeStaleAddresses(vips []string, results map[string]leaseResult) {
+	if !l.updated || l.cleaned {
+		return
+	}
+	l.cleaned = true
+
+	for _, ip := range vips {
+		if _, ok := l.held[ip]; ok || results[ip].held || results[ip].err != nil {
+			continue
+		}
+
+		addr := l.vipAddress(ip)
+		if hasAddress(addr) {
+			glog.Infof("removing VIP %v not held by the node", ip)
+			removeVIP(addr)
+		}
+	}
+}
+
+// forget removes the VIP from the node. Requires the lock.
+func (l *leaseAnnouncer) forget(ip string) {
+	removeVIP(l.configured[ip])
+	delete(l.held, ip)
+	delete(l.garp, ip)
+	delete(l.configured, ip)
+}
+
+// releaseLease removes the node as holder of the lease of the VIP
+func (l *leaseAnnouncer) releaseLease(ip string) {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(l.leaseName(ip), metav1.GetOptions{})
+	if err != nil {
+		glog.Warningf("error releasing lease of VIP %v: %v", ip, err)
+		return
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity {
+		return
+	}
+
+	lease.Spec.HolderIdentity = nil
+	_, err = leases.Update(lease)
+	if err != nil {
+		glog.Warningf("error releasing lease of VIP %v: %v", ip, err)
+	}
+}
+
+// vipAddress returns the address of a VIP
+func (l *leaseAnnouncer) vipAddress(ip string) vipAddress {
+	if addr, ok := l.addresses[ip]; ok {
+		return addr
+	}
+
+	return vipAddress{IP: ip, Interface: l.iface}
+}
+
+// acquireOrRenew returns true if the node holds the lease of the VIP
+func (l *leaseAnnouncer) acquireOrRenew(ip string) (bool, error) {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(vipLeaseDuration / time.Second)
+	identity := l.identity
+
+	lease, err := leases.Get(l.leaseName(ip), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        l.leaseName(ip),
+				Namespace:   l.namespace,
+				Annotations: map[string]string{vipAnnotation: ip},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+
+		_, err = leases.Create(lease)
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+
+	if holder != identity {
+		if holder != "" && !isLeaseExpired(lease, now.Time) {
+			return false, nil
+		}
+
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+
+		lease.Spec.HolderIdentity = &identity
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions = &transitions
+	}
+
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+
+	// the resource version of the lease avoids two nodes acquiring it
+	_, err = leases.Update(lease)
+	if errors.IsConflict(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// leaseName returns the name of the lease of a VIP. The characters of IPv6
+// addresses not allowed in names are replaced.
+func (l *leaseAnnouncer) leaseName(ip string) string {
+	if addr := net.ParseIP(ip); addr != nil {
+		ip = addr.String()
+	}
+
+	name := strings.Replace(ip, ":", "-", -1)
+	if strings.HasSuffix(name, "-") {
+		name += "0"
+	}
+
+	return fmt.Sprintf("kube-keepalived-vip-%v-vip-%v", l.vrid, name)
+}
+
+// hasAddress returns true if the VIP is configured in its interface
+func hasAddress(addr vipAddress) bool {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(addr.IP)
+	for _, ipNet := range addrs[addr.Interface] {
+		if ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addAddress configures a VIP in its interface
+func addAddress(addr vipAddress) error {
+	ip := net.ParseIP(addr.IP)
+	if ip == nil {
+		return fmt.Errorf("invalid VIP %v", addr.IP)
+	}
+
+	args := append([]string{"addr", "replace"}, addr.addArgs()...)
+	if ip.To4() == nil {
+		// the address is used as source of the neighbor advertisements
+		args = append(args, "nodad")
+	}
+
+	glog.Infof("adding VIP %v to %v", addr.IP, addr.Interface)
+	out, err := k8sexec.New().Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error adding VIP %v: %v\n%s", addr.IP, err, out)
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestAcquireOrRenew(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	node1 := newLeaseAnnouncer(client, "kube-system", "node1", "eth0", 50)
+	node2 := newLeaseAnnouncer(client, "kube-system", "node2", "eth0", 50)
+
+	held, err := node1.acquireOrRenew("10.4.0.50")
+	if err != nil || !held {
+		t.Fatalf("expected node1 to acquire the lease (%v)", err)
+	}
+
+	held, err = node2.acquireOrRenew("10.4.0.50")
+	if err != nil || held {
+		t.Fatalf("expected node2 not to acquire a valid lease (%v)", err)
+	}
+
+	held, err = node1.acquireOrRenew("10.4.0.50")
+	if err != nil || !held {
+		t.Fatalf("expected node1 to renew the lease (%v)", err)
+	}
+
+	// node1 stops renewing the lease
+	leases := client.CoordinationV1().Leases("kube-system")
+	lease, err := leases.Get(node1.leaseName("10.4.0.50"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expired := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	lease.Spec.RenewTime = &expired
+	leases.Update(lease)
+
+	held, err = node2.acquireOrRenew("10.4.0.50")
+	if err != nil || !held {
+		t.Fatalf("expected node2 to acquire an expired lease (%v)", err)
+	}
+
+	lease, _ = leases.Get(node1.leaseName("10.4.0.50"), metav1.GetOptions{})
+	if *lease.Spec.HolderIdentity != "node2" || *lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("unexpected lease %+v", lease.Spec)
+	}
+
+	held, err = node1.acquireOrRenew("10.4.0.50")
+	if err != nil || held {
+		t.Fatalf("expected node1 to lose the lease (%v)", err)
+	}
+}
+
+func TestLeaseSyncDoesNotBlockHealthy(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	client.PrependReactor("get", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		close(blocked)
+		<-unblock
+		return true, nil, fmt.Errorf("API server unavailable")
+	})
+
+	l := newLeaseAnnouncer(client, "kube-system", "node1", "eth0", 50)
+	l.Update([]vip{{IP: "10.4.0.50"}})
+
+	done := make(chan struct{})
+	go func() {
+		l.sync()
+		close(done)
+	}()
+	<-blocked
+
+	healthy := make(chan error)
+	go func() {
+		healthy <- l.Healthy()
+	}()
+
+	select {
+	case <-healthy:
+	case <-time.After(time.Second):
+		t.Errorf("Healthy must not wait for the lease API calls")
+	}
+
+	close(unblock)
+	<-done
+
+	if l.Healthy() == nil {
+		t.Errorf("expected an error after failing to renew the lease")
+	}
+}
+
+func TestLeaseName(t *testing.T) {
+	l := newLeaseAnnouncer(nil, "kube-system", "node1", "eth0", 50)
+
+	testcases := map[string]string{
+		"10.4.0.50":    "kube-keepalived-vip-50-vip-10.4.0.50",
+		"fd00::10":     "kube-keepalived-vip-50-vip-fd00--10",
+		"fd00:0::":     "kube-keepalived-vip-50-vip-fd00--0",
+		"FD00:0:0::10": "kube-keepalived-vip-50-vip-fd00--10",
+	}
+
+	for ip, expected := range testcases {
+		if name := l.leaseName(ip); name != expected {
+			t.Errorf("%v: expected %v but returned %v", ip, expected, name)
+		}
+	}
+}
+
+func TestHasAddress(t *testing.T) {
+	interfaceAddrs = testInterfaceAddrs
+	defer func() { interfaceAddrs = localInterfaceAddrs }()
+
+	testcases := map[string]struct {
+		Addr     vipAddress
+		Expected bool
+	}{
+		"configured":        {vipAddress{IP: "10.4.0.2", Interface: "eth0"}, true},
+		"ipv6 configured":   {vipAddress{IP: "fd00:10:0::2", Interface: "eth1"}, true},
+		"other interface":   {vipAddress{IP: "10.4.0.2", Interface: "eth1"}, false},
+		"missing":           {vipAddress{IP: "10.4.0.50", Interface: "eth0"}, false},
+		"missing interface": {vipAddress{IP: "10.4.0.2", Interface: "eth9"}, false},
+	}
+
+	for k, tc := range testcases {
+		if has := hasAddress(tc.Addr); has != tc.Expected {
+			t.Errorf("%s: expected %v but returned %v", k, tc.Expected, has)
+		}
+	}
+}
+
+func TestRemoveStaleAddressesOnce(t *testing.T) {
+	interfaceAddrs = testInterfaceAddrs
+	defer func() { interfaceAddrs = localInterfaceAddrs }()
+
+	l := newLeaseAnnouncer(nil, "kube-system", "node1", "eth0", 50)
+	results := map[string]leaseResult{"10.4.0.50": {held: false}}
+
+	// the VIPs are unknown before the first update
+	l.removeStaleAddresses([]string{"10.4.0.50"}, results)
+	if l.cleaned {
+		t.Errorf("expected no cleanup before the first update")
+	}
+
+	l.Update([]vip{{IP: "10.4.0.50", LVSMethod: "VIP"}})
+	l.removeStaleAddresses([]string{"10.4.0.50"}, results)
+	if !l.cleaned {
+		t.Errorf("expected the cleanup after the first update")
+	}
+}
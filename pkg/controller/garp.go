@@ -0,0 +1,145 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// sendGratuitous announces the MAC address of the interface for the VIP,
+// using a gratuitous ARP for IPv4 or an unsolicited neighbor advertisement
+// for IPv6, so the neighbors update their caches after a failover.
+func sendGratuitous(ifaceName string, ip net.IP) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("interface %v does not have an ethernet address", ifaceName)
+	}
+
+	if ip.To4() != nil {
+		return sendGratuitousARP(iface, ip.To4())
+	}
+
+	return sendUnsolicitedNA(iface, ip.To16())
+}
+
+// gratuitousARP returns an ethernet frame with an ARP request where the
+// sender and target addresses are the VIP
+func gratuitousARP(mac net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcastMAC...)
+	frame = append(frame, mac...)
+	frame = append(frame, 0x08, 0x06)
+
+	// hardware type ethernet, protocol IPv4, address lengths and request
+	frame = append(frame, 0, 1, 0x08, 0x00, 6, 4, 0, 1)
+	frame = append(frame, mac...)
+	frame = append(frame, ip...)
+	frame = append(frame, broadcastMAC...)
+	frame = append(frame, ip...)
+
+	return frame
+}
+
+func sendGratuitousARP(iface *net.Interface, ip net.IP) error {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return fmt.Errorf("error creating ARP socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], broadcastMAC)
+
+	return unix.Sendto(fd, gratuitousARP(iface.HardwareAddr, ip), 0, addr)
+}
+
+// unsolicitedNA returns an ICMPv6 neighbor advertisement with the override
+// flag and the link-layer address of the interface. The kernel computes the
+// checksum.
+func unsolicitedNA(mac net.HardwareAddr, ip net.IP) []byte {
+	msg := make([]byte, 0, 32)
+	// type 136 (neighbor advertisement), code, checksum and override flag
+	msg = append(msg, 136, 0, 0, 0, 0x20, 0, 0, 0)
+	msg = append(msg, ip...)
+	// target link-layer address option
+	msg = append(msg, 2, 1)
+	msg = append(msg, mac...)
+
+	return msg
+}
+
+func sendUnsolicitedNA(iface *net.Interface, ip net.IP) error {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		return fmt.Errorf("error creating ICMPv6 socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	// neighbor discovery messages must use a hop limit of 255
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, 255)
+	if err != nil {
+		return err
+	}
+
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, iface.Index)
+	if err != nil {
+		return err
+	}
+
+	// the source address is the VIP. IPV6_FREEBIND requires Linux 4.15,
+	// older kernels use IP_FREEBIND also for IPv6 sockets
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_FREEBIND, 1)
+	if err == unix.ENOPROTOOPT {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_FREEBIND, 1)
+	}
+	if err != nil {
+		return err
+	}
+
+	src := &unix.SockaddrInet6{}
+	copy(src.Addr[:], ip)
+	err = unix.Bind(fd, src)
+	if err != nil {
+		return fmt.Errorf("error binding to %v: %v", ip, err)
+	}
+
+	// all nodes multicast address
+	dst := &unix.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(dst.Addr[:], net.IPv6linklocalallnodes)
+
+	return unix.Sendto(fd, unsolicitedNA(iface.HardwareAddr, ip), 0, dst)
+}
+
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return binary.LittleEndian.Uint16(b)
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestGratuitousARP(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	ip := net.ParseIP("10.4.0.50").To4()
+
+	frame := gratuitousARP(mac, ip)
+	if len(frame) != 42 {
+		t.Fatalf("expected a frame of 42 bytes but returned %v", len(frame))
+	}
+
+	expected := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x42, 0xac, 0x11, 0x00, 0x02, 0x08, 0x06,
+		0, 1, 0x08, 0, 6, 4, 0, 1,
+		0x02, 0x42, 0xac, 0x11, 0x00, 0x02, 10, 4, 0, 50,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 10, 4, 0, 50,
+	}
+	if !bytes.Equal(frame, expected) {
+		t.Errorf("expected\n%v\nbut returned\n%v", expected, frame)
+	}
+}
+
+func TestUnsolicitedNA(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	ip := net.ParseIP("fd00::10")
+
+	msg := unsolicitedNA(mac, ip)
+	if len(msg) != 32 {
+		t.Fatalf("expected a message of 32 bytes but returned %v", len(msg))
+	}
+
+	if msg[0] != 136 || msg[4] != 0x20 {
+		t.Errorf("expected a neighbor advertisement with the override flag but returned %v", msg[:8])
+	}
+
+	if !net.IP(msg[8:24]).Equal(ip) {
+		t.Errorf("expected target %v but returned %v", ip, net.IP(msg[8:24]))
+	}
+
+	if !bytes.Equal(msg[24:], append([]byte{2, 1}, mac...)) {
+		t.Errorf("unexpected target link-layer address option %v", msg[24:])
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// vrrpGroup is a VRRP instance announcing a group of VIPs
+type vrrpGroup struct {
+	Name         string
+	VRID         int
+	State        string
+	Priority     int
+	Preempt      bool
+	PreemptDelay int
+	// Interface is the network interface of the instance
+	Interface string
+	// VMAC is the interface with the virtual MAC address created by
+	// keepalived for the VIPs of the instance. Empty if not used
+	VMAC string
+	VIPs []string
+	// Addresses contains the VIPs and their interfaces
+	Addresses []vipAddress
+	// TrackInterfaces contains the interfaces of the instance and its VIPs
+	TrackInterfaces []string
+	// Tracks contains the VIPs of the group tracking their backends
+	Tracks []backendTrack
+	// Config contains the settings of the VRRP ConfigMap (can be nil)
+	Config *vrrpInstanceConfig
+	// Auth is the VRRP password of the instance
+	Auth string
+}
+
+// vrrpGroups returns the VRRP instances of the VIPs. The group vips uses
+// the VRID of the controller and other groups the VRID of the VRRP
+// ConfigMap. Groups without VRID or using the VRID of other group are ignored.
+func (k *keepalived) vrrpGroups(svcs []vip, tracks []backendTrack) []vrrpGroup {
+	vips := map[string][]string{}
+	addresses := map[string][]vipAddress{}
+	owner := map[string]string{}
+	configured := map[string]vipAddress{}
+	for _, svc := range svcs {
+		group := svc.Group
+		if group == "" {
+			group = defaultGroup
+		}
+
+		iface := svc.Interface
+		if iface == "" {
+			iface = k.groupInterface(group)
+		}
+
+		addr := vipAddress{IP: svc.IP, Interface: iface, Prefix: svc.Prefix, Label: svc.Label, Scope: svc.Scope}
+		if current, ok := owner[svc.IP]; ok {
+			if current != group {
+				glog.Warningf("VIP %v cannot be in groups %v and %v, using %v", svc.IP, current, group, current)
+			} else if configured[svc.IP].Interface != iface {
+				glog.Warningf("VIP %v cannot use interfaces %v and %v, using %v", svc.IP, configured[svc.IP].Interface, iface, configured[svc.IP].Interface)
+			} else if configured[svc.IP] != addr {
+				glog.Warningf("VIP %v is configured with different prefix, label or scope, using %v", svc.IP, configured[svc.IP].addArgs())
+			}
+			continue
+		}
+
+		owner[svc.IP] = group
+		configured[svc.IP] = addr
+		vips[group] = append(vips[group], svc.IP)
+		addresses[group] = append(addresses[group], addr)
+	}
+
+	names := []string{}
+	for name := range vips {
+		if name != defaultGroup {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := vips[defaultGroup]; ok {
+		names = append([]string{defaultGroup}, names...)
+	}
+
+	groups := []vrrpGroup{}
+	used := map[int]string{}
+	for _, name := range names {
+		vrid, ok := k.groupVRID(name)
+		if !ok {
+			glog.Warningf("VRRP group %v requires a vrid in the VRRP ConfigMap, ignoring its VIPs", name)
+			continue
+		}
+
+		group := vrrpGroup{
+			Name:      name,
+			VRID:      vrid,
+			Interface: k.advertInterface(name),
+			VIPs:      vips[name],
+			Addresses: addresses[name],
+			Tracks:    []backendTrack{},
+			Config:    k.vrrpInstances[name],
+			Auth:      k.vrrpAuth[name],
+		}
+
+		// the unicast adverts of all the groups use the node address as
+		// source, so the instance must use the interface of the address
+		if k.useUnicast && k.ipIface != "" && group.Interface != k.ipIface {
+			glog.Warningf("VRRP group %v uses the interface %v but the node address %v used in the unicast adverts is in %v, ignoring its VIPs",
+				name, group.Interface, k.ip, k.ipIface)
+			continue
+		}
+
+		group.TrackInterfaces = []string{group.Interface}
+		for _, addr := range group.Addresses {
+			group.TrackInterfaces = appendIfMissing(group.TrackInterfaces, addr.Interface)
+		}
+
+		// keepalived adds the VIPs without other interface to the VMAC interface
+		if group.Config != nil && group.Config.UseVMAC {
+			group.VMAC = vmacLinkName(group.VRID)
+			for i, addr := range group.Addresses {
+				if addr.Interface == group.Interface {
+					group.Addresses[i].Interface = group.VMAC
+				}
+			}
+		}
+
+		for i, addr := range group.Addresses {
+			label, err := addressLabel(addr.Label, addr.Interface)
+			if err != nil {
+				glog.Warningf("VIP %v: %v, ignoring the label", addr.IP, err)
+			}
+			group.Addresses[i].Label = label
+		}
+
+		if other, ok := used[group.VRID]; ok {
+			glog.Warningf("VRRP groups %v and %v use the same VRID %v, ignoring the VIPs of %v", other, name, group.VRID, name)
+			continue
+		}
+		used[group.VRID] = name
+
+		group.State, group.Priority = k.vrrpState(name)
+		if group.Config != nil {
+			group.Preempt = group.Config.Preempt
+			if group.Config.PreemptDelay != nil {
+				group.PreemptDelay = *group.Config.PreemptDelay
+			}
+		}
+
+		for _, track := range tracks {
+			if owner[track.VIP] == name {
+				group.Tracks = append(group.Tracks, track)
+			}
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+// groupVRID returns the VRID of a VRRP group. A VRID derived from the list
+// of groups would change when other groups are added, so groups other than
+// vips must set the vrid in the VRRP ConfigMap.
+func (k *keepalived) groupVRID(name string) (int, bool) {
+	if name == defaultGroup {
+		return k.vrid, true
+	}
+
+	if cfg := k.vrrpInstances[name]; cfg != nil && cfg.VRID != nil {
+		return *cfg.VRID, true
+	}
+
+	return 0, false
+}
+
+// masterVIPs returns the VIPs of the VRRP groups in MASTER state
+func (k *keepalived) masterVIPs(states map[string]string) []string {
+	vips := []string{}
+	for _, group := range k.getGroups() {
+		if states[group.Name] == stateMaster {
+			vips = append(vips, group.VIPs...)
+		}
+	}
+
+	return vips
+}
+
+func (k *keepalived) getGroups() []vrrpGroup {
+	k.trackLock.Lock()
+	defer k.trackLock.Unlock()
+
+	return k.groups
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestVRRPGroups(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	ka := &keepalived{
+		vrid:     50,
+		priority: 100,
+		vrrpInstances: map[string]*vrrpInstanceConfig{
+			"public":   {VRID: intPtr(80)},
+			"internal": {VRID: intPtr(51)},
+		},
+	}
+
+	svcs := []vip{
+		{IP: "10.0.0.1", Port: 80},
+		{IP: "10.0.0.5", Port: 80, Group: "other"},
+		{IP: "10.0.0.2", Port: 80, Group: "public"},
+		{IP: "10.0.0.3", Port: 80, Group: "internal"},
+		{IP: "10.0.0.3", Port: 443, Group: "public"},
+		{IP: "10.0.0.4", Port: 80, Group: "internal"},
+	}
+	tracks := []backendTrack{{VIP: "10.0.0.4", Mode: trackFault}}
+
+	groups := ka.vrrpGroups(svcs, tracks)
+
+	names := []string{}
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"vips", "internal", "public"}) {
+		t.Fatalf("unexpected groups %v", names)
+	}
+
+	if groups[0].VRID != 50 || groups[1].VRID != 51 || groups[2].VRID != 80 {
+		t.Errorf("unexpected VRIDs %v, %v and %v", groups[0].VRID, groups[1].VRID, groups[2].VRID)
+	}
+
+	if !reflect.DeepEqual(groups[1].VIPs, []string{"10.0.0.3", "10.0.0.4"}) {
+		t.Errorf("unexpected VIPs of group internal: %v", groups[1].VIPs)
+	}
+
+	if len(groups[1].Tracks) != 1 || len(groups[0].Tracks) != 0 {
+		t.Errorf("expected the track in group internal: %+v", groups)
+	}
+
+	if groups[2].Config == nil || groups[0].Config != nil {
+		t.Errorf("unexpected configuration of the groups: %+v", groups)
+	}
+}
+
+func TestVRRPGroupsDuplicateVRID(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	ka := &keepalived{
+		vrid: 50,
+		vrrpInstances: map[string]*vrrpInstanceConfig{
+			"public": {VRID: intPtr(50)},
+		},
+	}
+
+	groups := ka.vrrpGroups([]vip{
+		{IP: "10.0.0.1", Port: 80},
+		{IP: "10.0.0.2", Port: 80, Group: "public"},
+	}, nil)
+
+	if len(groups) != 1 || groups[0].Name != defaultGroup {
+		t.Errorf("expected only the group vips but returned %+v", groups)
+	}
+}
+
+func TestVRRPGroupsUnicastInterface(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	svcs := []vip{
+		{IP: "10.4.0.50", Port: 80, Interface: "eth0"},
+		{IP: "192.168.10.50", Port: 80, Group: "public", Interface: "eth1"},
+	}
+
+	testcases := map[string]struct {
+		Unicast bool
+		Groups  []string
+	}{
+		"multicast": {false, []string{"vips", "public"}},
+		"unicast":   {true, []string{"vips"}},
+	}
+
+	for k, tc := range testcases {
+		ka := &keepalived{vrid: 50, iface: "eth0", ip: "10.4.0.2", ipIface: "eth0", useUnicast: tc.Unicast,
+			groupIfaces: map[string]string{"public": "eth1"},
+			vrrpInstances: map[string]*vrrpInstanceConfig{
+				"public": {VRID: intPtr(51), Interface: "eth1"},
+			},
+		}
+
+		names := []string{}
+		for _, group := range ka.vrrpGroups(svcs, nil) {
+			names = append(names, group.Name)
+		}
+		if !reflect.DeepEqual(names, tc.Groups) {
+			t.Errorf("%s: expected groups %v but returned %v", k, tc.Groups, names)
+		}
+	}
+}
+
+func TestKeepalivedTemplate(t *testing.T) {
+	tmpl, err := template.ParseFiles("../../rootfs/keepalived.tmpl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing template: %v", err)
+	}
+
+	svcs := []vip{
+		{Name: "default-web", IP: "10.0.0.1", Port: 80, LVSMethod: "NAT", Protocol: "TCP",
+			Scheduler: "rr", HealthCheck: healthCheck{Type: checkHTTP, Path: "/healthz", Status: 200, Interval: 10, Timeout: 2},
+			Backends: []service{{IP: "10.2.0.1", Port: 8080}}},
+		{Name: "default-db", IP: "10.0.0.2", Port: 5432, LVSMethod: "DR", Protocol: "TCP", Group: "internal",
+			Scheduler: "wlc", Persistence: 600, HealthCheck: healthCheck{Type: checkTCP, Interval: 5, Timeout: 3},
+			Backends: []service{{IP: "10.2.0.2", Port: 5432}}},
+		{IP: "10.0.0.3", LVSMethod: "VIP", Interface: "eth1"},
+		{IP: "10.0.0.4", LVSMethod: "VIP", Prefix: 24, Label: "vip", Scope: "link"},
+	}
+
+	vrid := 51
+	ka := &keepalived{vrid: 50, priority: 100, iface: "eth0",
+		vrrpInstances: map[string]*vrrpInstanceConfig{"internal": {UseVMAC: true, VRID: &vrid}}}
+	conf := map[string]interface{}{
+		"vipIsEmpty":    false,
+		"vrrp":          true,
+		"iface":         "eth0",
+		"vrrpVersion":   3,
+		"iptablesChain": iptablesChain,
+		"faultFile":     faultFile,
+		"svcs":          svcs,
+		"groups":        ka.vrrpGroups(svcs, nil),
+	}
+
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, conf)
+	if err != nil {
+		t.Fatalf("unexpected error rendering template: %v", err)
+	}
+
+	expected := []string{
+		"vrrp_instance vips {",
+		"virtual_router_id 50",
+		"vrrp_instance internal {",
+		"virtual_router_id 51",
+		"interface eth0",
+		"10.0.0.3 dev eth1",
+		"10.0.0.4/24 scope link label eth0:vip",
+		"use_vmac vrrp.51",
+		"vmac_xmit_base",
+		"lvs_sched rr",
+		"HTTP_GET {",
+		"path /healthz",
+		"delay_loop 10",
+		"connect_timeout 2",
+		"persistence_timeout 600",
+		"TCP_CHECK {",
+	}
+	for _, line := range expected {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected %q in rendered configuration:\n%v", line, buf.String())
+		}
+	}
+
+	if strings.Contains(buf.String(), "10.0.0.2 dev") {
+		t.Errorf("expected the VIP in the VMAC interface without dev:\n%v", buf.String())
+	}
+
+	if strings.Count(buf.String(), "persistence_timeout") != 1 {
+		t.Errorf("expected persistence only in the second virtual server:\n%v", buf.String())
+	}
+}
+
+func TestKeepalivedTemplateVLAN(t *testing.T) {
+	interfaceAddrs = testInterfaceAddrs
+	defer func() { interfaceAddrs = localInterfaceAddrs }()
+
+	tmpl, err := template.ParseFiles("../../rootfs/keepalived.tmpl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing template: %v", err)
+	}
+
+	vrid, vlan := 51, 100
+	svcs := []vip{
+		{IP: "10.0.0.1", LVSMethod: "VIP"},
+		{IP: "172.20.0.50", LVSMethod: "VIP", Group: "tagged"},
+	}
+
+	for _, unicast := range []bool{false, true} {
+		ka := &keepalived{vrid: 50, priority: 100, iface: "eth0", ip: "10.4.0.2", useUnicast: unicast,
+			vrrpInstances: map[string]*vrrpInstanceConfig{"tagged": {VRID: &vrid, VLAN: &vlan}}}
+		resolved := ka.resolveInterfaces(svcs)
+
+		conf := map[string]interface{}{
+			"vipIsEmpty": false,
+			"vrrp":       true,
+			"iface":      "eth0",
+			"myIP":       ka.ip,
+			"nodes":      []string{"10.4.0.3"},
+			"useUnicast": unicast,
+			"faultFile":  faultFile,
+			"svcs":       resolved,
+			"groups":     ka.vrrpGroups(resolved, nil),
+		}
+
+		buf := &bytes.Buffer{}
+		err = tmpl.Execute(buf, conf)
+		if err != nil {
+			t.Fatalf("unexpected error rendering template: %v", err)
+		}
+
+		rendered := buf.String()
+		instance := rendered[strings.Index(rendered, "vrrp_instance tagged {"):]
+
+		// the VLAN interface has no address, the adverts (multicast or
+		// unicast) are sent from the parent interface
+		expected := []string{
+			"interface eth0\n",
+			"virtual_router_id 51",
+			"172.20.0.50 dev eth0.100",
+			"eth0.100",
+		}
+		if unicast {
+			expected = append(expected, "unicast_src_ip 10.4.0.2")
+		}
+		for _, line := range expected {
+			if !strings.Contains(instance, line) {
+				t.Errorf("unicast %v: expected %q in rendered configuration:\n%v", unicast, line, instance)
+			}
+		}
+
+		if strings.Contains(instance, "interface eth0.100") {
+			t.Errorf("unicast %v: expected the adverts in the parent interface:\n%v", unicast, instance)
+		}
+	}
+}
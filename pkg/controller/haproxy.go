@@ -0,0 +1,773 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	haproxySocket    = "/tmp/haproxy"
+	haproxyStateFile = "/etc/haproxy/haproxy.state"
+	haproxyCertsDir  = "/etc/haproxy/certs"
+
+	// haproxyMinSlots is the minimum number of servers defined in each
+	// backend. Unused servers are kept in maintenance mode and assigned
+	// an address through the runtime API when a new endpoint appears.
+	haproxyMinSlots = 4
+
+	// haproxyReloadInterval is the interval used to check if HAProxy
+	// loaded the last configuration file written
+	haproxyReloadInterval = 2 * time.Second
+
+	// haproxyAdminMaint contains the flags of the admin state of a server
+	// in maintenance mode, forced using the runtime API or configured
+	// using the disabled keyword
+	haproxyAdminMaint = 0x01 | 0x04
+)
+
+var (
+	// haproxyRuntimeErrors contains the prefixes of the responses of the
+	// HAProxy runtime API that indicate an error
+	haproxyRuntimeErrors = []string{"No such", "Unknown", "Require", "Invalid", "Permission denied"}
+
+	// haproxyVersionRegex matches the major and minor version of HAProxy
+	haproxyVersionRegex = regexp.MustCompile(`^(\d+)\.(\d+)`)
+)
+
+// haproxyServer is one of the servers defined in an HAProxy backend
+type haproxyServer struct {
+	Name    string
+	IP      string
+	Port    int
+	Enabled bool
+}
+
+// haproxyBackend contains the servers of an HAProxy backend (or listen section)
+type haproxyBackend struct {
+	Name string
+	// Mode is the HAProxy mode of the backends used by routes (tcp or http)
+	Mode      string
+	SendProxy bool
+	Servers   []haproxyServer
+}
+
+// haproxy manages the HAProxy configuration. Changes in the structure of
+// the configuration (listeners or number of servers) are written to the
+// configuration file, reloaded by the HAProxy container. Changes in the
+// endpoints are applied using the runtime API without a reload, once the
+// running process contains the servers of the configuration file.
+type haproxy struct {
+	tmpl   *template.Template
+	socket string
+
+	// backends contains the servers configured in HAProxy by backend name
+	backends map[string]*haproxyBackend
+	// certificates contains the content of the certificates by path
+	certificates map[string][]byte
+	// structureMD5 is the checksum of the structure of the last
+	// configuration file written
+	structureMD5 string
+	// configVersion identifies the last configuration file written. It is
+	// the description of the HAProxy process, returned by show info
+	configVersion string
+	// cfg is the content of the last configuration file written
+	cfg []byte
+	// versionChecked is true once the version of HAProxy was read
+	versionChecked bool
+	// reloadCertificates is true when the version of HAProxy cannot update
+	// the certificates using the runtime API (requires 2.1)
+	reloadCertificates bool
+
+	mu sync.Mutex
+	// reloadPending is true until the running HAProxy process uses the
+	// last configuration file written
+	reloadPending bool
+}
+
+// haproxyBackendName returns the name of the HAProxy section of a service
+func haproxyBackendName(svc vip) string {
+	return fmt.Sprintf("%v-%v", svc.Name, svc.Port)
+}
+
+// Update updates the HAProxy configuration using the runtime API when possible
+func (h *haproxy) Update(conf map[string]interface{}, svcs []vip) error {
+	backends, routeBackends := h.backendsFor(svcs)
+
+	conf["backends"] = backends
+	conf["routeBackends"] = routeBackends
+
+	md5, err := haproxyStructureChecksum(svcs, backends)
+	if err != nil {
+		return err
+	}
+
+	reload := md5 != h.structureMD5
+
+	if !reload && h.isReloadPending() {
+		var running map[string]*haproxyBackend
+		version, err := h.runningVersion()
+		if err == nil && version == h.configVersion {
+			running, err = h.runningBackends()
+		}
+		if err != nil || version != h.configVersion {
+			// the running process does not use the last configuration
+			// file yet, the changes are written to the file
+			glog.V(2).Infof("waiting for HAProxy to load the new configuration")
+			_, err := h.updateCertificates(svcs, false)
+			if err != nil {
+				return err
+			}
+
+			err = h.writeCfg(conf)
+			if err != nil {
+				return err
+			}
+
+			h.backends = backends
+			return nil
+		}
+
+		glog.Info("HAProxy loaded the new configuration")
+		h.setReloadPending(false)
+		// the servers of the new process are the ones read from the
+		// configuration and state files
+		h.backends = running
+	}
+
+	h.checkVersion()
+	changed, err := h.updateCertificates(svcs, !reload && !h.reloadCertificates)
+	if err != nil {
+		if reload {
+			return err
+		}
+
+		glog.Warningf("error updating certificates using the runtime API, reloading: %v", err)
+		reload = true
+	}
+	if changed && !reload {
+		glog.Infof("certificates changed, reloading HAProxy")
+		reload = true
+	}
+
+	if !reload {
+		err := h.applyRuntimeChanges(backends)
+		if err == nil {
+			h.backends = backends
+			return nil
+		}
+
+		glog.Warningf("error updating HAProxy using the runtime API, reloading: %v", err)
+	}
+
+	// the state file allows the new HAProxy process to keep the
+	// state of the servers of the current configuration
+	h.saveServerState()
+
+	// a new version is written even if the file did not change, like
+	// when a certificate changed, to reload HAProxy
+	h.cfg = nil
+	err = h.writeCfg(conf)
+	if err != nil {
+		return err
+	}
+
+	glog.Info("HAProxy configuration changed, reload required")
+	h.backends = backends
+	h.structureMD5 = md5
+	h.setReloadPending(true)
+	return nil
+}
+
+// checkHAProxyReload triggers a sync while HAProxy has not loaded the last
+// configuration, to apply the pending changes once the reload is done
+func (ipvsc *ipvsControllerController) checkHAProxyReload() {
+	if !ipvsc.keepalived.haproxy.isReloadPending() {
+		return
+	}
+
+	ipvsc.syncQueue.Enqueue(cache.ExplicitKey(fmt.Sprintf("%v/%v", ipvsc.podNamespace, ipvsc.podName)))
+}
+
+func (h *haproxy) isReloadPending() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.reloadPending
+}
+
+func (h *haproxy) setReloadPending(pending bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.reloadPending = pending
+}
+
+// runningVersion returns the version of the configuration file loaded by
+// the running HAProxy process
+func (h *haproxy) runningVersion() (string, error) {
+	info, err := h.runtimeCommand("show info")
+	if err != nil {
+		return "", err
+	}
+
+	return parseHAProxyInfo(info)["description"], nil
+}
+
+// parseHAProxyInfo returns the fields of the output of show info
+func parseHAProxyInfo(info string) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return fields
+}
+
+// runningBackends returns the servers of the running HAProxy process
+func (h *haproxy) runningBackends() (map[string]*haproxyBackend, error) {
+	state, err := h.runtimeCommand("show servers state")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseServersState(state)
+}
+
+// backendsFor returns the backends of the services, keeping the servers of
+// the current configuration. The backends used by HTTP and SNI routes are
+// also returned sorted by name.
+func (h *haproxy) backendsFor(svcs []vip) (map[string]*haproxyBackend, []*haproxyBackend) {
+	backends := map[string]*haproxyBackend{}
+	routeBackends := []*haproxyBackend{}
+	for _, svc := range svcs {
+		switch {
+		case svc.LVSMethod == "VIP":
+			continue
+		case svc.Mode == modeHTTP || svc.Mode == modeSNI:
+			// different routes can use the same backend
+			for _, route := range svc.Routes {
+				if _, ok := backends[route.Backend]; ok {
+					continue
+				}
+
+				backend := assignServers(route.Backend, h.backends[route.Backend], route.Backends)
+				backend.Mode = modeHTTP
+				if svc.Mode == modeSNI {
+					backend.Mode = modeTCP
+					backend.SendProxy = svc.LVSMethod == "PROXY"
+				}
+
+				backends[route.Backend] = backend
+				routeBackends = append(routeBackends, backend)
+			}
+		default:
+			name := haproxyBackendName(svc)
+			backends[name] = assignServers(name, h.backends[name], svc.Backends)
+		}
+	}
+
+	sort.Slice(routeBackends, func(i, j int) bool {
+		return routeBackends[i].Name < routeBackends[j].Name
+	})
+
+	return backends, routeBackends
+}
+
+// checkVersion reads the version of the running HAProxy process once and
+// warns when the certificates cannot be updated using the runtime API
+func (h *haproxy) checkVersion() {
+	if h.versionChecked {
+		return
+	}
+
+	info, err := h.runtimeCommand("show info")
+	if err != nil {
+		return
+	}
+
+	h.versionChecked = true
+	version := parseHAProxyInfo(info)["Version"]
+	if !haproxyVersionAtLeast(version, 2, 1) {
+		glog.Warningf("HAProxy %v cannot update certificates using the runtime API (requires 2.1), certificate changes reload HAProxy", version)
+		h.reloadCertificates = true
+	}
+}
+
+// haproxyVersionAtLeast returns false if the version of HAProxy is lower
+// than major.minor. Unknown versions are considered recent.
+func haproxyVersionAtLeast(version string, major, minor int) bool {
+	m := haproxyVersionRegex.FindStringSubmatch(version)
+	if m == nil {
+		return true
+	}
+
+	vMajor, _ := strconv.Atoi(m[1])
+	vMinor, _ := strconv.Atoi(m[2])
+	if vMajor != major {
+		return vMajor > major
+	}
+
+	return vMinor >= minor
+}
+
+// updateCertificates writes the certificates used in http mode. If runtime
+// is true the certificates are also updated in the running HAProxy process,
+// otherwise it returns true when a certificate loaded by HAProxy changed.
+func (h *haproxy) updateCertificates(svcs []vip, runtime bool) (bool, error) {
+	if h.certificates == nil {
+		h.certificates = map[string][]byte{}
+	}
+
+	changed := false
+
+	used := map[string]bool{}
+	for _, svc := range svcs {
+		for _, cert := range svc.Certificates {
+			used[cert.Path] = true
+			if bytes.Equal(h.certificates[cert.Path], cert.PEM) {
+				continue
+			}
+
+			err := os.MkdirAll(haproxyCertsDir, 0700)
+			if err != nil {
+				return false, err
+			}
+
+			err = ioutil.WriteFile(cert.Path, cert.PEM, 0600)
+			if err != nil {
+				return false, fmt.Errorf("unexpected error writing certificate %v: %v", cert.Name, err)
+			}
+
+			_, loaded := h.certificates[cert.Path]
+			h.certificates[cert.Path] = cert.PEM
+
+			if !loaded {
+				continue
+			}
+
+			if !runtime {
+				changed = true
+				continue
+			}
+
+			glog.Infof("updating certificate %v", cert.Name)
+			_, err = h.runtimeCommand(fmt.Sprintf("set ssl cert %v <<\n%v\n", cert.Path, strings.TrimSpace(string(cert.PEM))))
+			if err != nil {
+				return false, err
+			}
+
+			_, err = h.runtimeCommand(fmt.Sprintf("commit ssl cert %v", cert.Path))
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	removeCertificates(haproxyCertsDir, used)
+	for path := range h.certificates {
+		if !used[path] {
+			delete(h.certificates, path)
+		}
+	}
+
+	return changed, nil
+}
+
+// removeCertificates removes the certificates of the directory that are not
+// used, like the ones of deleted secrets or rules
+func removeCertificates(dir string, used map[string]bool) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("unexpected error reading %v: %v", dir, err)
+		}
+		return
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if file.IsDir() || filepath.Ext(path) != ".pem" || used[path] {
+			continue
+		}
+
+		glog.Infof("removing certificate %v", path)
+		err := os.Remove(path)
+		if err != nil {
+			glog.Warningf("unexpected error removing certificate %v: %v", path, err)
+		}
+	}
+}
+
+// writeCfg writes the HAProxy configuration file with a new version. The
+// file is not written when the configuration did not change, to avoid
+// reloads of HAProxy waiting for a version that is never loaded.
+func (h *haproxy) writeCfg(conf map[string]interface{}) error {
+	conf["configVersion"] = h.configVersion
+	buf := &bytes.Buffer{}
+	err := h.tmpl.Execute(buf, conf)
+	if err != nil {
+		return fmt.Errorf("unexpected error creating haproxy.cfg: %v", err)
+	}
+
+	if h.configVersion != "" && bytes.Equal(buf.Bytes(), h.cfg) {
+		return nil
+	}
+
+	h.configVersion = strconv.FormatInt(time.Now().UnixNano(), 36)
+	conf["configVersion"] = h.configVersion
+	buf.Reset()
+	err = h.tmpl.Execute(buf, conf)
+	if err != nil {
+		return fmt.Errorf("unexpected error creating haproxy.cfg: %v", err)
+	}
+
+	err = ioutil.WriteFile(haproxyCfg, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	h.cfg = buf.Bytes()
+	return nil
+}
+
+// applyRuntimeChanges updates the servers of the running HAProxy process
+// that differ from the new backends
+func (h *haproxy) applyRuntimeChanges(backends map[string]*haproxyBackend) error {
+	cmds := runtimeCommands(h.backends, backends)
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	for _, cmd := range cmds {
+		glog.V(2).Infof("HAProxy runtime API: %v", cmd)
+		_, err := h.runtimeCommand(cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.saveServerState()
+	return nil
+}
+
+// saveServerState writes the current state of the servers to the HAProxy
+// server state file, loaded by HAProxy after a reload
+func (h *haproxy) saveServerState() {
+	state, err := h.runtimeCommand("show servers state")
+	if err != nil {
+		glog.V(2).Infof("unable to get HAProxy servers state: %v", err)
+		return
+	}
+
+	err = ioutil.WriteFile(haproxyStateFile, []byte(state+"\n"), 0644)
+	if err != nil {
+		glog.Warningf("unexpected error writing HAProxy servers state: %v", err)
+	}
+}
+
+// runtimeCommand sends a command to the HAProxy admin socket and returns the response
+func (h *haproxy) runtimeCommand(cmd string) (string, error) {
+	conn, err := net.DialTimeout("unix", h.socket, time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "%v\n", cmd)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+
+	resp := strings.TrimSpace(string(b))
+	for _, prefix := range haproxyRuntimeErrors {
+		if strings.HasPrefix(resp, prefix) {
+			return "", fmt.Errorf("%v: %v", cmd, resp)
+		}
+	}
+
+	return resp, nil
+}
+
+// assignServers returns the servers of a backend for the given endpoints.
+// Endpoints already present keep their server to avoid changes in the
+// running HAProxy process. The number of servers is increased when
+// there are not enough free servers.
+func assignServers(name string, current *haproxyBackend, endpoints []service) *haproxyBackend {
+	size := haproxyMinSlots
+	if current != nil {
+		size = len(current.Servers)
+	}
+	for size < len(endpoints) {
+		size = size * 2
+	}
+
+	backend := &haproxyBackend{
+		Name:    name,
+		Servers: make([]haproxyServer, size),
+	}
+
+	pending := map[string]service{}
+	for _, ep := range endpoints {
+		pending[fmt.Sprintf("%v:%v", ep.IP, ep.Port)] = ep
+	}
+
+	if current != nil {
+		for i, server := range current.Servers {
+			key := fmt.Sprintf("%v:%v", server.IP, server.Port)
+			if _, ok := pending[key]; ok && server.Enabled {
+				backend.Servers[i] = server
+				delete(pending, key)
+			}
+		}
+	}
+
+	next := 0
+	for _, ep := range endpoints {
+		key := fmt.Sprintf("%v:%v", ep.IP, ep.Port)
+		if _, ok := pending[key]; !ok {
+			continue
+		}
+
+		for backend.Servers[next].Enabled {
+			next++
+		}
+
+		backend.Servers[next] = haproxyServer{
+			IP:      ep.IP,
+			Port:    ep.Port,
+			Enabled: true,
+		}
+		delete(pending, key)
+	}
+
+	for i := range backend.Servers {
+		backend.Servers[i].Name = fmt.Sprintf("s%v", i+1)
+		if !backend.Servers[i].Enabled {
+			// keep the last address to avoid unnecessary changes
+			if current != nil && i < len(current.Servers) {
+				backend.Servers[i].IP = current.Servers[i].IP
+				backend.Servers[i].Port = current.Servers[i].Port
+			}
+			if backend.Servers[i].IP == "" {
+				backend.Servers[i].IP = "127.0.0.1"
+				backend.Servers[i].Port = 1
+			}
+		}
+	}
+
+	return backend
+}
+
+// runtimeCommands returns the HAProxy runtime API commands required to
+// change the servers from the current to the new backends. Both must have
+// the same structure.
+func runtimeCommands(current, backends map[string]*haproxyBackend) []string {
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cmds := []string{}
+	for _, name := range names {
+		backend := backends[name]
+		old, ok := current[name]
+		if !ok {
+			continue
+		}
+
+		for i, server := range backend.Servers {
+			oldServer := old.Servers[i]
+			id := fmt.Sprintf("%v/%v", name, server.Name)
+
+			if server.IP != oldServer.IP || server.Port != oldServer.Port {
+				if oldServer.Enabled {
+					cmds = append(cmds, fmt.Sprintf("set server %v state maint", id))
+					oldServer.Enabled = false
+				}
+				cmds = append(cmds, fmt.Sprintf("set server %v addr %v port %v", id, server.IP, server.Port))
+			}
+
+			if server.Enabled != oldServer.Enabled {
+				state := "maint"
+				if server.Enabled {
+					state = "ready"
+				}
+				cmds = append(cmds, fmt.Sprintf("set server %v state %v", id, state))
+			}
+		}
+	}
+
+	return cmds
+}
+
+// parseServersState returns the servers of each backend contained in the
+// output of the show servers state command of the HAProxy runtime API
+func parseServersState(state string) (map[string]*haproxyBackend, error) {
+	type server struct {
+		id int
+		haproxyServer
+	}
+
+	columns := map[string]int{}
+	servers := map[string][]server{}
+	for _, line := range strings.Split(state, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "#" {
+			for i, name := range fields[1:] {
+				columns[name] = i
+			}
+			continue
+		}
+
+		// the first line contains the version of the format
+		if len(columns) == 0 || len(fields) == 0 {
+			continue
+		}
+
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(fields) {
+				return ""
+			}
+			return fields[i]
+		}
+
+		id, err := strconv.Atoi(field("srv_id"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid server id in HAProxy servers state %q: %v", line, err)
+		}
+		admin, err := strconv.Atoi(field("srv_admin_state"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin state in HAProxy servers state %q: %v", line, err)
+		}
+		port, err := strconv.Atoi(field("srv_port"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in HAProxy servers state %q: %v", line, err)
+		}
+
+		name := field("be_name")
+		servers[name] = append(servers[name], server{id, haproxyServer{
+			Name:    field("srv_name"),
+			IP:      field("srv_addr"),
+			Port:    port,
+			Enabled: admin&haproxyAdminMaint == 0,
+		}})
+	}
+
+	backends := map[string]*haproxyBackend{}
+	for name, list := range servers {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].id < list[j].id
+		})
+
+		backend := &haproxyBackend{Name: name}
+		for _, s := range list {
+			backend.Servers = append(backend.Servers, s.haproxyServer)
+		}
+		backends[name] = backend
+	}
+
+	return backends, nil
+}
+
+// haproxyStructureChecksum returns a checksum of the parts of the HAProxy
+// configuration that cannot be changed using the runtime API
+func haproxyStructureChecksum(svcs []vip, backends map[string]*haproxyBackend) (string, error) {
+	type listener struct {
+		Name         string
+		IP           string
+		Port         int
+		Protocol     string
+		LVSMethod    string
+		Mode         string
+		Routes       []string
+		Certificates []string
+		Servers      map[string]int
+	}
+
+	listeners := []listener{}
+	for _, svc := range svcs {
+		l := listener{
+			Name:      svc.Name,
+			IP:        svc.IP,
+			Port:      svc.Port,
+			Protocol:  svc.Protocol,
+			LVSMethod: svc.LVSMethod,
+			Mode:      svc.Mode,
+			Servers:   map[string]int{},
+		}
+
+		names := []string{haproxyBackendName(svc)}
+		for _, route := range svc.Routes {
+			l.Routes = append(l.Routes, fmt.Sprintf("%v%v=%v", route.Host, route.Path, route.Backend))
+			names = append(names, route.Backend)
+		}
+
+		for _, cert := range svc.Certificates {
+			l.Certificates = append(l.Certificates, cert.Path)
+		}
+
+		for _, name := range names {
+			if backend, ok := backends[name]; ok {
+				l.Servers[name] = len(backend.Servers)
+			}
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	b, err := json.Marshal(listeners)
+	if err != nil {
+		return "", err
+	}
+
+	hash := md5.Sum(b)
+	return hex.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestAssignServers(t *testing.T) {
+	eps := []service{{IP: "10.2.0.1", Port: 8080}, {IP: "10.2.0.2", Port: 8080}}
+
+	backend := assignServers("default-echoheaders-80", nil, eps)
+	if len(backend.Servers) != haproxyMinSlots {
+		t.Fatalf("expected %v servers but returned %v", haproxyMinSlots, len(backend.Servers))
+	}
+
+	expected := []haproxyServer{
+		{"s1", "10.2.0.1", 8080, true},
+		{"s2", "10.2.0.2", 8080, true},
+		{"s3", "127.0.0.1", 1, false},
+		{"s4", "127.0.0.1", 1, false},
+	}
+	if !reflect.DeepEqual(backend.Servers, expected) {
+		t.Errorf("expected %v but returned %v", expected, backend.Servers)
+	}
+
+	// removing an endpoint must not move the others
+	updated := assignServers("default-echoheaders-80", backend, eps[1:])
+	expected = []haproxyServer{
+		{"s1", "10.2.0.1", 8080, false},
+		{"s2", "10.2.0.2", 8080, true},
+		{"s3", "127.0.0.1", 1, false},
+		{"s4", "127.0.0.1", 1, false},
+	}
+	if !reflect.DeepEqual(updated.Servers, expected) {
+		t.Errorf("expected %v but returned %v", expected, updated.Servers)
+	}
+
+	// more endpoints than servers
+	many := []service{}
+	for _, ip := range []string{"10.2.0.1", "10.2.0.2", "10.2.0.3", "10.2.0.4", "10.2.0.5"} {
+		many = append(many, service{IP: ip, Port: 8080})
+	}
+	grown := assignServers("default-echoheaders-80", backend, many)
+	if len(grown.Servers) != 2*haproxyMinSlots {
+		t.Errorf("expected %v servers but returned %v", 2*haproxyMinSlots, len(grown.Servers))
+	}
+}
+
+func TestRuntimeCommands(t *testing.T) {
+	eps := []service{{IP: "10.2.0.1", Port: 8080}, {IP: "10.2.0.2", Port: 8080}}
+
+	current := map[string]*haproxyBackend{
+		"default-echoheaders-80": assignServers("default-echoheaders-80", nil, eps),
+	}
+
+	updated := map[string]*haproxyBackend{
+		"default-echoheaders-80": assignServers("default-echoheaders-80", current["default-echoheaders-80"],
+			[]service{{IP: "10.2.0.2", Port: 8080}, {IP: "10.2.0.3", Port: 8080}}),
+	}
+
+	expected := []string{
+		"set server default-echoheaders-80/s1 state maint",
+		"set server default-echoheaders-80/s1 addr 10.2.0.3 port 8080",
+		"set server default-echoheaders-80/s1 state ready",
+	}
+
+	cmds := runtimeCommands(current, updated)
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("expected %v but returned %v", expected, cmds)
+	}
+
+	if cmds := runtimeCommands(updated, updated); len(cmds) != 0 {
+		t.Errorf("expected no commands but returned %v", cmds)
+	}
+}
+
+func TestHAProxyTemplate(t *testing.T) {
+	tmpl, err := template.ParseFiles("../../rootfs/haproxy.tmpl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing template: %v", err)
+	}
+
+	h := &haproxy{tmpl: tmpl}
+	svcs := []vip{
+		{Name: "", IP: "10.4.0.49", LVSMethod: "VIP", Protocol: "TCP"},
+		{Name: "default-echoheaders", IP: "10.4.0.50", Port: 80, LVSMethod: "PROXY", Protocol: "TCP", Mode: modeTCP,
+			Backends: []service{{IP: "10.2.0.1", Port: 8080}}},
+		{Name: "http-10.4.0.51", IP: "10.4.0.51", Port: 80, LVSMethod: "NAT", Protocol: "TCP", Mode: modeHTTP,
+			Routes: []route{
+				{Host: "example.com", Path: "/api", Backend: "http-default-api-80", Backends: []service{{IP: "10.2.0.2", Port: 8080}}},
+				{Backend: "http-default-web-80"},
+			},
+			Certificates: []certificate{{Name: "default/cert", Path: "/etc/haproxy/certs/default-cert.pem"}},
+		},
+		{Name: "sni-10.4.0.52", IP: "10.4.0.52", Port: 443, LVSMethod: "PROXY", Protocol: "TCP", Mode: modeSNI,
+			Routes: []route{
+				{Host: "example.com", Backend: "sni-default-web-443", Backends: []service{{IP: "10.2.0.3", Port: 8443}}},
+			},
+		},
+	}
+
+	backends, routeBackends := h.backendsFor(svcs)
+	conf := map[string]interface{}{
+		"svcs":          svcs,
+		"backends":      backends,
+		"routeBackends": routeBackends,
+		"configVersion": "k2x9z",
+	}
+
+	buf := &bytes.Buffer{}
+	err = h.tmpl.Execute(buf, conf)
+	if err != nil {
+		t.Fatalf("unexpected error rendering template: %v", err)
+	}
+
+	expected := []string{
+		"description k2x9z",
+		"listen default-echoheaders-80",
+		"server s1 10.2.0.1:8080 check send-proxy inter 5000",
+		"frontend http-10.4.0.51",
+		"bind      10.4.0.51:443 ssl crt /etc/haproxy/certs/default-cert.pem",
+		"use_backend http-default-api-80 if { req.hdr(host),field(1,:) -i example.com } { path_beg /api }",
+		"default_backend http-default-web-80",
+		"backend http-default-api-80",
+		"server s2 127.0.0.1:1 check inter 5000 disabled",
+		"frontend sni-10.4.0.52",
+		"tcp-request inspect-delay 5s",
+		"use_backend sni-default-web-443 if { req_ssl_sni -i example.com }",
+		"server s1 10.2.0.3:8443 check send-proxy inter 5000",
+	}
+	for _, line := range expected {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected %q in rendered configuration:\n%v", line, buf.String())
+		}
+	}
+
+	if strings.Contains(buf.String(), "listen -0") {
+		t.Errorf("VIP only services must not render a listen section:\n%v", buf.String())
+	}
+}
+
+func TestHAProxyVersionAtLeast(t *testing.T) {
+	testcases := map[string]bool{
+		"2.1.4":            true,
+		"2.2-dev5":         true,
+		"3.0.1":            true,
+		"2.0.14-1~bpo10+1": false,
+		"1.8.25":           false,
+		"":                 true,
+	}
+
+	for version, expected := range testcases {
+		if atLeast := haproxyVersionAtLeast(version, 2, 1); atLeast != expected {
+			t.Errorf("%q: expected %v but returned %v", version, expected, atLeast)
+		}
+	}
+}
+
+func TestParseServersState(t *testing.T) {
+	state := `1
+# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state srv_uweight srv_iweight srv_time_since_last_change srv_check_status srv_check_result srv_check_health srv_check_state srv_agent_state bk_f_forced_id srv_f_forced_id srv_fqdn srv_port
+3 default-echoheaders-80 2 s2 127.0.0.1 0 5 1 1 10 1 0 0 14 0 0 0 - 1
+3 default-echoheaders-80 1 s1 10.2.0.1 2 0 1 1 10 6 3 4 6 0 0 0 - 8080
+4 http-default-api-80 1 s1 10.2.0.2 2 1 1 1 10 6 3 4 6 0 0 0 - 8080`
+
+	running, err := parseServersState(state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]*haproxyBackend{
+		"default-echoheaders-80": {Name: "default-echoheaders-80", Servers: []haproxyServer{
+			{"s1", "10.2.0.1", 8080, true},
+			{"s2", "127.0.0.1", 1, false},
+		}},
+		"http-default-api-80": {Name: "http-default-api-80", Servers: []haproxyServer{
+			{"s1", "10.2.0.2", 8080, false},
+		}},
+	}
+	if !reflect.DeepEqual(running, expected) {
+		t.Errorf("expected %+v but returned %+v", expected, running)
+	}
+
+	if _, err := parseServersState("1\n# be_id be_name srv_id srv_name srv_admin_state srv_port\n3 a x s1 0 80"); err == nil {
+		t.Errorf("expected an error with an invalid server id")
+	}
+}
+
+func TestParseHAProxyInfo(t *testing.T) {
+	info := "Name: HAProxy\nVersion: 2.1.4\nRelease_date: 2020/04/02\nPid: 42\nnode: node1\ndescription: k2x9z\n"
+
+	fields := parseHAProxyInfo(info)
+	expected := map[string]string{
+		"Name":         "HAProxy",
+		"Version":      "2.1.4",
+		"Release_date": "2020/04/02",
+		"Pid":          "42",
+		"node":         "node1",
+		"description":  "k2x9z",
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected %v but returned %v", expected, fields)
+	}
+
+	if fields := parseHAProxyInfo("description:"); fields["description"] != "" {
+		t.Errorf("expected an empty description but returned %q", fields["description"])
+	}
+}
+
+func TestRemoveCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"default-used.pem", "default-deleted.pem", "other.txt"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte("pem"), 0600)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	removeCertificates(dir, map[string]bool{filepath.Join(dir, "default-used.pem"): true})
+
+	for name, exists := range map[string]bool{"default-used.pem": true, "default-deleted.pem": false, "other.txt": true} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists != (err == nil) {
+			t.Errorf("expected %v to exist: %v", name, exists)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/aledbf/kube-keepalived-vip/pkg/store"
+)
+
+// newNamespacedInformer returns an informer of the objects of a resource
+// matching the label selector in the given namespaces. An empty list of
+// namespaces watches all the namespaces. Each namespace uses a different
+// informer and the returned store contains the objects of all of them.
+func newNamespacedInformer(c cache.Getter, resource string, namespaces []string, selector string,
+	objType runtime.Object, h cache.ResourceEventHandler) (cache.Store, cache.Controller) {
+	optionsModifier := func(options *metav1.ListOptions) {
+		options.LabelSelector = selector
+	}
+
+	if len(namespaces) <= 1 {
+		ns := apiv1.NamespaceAll
+		if len(namespaces) == 1 {
+			ns = namespaces[0]
+		}
+
+		return cache.NewInformer(cache.NewFilteredListWatchFromClient(c, resource, ns, optionsModifier),
+			objType, resyncPeriod, h)
+	}
+
+	stores := map[string]cache.Store{}
+	controllers := multiController{}
+	for _, ns := range namespaces {
+		s, ctrl := cache.NewInformer(cache.NewFilteredListWatchFromClient(c, resource, ns, optionsModifier),
+			objType, resyncPeriod, h)
+		stores[ns] = s
+		controllers = append(controllers, ctrl)
+	}
+
+	return store.NewNamespacedStore(stores), controllers
+}
+
+// multiController runs the informers of several namespaces
+type multiController []cache.Controller
+
+func (mc multiController) Run(stopCh <-chan struct{}) {
+	for _, c := range mc {
+		go c.Run(stopCh)
+	}
+	<-stopCh
+}
+
+func (mc multiController) HasSynced() bool {
+	for _, c := range mc {
+		if !c.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (mc multiController) LastSyncResourceVersion() string {
+	return ""
+}
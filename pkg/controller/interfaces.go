@@ -0,0 +1,414 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// DefaultExcludedIfaces contains the patterns of the interfaces of
+// containers, CNI plugins, kube-proxy and tunnels ignored by the controller
+var DefaultExcludedIfaces = []string{
+	"lo", "docker*", "cbr0", "veth*", "cali*", "flannel*", "cilium_*", "lxc*",
+	"weave", "datapath", "vxlan*", "kube-ipvs0", "kube-bridge", "kube-dummy-if",
+	"nodelocaldns", "tunl*", "wg*",
+}
+
+// internalIfaces contains the patterns of the interfaces created by
+// keepalived (VMAC) and the controller (BGP), always excluded
+var internalIfaces = []string{"vrrp.*", bgpIface}
+
+var (
+	// ifaceNameRegex matches the valid names of network interfaces
+	ifaceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+	// labelRegex matches the labels of addresses, with or without the
+	// name of the interface
+	labelRegex = regexp.MustCompile(`^([a-zA-Z0-9_.-]{1,15}:)?[a-zA-Z0-9_.-]{1,15}$`)
+
+	// addressScopes contains the scopes of an address supported by ip and
+	// keepalived
+	addressScopes = []string{"global", "site", "link", "host", "nowhere"}
+
+	// interfaceAddrs returns the addresses of the network interfaces
+	interfaceAddrs = localInterfaceAddrs
+
+	// excludedIfaces contains the patterns of the interfaces not used by
+	// the controller
+	excludedIfaces = append(append([]string{}, DefaultExcludedIfaces...), internalIfaces...)
+
+	// sysClassNet and routeFile are the paths used to find the ports of bonds
+	// and bridges and the default route
+	sysClassNet = "/sys/class/net"
+	routeFile   = "/proc/net/route"
+)
+
+// vipAddress is a VIP configured by a VRRP instance
+type vipAddress struct {
+	IP string
+	// Interface is the network interface of the VIP
+	Interface string
+	// Prefix is the prefix length of the address. Zero uses a host prefix
+	Prefix int
+	// Label is the label of the address, starting with the interface name
+	Label string
+	// Scope of the address. Empty uses global
+	Scope string
+}
+
+// CIDR returns the VIP with its prefix length
+func (a vipAddress) CIDR() string {
+	prefix := a.Prefix
+	if prefix == 0 {
+		prefix = 128
+		if ip := net.ParseIP(a.IP); ip != nil && ip.To4() != nil {
+			prefix = 32
+		}
+	}
+
+	return fmt.Sprintf("%v/%v", a.IP, prefix)
+}
+
+// addArgs returns the arguments of ip address to add the VIP
+func (a vipAddress) addArgs() []string {
+	args := []string{a.CIDR(), "dev", a.Interface}
+	if a.Scope != "" {
+		args = append(args, "scope", a.Scope)
+	}
+	if a.Label != "" {
+		args = append(args, "label", a.Label)
+	}
+
+	return args
+}
+
+// addressLabel returns the label of an address in an interface. Labels
+// without the interface name get it as prefix.
+func addressLabel(label, iface string) (string, error) {
+	if label == "" {
+		return "", nil
+	}
+
+	if !strings.Contains(label, ":") {
+		label = fmt.Sprintf("%v:%v", iface, label)
+	} else if !strings.HasPrefix(label, iface+":") {
+		return "", fmt.Errorf("label %v must start with the interface name %v", label, iface)
+	}
+
+	if len(label) > 15 {
+		return "", fmt.Errorf("label %v is longer than 15 characters", label)
+	}
+
+	return label, nil
+}
+
+// validateAddressScope checks the scope of an address
+func validateAddressScope(scope string) error {
+	if scope != "" && !contains(addressScopes, scope) {
+		return fmt.Errorf("invalid scope %v. Only %v are supported", scope, strings.Join(addressScopes, ", "))
+	}
+
+	return nil
+}
+
+// validateInterface checks the name of a network interface or a CIDR used
+// to find the interface
+func validateInterface(value string) error {
+	if _, _, err := net.ParseCIDR(value); err == nil {
+		return nil
+	}
+
+	if net.ParseIP(value) != nil {
+		return fmt.Errorf("invalid interface %v, use a CIDR to find the interface of an address", value)
+	}
+
+	if !ifaceNameRegex.MatchString(value) {
+		return fmt.Errorf("invalid interface %v, it must be the name of an interface or a CIDR", value)
+	}
+
+	return nil
+}
+
+// findInterface returns the name of the interface or the interface with an
+// address in the CIDR. The addresses contain all the interfaces.
+func findInterface(value string, addrs map[string][]*net.IPNet) (string, error) {
+	_, cidr, err := net.ParseCIDR(value)
+	if err != nil {
+		if _, ok := addrs[value]; !ok {
+			return "", fmt.Errorf("interface %v not found", value)
+		}
+		return value, nil
+	}
+
+	names := []string{}
+	for name := range addrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, addr := range addrs[name] {
+			if cidr.Contains(addr.IP) {
+				return name, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no interface with an address in %v", value)
+}
+
+// setExcludedInterfaces changes the patterns (like veth*) of the interfaces
+// not used by the controller. The internal interfaces are always excluded
+func setExcludedInterfaces(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid interface pattern %v: %v", pattern, err)
+		}
+	}
+
+	excludedIfaces = append(append([]string{}, patterns...), internalIfaces...)
+	return nil
+}
+
+// isExcludedInterface returns true if the name of the interface matches an
+// exclusion pattern
+func isExcludedInterface(name string) bool {
+	for _, pattern := range excludedIfaces {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isEnslaved returns true if the interface is a port of a bond or a bridge,
+// so the addresses are in the bond or bridge instead
+func isEnslaved(name string) bool {
+	master, err := os.Readlink(filepath.Join(sysClassNet, name, "master"))
+	if err != nil {
+		return false
+	}
+
+	for _, kind := range []string{"bonding", "bridge"} {
+		if _, err := os.Stat(filepath.Join(sysClassNet, filepath.Base(master), kind)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// defaultRouteInterface returns the interface of the IPv4 default route
+// with the lowest metric
+func defaultRouteInterface() (string, error) {
+	f, err := os.Open(routeFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return parseDefaultRoute(f)
+}
+
+// parseDefaultRoute returns the interface of the default route in the
+// format of /proc/net/route, ignoring the excluded interfaces
+func parseDefaultRoute(r io.Reader) (string, error) {
+	iface := ""
+	metric := -1
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&0x1 == 0 {
+			// not RTF_UP
+			continue
+		}
+
+		m, err := strconv.Atoi(fields[6])
+		if err != nil || isExcludedInterface(fields[0]) {
+			continue
+		}
+
+		if metric == -1 || m < metric {
+			iface, metric = fields[0], m
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if iface == "" {
+		return "", fmt.Errorf("no default route found")
+	}
+
+	return iface, nil
+}
+
+// localInterfaceAddrs returns the addresses of the network interfaces of
+// the node, excluding the interfaces of containers
+func localInterfaceAddrs() (map[string][]*net.IPNet, error) {
+	ifaces, err := netInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := map[string][]*net.IPNet{}
+	for _, iface := range ifaces {
+		addrs[iface.Name] = []*net.IPNet{}
+
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range ifaceAddrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				addrs[iface.Name] = append(addrs[iface.Name], ipNet)
+			}
+		}
+	}
+
+	return addrs, nil
+}
+
+// resolveInterfaces sets the interface of each VIP: the interface of the
+// entry, the interface of its VRRP group or the interface of keepalived.
+// Entries with an interface that is not found are removed.
+func (k *keepalived) resolveInterfaces(svcs []vip) []vip {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		glog.Warningf("error listing network interfaces: %v", err)
+		addrs = map[string][]*net.IPNet{}
+	}
+
+	groupIfaces := map[string]string{}
+	vlanLinks := map[string]vlanLink{}
+	for name, cfg := range k.vrrpInstances {
+		if cfg.Interface == "" && cfg.VLAN == nil {
+			continue
+		}
+
+		iface := k.iface
+		if cfg.Interface != "" {
+			iface, err = findInterface(cfg.Interface, addrs)
+			if err != nil {
+				glog.Warningf("VRRP instance %v: %v, ignoring its VIPs", name, err)
+				groupIfaces[name] = ""
+				continue
+			}
+		}
+
+		// the VIPs of the group use a VLAN interface in the interface
+		if cfg.VLAN != nil {
+			link := vlanLink{Name: vlanLinkName(iface, *cfg.VLAN), Parent: iface, ID: *cfg.VLAN}
+			if other, ok := vlanLinks[link.Name]; ok && other != link {
+				glog.Warningf("VRRP instance %v: interface %v is already used by other VLAN, ignoring its VIPs", name, link.Name)
+				groupIfaces[name] = ""
+				continue
+			}
+
+			vlanLinks[link.Name] = link
+			iface = link.Name
+		}
+
+		groupIfaces[name] = iface
+	}
+
+	result := []vip{}
+	for _, svc := range svcs {
+		group := svc.Group
+		if group == "" {
+			group = defaultGroup
+		}
+
+		iface, ok := groupIfaces[group]
+		if !ok {
+			iface = k.iface
+		}
+
+		if iface == "" {
+			// the interface of the group was not found
+			continue
+		}
+
+		if svc.Interface != "" {
+			iface, err = findInterface(svc.Interface, addrs)
+			if err != nil {
+				glog.Warningf("VIP %v: %v", svc.IP, err)
+				continue
+			}
+		}
+
+		svc.Interface = iface
+		result = append(result, svc)
+	}
+
+	k.groupIfaces = groupIfaces
+	k.vlanLinks = vlanLinks
+	return result
+}
+
+// groupInterface returns the interface of a VRRP group
+func (k *keepalived) groupInterface(name string) string {
+	if iface := k.groupIfaces[name]; iface != "" {
+		return iface
+	}
+
+	return k.iface
+}
+
+// advertInterface returns the interface where the VRRP instance of a group
+// sends its adverts. The VLAN interfaces have no address, so the instance of
+// a group with VLAN uses the parent interface and the VIPs the VLAN interface.
+func (k *keepalived) advertInterface(name string) string {
+	iface := k.groupInterface(name)
+	if link, ok := k.vlanLinks[iface]; ok {
+		return link.Parent
+	}
+
+	return iface
+}
+
+// vrrpInterfaces returns the interfaces used by the VRRP groups
+func (k *keepalived) vrrpInterfaces() []string {
+	ifaces := []string{k.iface}
+	for _, group := range k.getGroups() {
+		ifaces = appendIfMissing(ifaces, group.Interface)
+	}
+
+	return ifaces
+}
@@ -0,0 +1,373 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testInterfaceAddrs() (map[string][]*net.IPNet, error) {
+	parse := func(cidr string) *net.IPNet {
+		ip, ipNet, _ := net.ParseCIDR(cidr)
+		ipNet.IP = ip
+		return ipNet
+	}
+
+	return map[string][]*net.IPNet{
+		"eth0":  {parse("10.4.0.2/24")},
+		"eth1":  {parse("192.168.10.2/24"), parse("fd00:10::2/64")},
+		"bond0": {},
+	}, nil
+}
+
+func TestFindInterface(t *testing.T) {
+	addrs, _ := testInterfaceAddrs()
+
+	testcases := map[string]struct {
+		Value string
+		Iface string
+		Error bool
+	}{
+		"name":                 {Value: "eth1", Iface: "eth1"},
+		"name without address": {Value: "bond0", Iface: "bond0"},
+		"unknown name":         {Value: "eth2", Error: true},
+		"cidr":                 {Value: "192.168.10.0/24", Iface: "eth1"},
+		"ipv6 cidr":            {Value: "fd00:10::/64", Iface: "eth1"},
+		"unknown cidr":         {Value: "172.16.0.0/16", Error: true},
+	}
+
+	for name, tc := range testcases {
+		iface, err := findInterface(tc.Value, addrs)
+		if tc.Error && err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+		if !tc.Error && (err != nil || iface != tc.Iface) {
+			t.Errorf("%v: expected %v but returned %v (%v)", name, tc.Iface, iface, err)
+		}
+	}
+}
+
+func TestValidateInterface(t *testing.T) {
+	testcases := map[string]bool{
+		"eth0":                  true,
+		"bond0.100":             true,
+		"10.0.0.0/8":            true,
+		"fd00::/64":             true,
+		"eth 0":                 false,
+		"10.0.0.1":              false,
+		"a-very-long-interface": false,
+	}
+
+	for value, valid := range testcases {
+		err := validateInterface(value)
+		if valid != (err == nil) {
+			t.Errorf("%v: expected valid %v but returned %v", value, valid, err)
+		}
+	}
+}
+
+func TestResolveInterfaces(t *testing.T) {
+	interfaceAddrs = testInterfaceAddrs
+	defer func() { interfaceAddrs = localInterfaceAddrs }()
+
+	intPtr := func(i int) *int { return &i }
+	ka := &keepalived{
+		iface: "eth0",
+		vrrpInstances: map[string]*vrrpInstanceConfig{
+			"public":  {Interface: "192.168.10.0/24", VRID: intPtr(51)},
+			"missing": {Interface: "eth5", VRID: intPtr(52)},
+			"tagged":  {Interface: "eth1", VLAN: intPtr(100), VRID: intPtr(53)},
+			"storage": {VLAN: intPtr(200), VRID: intPtr(54)},
+		},
+	}
+
+	svcs := ka.resolveInterfaces([]vip{
+		{IP: "10.4.0.50", Port: 80, Group: defaultGroup},
+		{IP: "10.4.0.51", Port: 80, Group: defaultGroup, Interface: "bond0"},
+		{IP: "192.168.10.50", Port: 80, Group: "public"},
+		{IP: "192.168.10.51", Port: 80, Group: "missing"},
+		{IP: "192.168.10.52", Port: 80, Group: "missing", Interface: "eth1"},
+		{IP: "10.4.0.52", Port: 80, Interface: "172.16.0.0/16"},
+		{IP: "172.20.0.50", Port: 80, Group: "tagged"},
+		{IP: "172.21.0.50", Port: 80, Group: "storage"},
+	})
+
+	ifaces := map[string]string{}
+	for _, svc := range svcs {
+		ifaces[svc.IP] = svc.Interface
+	}
+
+	expected := map[string]string{
+		"10.4.0.50":     "eth0",
+		"10.4.0.51":     "bond0",
+		"192.168.10.50": "eth1",
+		"172.20.0.50":   "eth1.100",
+		"172.21.0.50":   "eth0.200",
+	}
+	if !reflect.DeepEqual(ifaces, expected) {
+		t.Errorf("expected %v but returned %v", expected, ifaces)
+	}
+
+	groups := ka.vrrpGroups(svcs, nil)
+	if groups[0].Name != defaultGroup || groups[0].Interface != "eth0" {
+		t.Fatalf("unexpected group %+v", groups[0])
+	}
+
+	if !reflect.DeepEqual(groups[0].TrackInterfaces, []string{"eth0", "bond0"}) {
+		t.Errorf("unexpected interfaces tracked by the group vips: %v", groups[0].TrackInterfaces)
+	}
+
+	if !reflect.DeepEqual(groups[1].Addresses, []vipAddress{{IP: "192.168.10.50", Interface: "eth1"}}) {
+		t.Errorf("unexpected addresses of the group public: %v", groups[1].Addresses)
+	}
+
+	expectedLinks := map[string]vlanLink{
+		"eth1.100": {Name: "eth1.100", Parent: "eth1", ID: 100},
+		"eth0.200": {Name: "eth0.200", Parent: "eth0", ID: 200},
+	}
+	if !reflect.DeepEqual(ka.vlanLinks, expectedLinks) {
+		t.Errorf("expected VLAN interfaces %v but returned %v", expectedLinks, ka.vlanLinks)
+	}
+
+	found := false
+	for _, group := range groups {
+		if group.Name != "tagged" {
+			continue
+		}
+
+		// the adverts use the parent interface, with an address
+		found = true
+		if group.Interface != "eth1" || group.VMAC != "" {
+			t.Errorf("unexpected interfaces of the group tagged: %v %v", group.Interface, group.VMAC)
+		}
+		if !reflect.DeepEqual(group.Addresses, []vipAddress{{IP: "172.20.0.50", Interface: "eth1.100"}}) {
+			t.Errorf("unexpected addresses of the group tagged: %v", group.Addresses)
+		}
+		if !reflect.DeepEqual(group.TrackInterfaces, []string{"eth1", "eth1.100"}) {
+			t.Errorf("unexpected interfaces tracked by the group tagged: %v", group.TrackInterfaces)
+		}
+	}
+	if !found {
+		t.Errorf("expected the group tagged in %+v", groups)
+	}
+}
+
+func TestVIPAddress(t *testing.T) {
+	testcases := map[string]struct {
+		Address vipAddress
+		Args    []string
+	}{
+		"ipv4":        {vipAddress{IP: "10.4.0.50", Interface: "eth0"}, []string{"10.4.0.50/32", "dev", "eth0"}},
+		"ipv6":        {vipAddress{IP: "fd00:10::50", Interface: "eth1"}, []string{"fd00:10::50/128", "dev", "eth1"}},
+		"subnet":      {vipAddress{IP: "10.4.0.50", Interface: "eth0", Prefix: 24}, []string{"10.4.0.50/24", "dev", "eth0"}},
+		"label scope": {vipAddress{IP: "10.4.0.50", Interface: "eth0", Label: "eth0:vip", Scope: "link"}, []string{"10.4.0.50/32", "dev", "eth0", "scope", "link", "label", "eth0:vip"}},
+	}
+
+	for name, tc := range testcases {
+		if args := tc.Address.addArgs(); !reflect.DeepEqual(args, tc.Args) {
+			t.Errorf("%v: expected %v but returned %v", name, tc.Args, args)
+		}
+	}
+}
+
+func TestAddressLabel(t *testing.T) {
+	testcases := map[string]struct {
+		Label string
+		Iface string
+		Value string
+		Error bool
+	}{
+		"empty":              {Label: "", Iface: "eth0", Value: ""},
+		"suffix":             {Label: "vip", Iface: "eth0", Value: "eth0:vip"},
+		"full label":         {Label: "eth0:vip", Iface: "eth0", Value: "eth0:vip"},
+		"other interface":    {Label: "eth1:vip", Iface: "eth0", Error: true},
+		"too long":           {Label: "public-vips", Iface: "bond0.100", Error: true},
+		"vmac interface":     {Label: "vip", Iface: "vrrp.51", Value: "vrrp.51:vip"},
+		"interface with dot": {Label: "bond0.100:v", Iface: "bond0.100", Value: "bond0.100:v"},
+	}
+
+	for name, tc := range testcases {
+		label, err := addressLabel(tc.Label, tc.Iface)
+		if tc.Error && err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+		if !tc.Error && (err != nil || label != tc.Value) {
+			t.Errorf("%v: expected %v but returned %v (%v)", name, tc.Value, label, err)
+		}
+	}
+}
+
+func TestVLANLinkName(t *testing.T) {
+	testcases := map[string]struct {
+		Parent string
+		ID     int
+		Name   string
+	}{
+		"short name": {Parent: "eth0", ID: 100, Name: "eth0.100"},
+		"max length": {Parent: "enp0s31f6a", ID: 4000, Name: "enp0s31f6a.4000"},
+	}
+
+	for name, tc := range testcases {
+		if link := vlanLinkName(tc.Parent, tc.ID); link != tc.Name {
+			t.Errorf("%v: expected %v but returned %v", name, tc.Name, link)
+		}
+	}
+
+	// long parent names are truncated and must not collide
+	names := map[string]string{}
+	for _, parent := range []string{"enp0s31f6abcd", "enp0s31f6abce", "enp0s31f6", "bond-uplink-0", "bond-uplink-1"} {
+		link := vlanLinkName(parent, 4000)
+		if len(link) > 15 {
+			t.Errorf("%v: name %v is longer than 15 characters", parent, link)
+		}
+		if other, ok := names[link]; ok {
+			t.Errorf("%v: name %v is also used by %v", parent, link, other)
+		}
+		names[link] = parent
+	}
+}
+
+func TestIsExcludedInterface(t *testing.T) {
+	testcases := map[string]bool{
+		"eth0":         false,
+		"bond0":        false,
+		"br0":          false,
+		"lo":           true,
+		"veth1234":     true,
+		"cali12ab":     true,
+		"cilium_host":  true,
+		"lxc1234":      true,
+		"weave":        true,
+		"kube-ipvs0":   true,
+		"wg0":          true,
+		"vrrp.50":      true,
+		"flannel.1":    true,
+		bgpIface:       true,
+		"docker0":      true,
+		"nodelocaldns": true,
+	}
+
+	for name, excluded := range testcases {
+		if isExcludedInterface(name) != excluded {
+			t.Errorf("%v: expected excluded %v", name, excluded)
+		}
+	}
+
+	defer setExcludedInterfaces(DefaultExcludedIfaces)
+	if err := setExcludedInterfaces([]string{"eth[0"}); err == nil {
+		t.Errorf("expected an error with an invalid pattern")
+	}
+
+	if err := setExcludedInterfaces([]string{"eth1", "ens*"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !isExcludedInterface("ens3") || isExcludedInterface("veth1234") {
+		t.Errorf("expected only the configured patterns to be excluded")
+	}
+	if !isExcludedInterface("vrrp.50") || !isExcludedInterface(bgpIface) {
+		t.Errorf("expected the internal interfaces to be excluded")
+	}
+}
+
+func TestIsEnslaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sys-class-net")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sysClassNet = dir
+	defer func() { sysClassNet = "/sys/class/net" }()
+
+	// eth0 and eth1 are ports of bond0, eth2 of br0 and eth3 of the VRF red
+	for _, path := range []string{"bond0/bonding", "br0/bridge", "red", "eth0", "eth1", "eth2", "eth3", "eth4"} {
+		if err := os.MkdirAll(filepath.Join(dir, path), 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for port, master := range map[string]string{"eth0": "bond0", "eth1": "bond0", "eth2": "br0", "eth3": "red"} {
+		if err := os.Symlink("../"+master, filepath.Join(dir, port, "master")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	testcases := map[string]bool{
+		"bond0": false,
+		"br0":   false,
+		"eth0":  true,
+		"eth1":  true,
+		"eth2":  true,
+		"eth3":  false,
+		"eth4":  false,
+	}
+
+	for name, enslaved := range testcases {
+		if isEnslaved(name) != enslaved {
+			t.Errorf("%v: expected enslaved %v", name, enslaved)
+		}
+	}
+}
+
+func TestParseDefaultRoute(t *testing.T) {
+	header := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+
+	testcases := map[string]struct {
+		Routes string
+		Iface  string
+		Error  bool
+	}{
+		"default route": {
+			Routes: "eth0\t0004000A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+				"bond0\t00000000\t0104000A\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+			Iface: "bond0",
+		},
+		"lowest metric": {
+			Routes: "eth1\t00000000\t010AA8C0\t0003\t0\t0\t600\t00000000\t0\t0\t0\n" +
+				"br0\t00000000\t0104000A\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+			Iface: "br0",
+		},
+		"excluded interface": {
+			Routes: "wg0\t00000000\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0\n" +
+				"eth0\t00000000\t0104000A\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+			Iface: "eth0",
+		},
+		"route down": {
+			Routes: "eth0\t00000000\t0104000A\t0002\t0\t0\t100\t00000000\t0\t0\t0\n",
+			Error:  true,
+		},
+		"without default route": {
+			Routes: "eth0\t0004000A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n",
+			Error:  true,
+		},
+	}
+
+	for name, tc := range testcases {
+		iface, err := parseDefaultRoute(strings.NewReader(header + tc.Routes))
+		if tc.Error && err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+		if !tc.Error && (err != nil || iface != tc.Iface) {
+			t.Errorf("%v: expected %v but returned %v (%v)", name, tc.Iface, iface, err)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// allocationsKey is the key of the allocations ConfigMap containing the
+	// VIP allocated to each entry (namespace/configmap/key)
+	allocationsKey = "allocations"
+	// allocationsSuffix is appended to the name of the pools ConfigMap to
+	// get the name of the allocations ConfigMap
+	allocationsSuffix = "-allocations"
+)
+
+// ipPool is a set of addresses that can be used as VIPs. It is the value of
+// an entry of the pools ConfigMap, where the key is the name of the pool.
+type ipPool struct {
+	// Addresses contains CIDRs (10.0.0.0/28), ranges (10.0.0.10-10.0.0.20)
+	// or single addresses
+	Addresses []string `json:"addresses"`
+	// Namespaces contains the namespaces of the services ConfigMaps that
+	// can use the addresses of the pool. Empty allows all the namespaces
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	ranges []ipRange
+}
+
+// ipRange contains the addresses between first and last (included)
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+// parseIPRange parses a CIDR, a range or a single address. The network and
+// broadcast addresses of the CIDRs are not used.
+func parseIPRange(value string) (ipRange, error) {
+	value = strings.TrimSpace(value)
+
+	if strings.Contains(value, "/") {
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return ipRange{}, fmt.Errorf("invalid CIDR %v", value)
+		}
+
+		first := ipnet.IP.To16()
+		last := make(net.IP, len(first))
+		mask := ipnet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.IPMask{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, mask...)
+		}
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+
+		ones, bits := ipnet.Mask.Size()
+		if bits-ones > 1 {
+			first = nextIP(first)
+			if ipnet.IP.To4() != nil {
+				last = prevIP(last)
+			}
+		}
+
+		return ipRange{first: first, last: last}, nil
+	}
+
+	parts := strings.Split(value, "-")
+	if len(parts) > 2 {
+		return ipRange{}, fmt.Errorf("invalid range %v", value)
+	}
+
+	first := net.ParseIP(strings.TrimSpace(parts[0]))
+	last := first
+	if len(parts) == 2 {
+		last = net.ParseIP(strings.TrimSpace(parts[1]))
+	}
+
+	if first == nil || last == nil {
+		return ipRange{}, fmt.Errorf("invalid range %v", value)
+	}
+
+	if (first.To4() == nil) != (last.To4() == nil) {
+		return ipRange{}, fmt.Errorf("invalid range %v, the addresses use different families", value)
+	}
+
+	if bytes.Compare(first.To16(), last.To16()) > 0 {
+		return ipRange{}, fmt.Errorf("invalid range %v, the first address is greater than the last", value)
+	}
+
+	return ipRange{first: first.To16(), last: last.To16()}, nil
+}
+
+func (r ipRange) contains(ip net.IP) bool {
+	ip = ip.To16()
+	return bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+
+	return next
+}
+
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+
+	return prev
+}
+
+// contains returns true if the address is part of the pool
+func (p *ipPool) contains(ip net.IP) bool {
+	for _, r := range p.ranges {
+		if r.contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows returns true if a ConfigMap of the namespace can use the pool
+func (p *ipPool) allows(namespace string) bool {
+	return len(p.Namespaces) == 0 || contains(p.Namespaces, namespace)
+}
+
+// allocate returns the first address of the pool not used
+func (p *ipPool) allocate(used map[string]bool) (string, bool) {
+	for _, r := range p.ranges {
+		for ip := r.first; bytes.Compare(ip, r.last) <= 0; ip = nextIP(ip) {
+			if !used[ip.String()] {
+				return ip.String(), true
+			}
+
+			if bytes.Equal(ip, r.last) {
+				break
+			}
+		}
+	}
+
+	return "", false
+}
+
+// parseIPPools returns the pools contained in a ConfigMap
+func parseIPPools(cfgMap *apiv1.ConfigMap) (map[string]*ipPool, error) {
+	pools := map[string]*ipPool{}
+
+	names := []string{}
+	for name := range cfgMap.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		pool := &ipPool{}
+		err := yaml.UnmarshalStrict([]byte(cfgMap.Data[name]), pool)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool %v: %v", name, err)
+		}
+
+		if len(pool.Addresses) == 0 {
+			return nil, fmt.Errorf("invalid pool %v: addresses is required", name)
+		}
+
+		for _, value := range pool.Addresses {
+			r, err := parseIPRange(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pool %v: %v", name, err)
+			}
+			pool.ranges = append(pool.ranges, r)
+		}
+
+		pools[name] = pool
+	}
+
+	return pools, nil
+}
+
+// checkPools returns an error if the address of a ConfigMap in a namespace
+// is not part of a pool allowed in the namespace
+func checkPools(pools map[string]*ipPool, ip net.IP, namespace string) error {
+	names := []string{}
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	found := ""
+	for _, name := range names {
+		if !pools[name].contains(ip) {
+			continue
+		}
+
+		if pools[name].allows(namespace) {
+			return nil
+		}
+		found = name
+	}
+
+	if found != "" {
+		return fmt.Errorf("pool %v cannot be used in namespace %v", found, namespace)
+	}
+
+	return fmt.Errorf("address %v is not part of any pool", ip)
+}
+
+// getIPPools returns the pools of VIPs. In case of errors the current pools
+// are used.
+func (ipvsc *ipvsControllerController) getIPPools() map[string]*ipPool {
+	obj, exists, err := ipvsc.poolsMapLister.Store.GetByKey(ipvsc.poolsConfigMapName)
+	if err != nil || !exists {
+		glog.Warningf("pools configmap %v not found: %v", ipvsc.poolsConfigMapName, err)
+		return ipvsc.ipPools
+	}
+
+	pools, err := parseIPPools(obj.(*apiv1.ConfigMap))
+	if err != nil {
+		glog.Warningf("%v", err)
+		return ipvsc.ipPools
+	}
+
+	ipvsc.ipPools = pools
+	return pools
+}
+
+// allocationOwner returns the name used to record the VIP of an entry
+func allocationOwner(cfgMap *apiv1.ConfigMap, key string) string {
+	return fmt.Sprintf("%v/%v", configMapKey(cfgMap), key)
+}
+
+// resolveAddresses returns a copy of the services ConfigMaps where the keys
+// are the VIPs. Entries with a name instead of an address get a VIP from the
+// pool of the entry, recorded in the allocations ConfigMap. When pools are
+// configured the addresses outside the pools are ignored.
+func (ipvsc *ipvsControllerController) resolveAddresses(cfgMaps []*apiv1.ConfigMap) ([]*apiv1.ConfigMap, error) {
+	if ipvsc.poolsConfigMapName == "" {
+		resolved := []*apiv1.ConfigMap{}
+		for _, cfgMap := range cfgMaps {
+			out := cfgMap.DeepCopy()
+			for key := range out.Data {
+				if net.ParseIP(key) == nil {
+					glog.Warningf("configmap %v: %v is not a valid IP address, using a pool requires --ip-pools-configmap", configMapKey(cfgMap), key)
+					delete(out.Data, key)
+				}
+			}
+			resolved = append(resolved, out)
+		}
+
+		return resolved, nil
+	}
+
+	pools := ipvsc.getIPPools()
+
+	allocCfgMap, exists, err := ipvsc.getAllocations()
+	if err != nil {
+		return nil, fmt.Errorf("error getting VIP allocations: %v", err)
+	}
+
+	allocations, err := parseAllocations(allocCfgMap)
+	if err != nil {
+		return nil, err
+	}
+
+	// addresses of the nodes, used by other entries or allocated
+	used := map[string]bool{}
+	for _, node := range ipvsc.keepalived.nodes {
+		used[normalizeIP(node)] = true
+	}
+	for _, cfgMap := range cfgMaps {
+		for key := range cfgMap.Data {
+			if ip := net.ParseIP(key); ip != nil {
+				used[ip.String()] = true
+			}
+		}
+	}
+	allocated := map[string]string{}
+	for owner, ip := range allocations {
+		used[ip] = true
+		allocated[ip] = owner
+	}
+
+	changed := false
+	owners := map[string]bool{}
+	resolved := []*apiv1.ConfigMap{}
+	for _, cfgMap := range cfgMaps {
+		out := cfgMap.DeepCopy()
+		out.Data = map[string]string{}
+
+		keys := []string{}
+		for key := range cfgMap.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value := cfgMap.Data[key]
+			owner := allocationOwner(cfgMap, key)
+			// an invalid entry keeps its VIP until it is removed
+			owners[owner] = true
+
+			if ip := net.ParseIP(key); ip != nil {
+				if other, ok := allocated[ip.String()]; ok && other != owner {
+					glog.Warningf("configmap %v: VIP %v is allocated to %v", configMapKey(cfgMap), key, other)
+					continue
+				}
+
+				err := checkPools(pools, ip, cfgMap.Namespace)
+				if err != nil {
+					glog.Warningf("configmap %v: VIP %v: %v", configMapKey(cfgMap), key, err)
+					continue
+				}
+
+				if cfg, err := parseVIPConfig(value); value != "" && err == nil && cfg.Pool != "" {
+					if pool, ok := pools[cfg.Pool]; !ok || !pool.contains(ip) {
+						glog.Warningf("configmap %v: VIP %v is not part of pool %v", configMapKey(cfgMap), key, cfg.Pool)
+						continue
+					}
+				}
+
+				out.Data[key] = value
+				continue
+			}
+
+			cfg, err := parseVIPConfig(value)
+			if err != nil {
+				glog.Warningf("configmap %v: entry %v: %v", configMapKey(cfgMap), key, err)
+				continue
+			}
+
+			pool, ok := pools[cfg.Pool]
+			if !ok {
+				glog.Warningf("configmap %v: entry %v: pool %q not found", configMapKey(cfgMap), key, cfg.Pool)
+				continue
+			}
+
+			if !pool.allows(cfgMap.Namespace) {
+				glog.Warningf("configmap %v: entry %v: pool %v cannot be used in namespace %v", configMapKey(cfgMap), key, cfg.Pool, cfgMap.Namespace)
+				continue
+			}
+
+			ip, ok := allocations[owner]
+			if !ok || !pool.contains(net.ParseIP(ip)) {
+				ip, ok = pool.allocate(used)
+				if !ok {
+					glog.Warningf("configmap %v: entry %v: pool %v has no free addresses", configMapKey(cfgMap), key, cfg.Pool)
+					continue
+				}
+
+				glog.Infof("allocated VIP %v from pool %v to %v", ip, cfg.Pool, owner)
+				allocations[owner] = ip
+				used[ip] = true
+				changed = true
+			}
+
+			out.Data[ip] = value
+		}
+
+		resolved = append(resolved, out)
+	}
+
+	// release the VIPs of the entries removed from their ConfigMaps
+	for owner, ip := range allocations {
+		if !owners[owner] {
+			glog.Infof("releasing VIP %v allocated to %v", ip, owner)
+			delete(allocations, owner)
+			changed = true
+		}
+	}
+
+	if changed {
+		err = ipvsc.saveAllocations(allocCfgMap, exists, allocations)
+		if err != nil {
+			return nil, fmt.Errorf("error saving VIP allocations: %v", err)
+		}
+	}
+
+	return resolved, nil
+}
+
+// parseAllocations returns the VIPs recorded in the allocations ConfigMap
+// by owner
+func parseAllocations(cfgMap *apiv1.ConfigMap) (map[string]string, error) {
+	allocations := map[string]string{}
+	if value := cfgMap.Data[allocationsKey]; value != "" {
+		err := json.Unmarshal([]byte(value), &allocations)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VIP allocations in configmap %v: %v", configMapKey(cfgMap), err)
+		}
+	}
+
+	return allocations, nil
+}
+
+// allocationsName returns the namespace and name of the allocations ConfigMap
+func (ipvsc *ipvsControllerController) allocationsName() (string, string) {
+	ns, name, _ := parseNsName(ipvsc.poolsConfigMapName)
+	return ns, name + allocationsSuffix
+}
+
+// getAllocations returns the allocations ConfigMap and if it exists. If it
+// does not exist an empty ConfigMap is returned
+func (ipvsc *ipvsControllerController) getAllocations() (*apiv1.ConfigMap, bool, error) {
+	ns, name := ipvsc.allocationsName()
+	obj, exists, err := ipvsc.allocMapLister.Store.GetByKey(fmt.Sprintf("%v/%v", ns, name))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !exists {
+		return &apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: ns,
+				Name:      name,
+			},
+		}, false, nil
+	}
+
+	return obj.(*apiv1.ConfigMap), true, nil
+}
+
+// saveAllocations writes the allocations. The resource version of the
+// ConfigMap avoids overwriting the allocations done by other nodes.
+func (ipvsc *ipvsControllerController) saveAllocations(cfgMap *apiv1.ConfigMap, exists bool, allocations map[string]string) error {
+	b, err := json.Marshal(allocations)
+	if err != nil {
+		return err
+	}
+
+	cfgMap = cfgMap.DeepCopy()
+	if cfgMap.Data == nil {
+		cfgMap.Data = map[string]string{}
+	}
+	cfgMap.Data[allocationsKey] = string(b)
+
+	configMaps := ipvsc.client.CoreV1().ConfigMaps(cfgMap.Namespace)
+	if !exists {
+		_, err = configMaps.Create(cfgMap)
+	} else {
+		_, err = configMaps.Update(cfgMap)
+	}
+
+	return err
+}
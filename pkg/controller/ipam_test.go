@@ -0,0 +1,170 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseIPRange(t *testing.T) {
+	testcases := map[string]struct {
+		Value         string
+		First         string
+		Last          string
+		ErrorExpected bool
+	}{
+		"cidr":           {"10.0.0.0/29", "10.0.0.1", "10.0.0.6", false},
+		"cidr /31":       {"10.0.0.0/31", "10.0.0.0", "10.0.0.1", false},
+		"cidr /32":       {"10.0.0.5/32", "10.0.0.5", "10.0.0.5", false},
+		"ipv6 cidr":      {"fd00::/126", "fd00::1", "fd00::3", false},
+		"range":          {"10.0.0.10-10.0.0.20", "10.0.0.10", "10.0.0.20", false},
+		"single":         {"10.0.0.10", "10.0.0.10", "10.0.0.10", false},
+		"invalid cidr":   {"10.0.0.0/33", "", "", true},
+		"reversed range": {"10.0.0.20-10.0.0.10", "", "", true},
+		"mixed families": {"10.0.0.1-fd00::1", "", "", true},
+		"invalid":        {"10.0.0.1-10.0.0.2-10.0.0.3", "", "", true},
+	}
+
+	for k, tc := range testcases {
+		r, err := parseIPRange(tc.Value)
+		if tc.ErrorExpected {
+			if err == nil {
+				t.Errorf("%s: expected an error but returned %v-%v", k, r.first, r.last)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", k, err)
+			continue
+		}
+
+		if r.first.String() != tc.First || r.last.String() != tc.Last {
+			t.Errorf("%s: expected %v-%v but returned %v-%v", k, tc.First, tc.Last, r.first, r.last)
+		}
+	}
+}
+
+func TestPoolAllocate(t *testing.T) {
+	pools, err := parseIPPools(&apiv1.ConfigMap{Data: map[string]string{
+		"public": "addresses: [10.0.0.0/30, 10.0.1.10-10.0.1.11]\nnamespaces: [team-a]",
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pool := pools["public"]
+	if !pool.allows("team-a") || pool.allows("team-b") {
+		t.Errorf("unexpected namespaces of the pool: %v", pool.Namespaces)
+	}
+
+	used := map[string]bool{}
+	allocated := []string{}
+	for {
+		ip, ok := pool.allocate(used)
+		if !ok {
+			break
+		}
+		used[ip] = true
+		allocated = append(allocated, ip)
+	}
+
+	expected := []string{"10.0.0.1", "10.0.0.2", "10.0.1.10", "10.0.1.11"}
+	if !reflect.DeepEqual(allocated, expected) {
+		t.Errorf("expected %v but returned %v", expected, allocated)
+	}
+
+	if err := checkPools(pools, net.ParseIP("10.0.0.2"), "team-b"); err == nil {
+		t.Errorf("expected an error using the pool in other namespace")
+	}
+	if err := checkPools(pools, net.ParseIP("10.0.2.1"), "team-a"); err == nil {
+		t.Errorf("expected an error using an address outside the pools")
+	}
+}
+
+func TestResolveAddresses(t *testing.T) {
+	allocCfgMap := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "pools-allocations"},
+		Data: map[string]string{
+			allocationsKey: `{"team-a/vips/web":"10.0.0.1","team-a/vips/removed":"10.0.0.3","team-a/vips/broken":"10.0.0.6"}`,
+		},
+	}
+	client := fake.NewSimpleClientset(allocCfgMap)
+
+	ipvsc := &ipvsControllerController{
+		client:             client,
+		keepalived:         &keepalived{nodes: []string{"10.0.0.2"}},
+		poolsConfigMapName: "kube-system/pools",
+	}
+	ipvsc.allocMapLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	ipvsc.allocMapLister.Store.Add(allocCfgMap)
+	ipvsc.poolsMapLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	ipvsc.poolsMapLister.Store.Add(&apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "pools"},
+		Data: map[string]string{
+			"public":  "addresses: [10.0.0.1-10.0.0.10]",
+			"private": "addresses: [10.1.0.1-10.1.0.10]\nnamespaces: [team-b]",
+		},
+	})
+
+	cfgMaps := []*apiv1.ConfigMap{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "vips"},
+		Data: map[string]string{
+			"web":      "service: team-a/web\npool: public",
+			"api":      "service: team-a/api\npool: public",
+			"db":       "service: team-a/db\npool: private",
+			"broken":   "service: team-a/broken\npool: missing",
+			"10.0.0.5": "team-a/explicit",
+			"10.2.0.1": "team-a/outside",
+		},
+	}}
+
+	resolved, err := ipvsc.resolveAddresses(cfgMaps)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"10.0.0.1": "service: team-a/web\npool: public",
+		"10.0.0.4": "service: team-a/api\npool: public",
+		"10.0.0.5": "team-a/explicit",
+	}
+	if !reflect.DeepEqual(resolved[0].Data, expected) {
+		t.Errorf("expected %v but returned %v", expected, resolved[0].Data)
+	}
+
+	cfgMap, err := client.CoreV1().ConfigMaps("kube-system").Get("pools-allocations", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	allocations := map[string]string{}
+	json.Unmarshal([]byte(cfgMap.Data[allocationsKey]), &allocations)
+	// the entry with an invalid pool keeps its VIP until it is removed
+	expected = map[string]string{"team-a/vips/web": "10.0.0.1", "team-a/vips/api": "10.0.0.4", "team-a/vips/broken": "10.0.0.6"}
+	if !reflect.DeepEqual(allocations, expected) {
+		t.Errorf("expected allocations %v but returned %v", expected, allocations)
+	}
+}
@@ -23,7 +23,10 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"text/template"
 	"time"
@@ -35,12 +38,16 @@ import (
 )
 
 const (
-	iptablesChain   = "KUBE-KEEPALIVED-VIP"
-	keepalivedCfg   = "/etc/keepalived/keepalived.conf"
-	haproxyCfg      = "/etc/haproxy/haproxy.cfg"
-	keepalivedPid   = "/var/run/keepalived.pid"
-	keepalivedState = "/var/run/keepalived.state"
-	vrrpPid         = "/var/run/vrrp.pid"
+	iptablesChain = "KUBE-KEEPALIVED-VIP"
+	// vrrpChain drops the VRRP adverts sent by hosts that are not part of the cluster
+	vrrpChain     = "KUBE-KEEPALIVED-VRRP"
+	keepalivedCfg = "/etc/keepalived/keepalived.conf"
+	haproxyCfg    = "/etc/haproxy/haproxy.cfg"
+	keepalivedPid = "/var/run/keepalived.pid"
+	vrrpPid       = "/var/run/vrrp.pid"
+	// faultFile is tracked by the VRRP instance. A value different than
+	// zero puts the instance in FAULT state, releasing the VIPs
+	faultFile = "/var/run/keepalived.fault"
 )
 
 var (
@@ -53,19 +60,71 @@ type keepalived struct {
 	ip             string
 	netmask        int
 	priority       int
+	nodeName       string
 	nodes          []string
 	neighbors      []string
 	useUnicast     bool
 	started        bool
 	vips           []string
 	keepalivedTmpl *template.Template
-	haproxyTmpl    *template.Template
+	haproxy        *haproxy
 	cmd            *exec.Cmd
 	ipt            iptables.Interface
 	vrid           int
 	proxyMode      bool
 	notify         string
 	releaseVips    bool
+	// vrrp is false when the VIPs are announced using BGP. In that case
+	// keepalived only configures the LVS virtual servers
+	vrrp bool
+	// vrrpAuth contains the VRRP password of each instance
+	vrrpAuth map[string]string
+	// ipIface is the interface with the node address, used as source of
+	// the unicast adverts
+	ipIface string
+	// vrrpInstances contains the settings of each VRRP instance
+	vrrpInstances map[string]*vrrpInstanceConfig
+	// groupIfaces contains the interface of the VRRP instances with an
+	// interface different than iface
+	groupIfaces map[string]string
+	// vrrpFilter drops the VRRP adverts received in iface from addresses
+	// that are not nodes of the cluster. filterSources contains the allowed
+	// addresses and appliedSources the addresses of the iptables chain
+	vrrpFilter     bool
+	filterLock     sync.Mutex
+	filterSources  []string
+	appliedSources []string
+	// vlanLinks contains the VLAN interfaces used by the VRRP instances and
+	// createdLinks the interfaces created by the controller
+	vlanLinks    map[string]vlanLink
+	createdLinks []string
+	// locality raises the priority by the number of local endpoints
+	locality      bool
+	localityBoost int
+
+	// maintenanceMode is fault or priority when the node maintenance is
+	// tracked, otherwise empty
+	maintenanceMode string
+
+	trackLock sync.Mutex
+	// tracks contains the VIPs that track the health of their backends
+	tracks []backendTrack
+	svcs   []vip
+	// groups contains the VRRP instances of the last configuration
+	groups []vrrpGroup
+	// trackDown contains the VIPs without healthy backends
+	trackDown map[string]bool
+
+	// processLock protects the keepalived process (cmd, started and
+	// exited) and stopping, true once Stop is called so the exit of the
+	// process is not an error. exited is closed when the process exits
+	processLock sync.Mutex
+	exited      chan struct{}
+	stopping    bool
+
+	faultLock sync.Mutex
+	// faults contains the reasons to keep the VRRP instance in FAULT state
+	faults map[string]bool
 }
 
 // WriteCfg creates a new keepalived configuration file.
@@ -87,13 +146,31 @@ func (k *keepalived) WriteCfg(svcs []vip) error {
 	conf["svcs"] = svcs
 	conf["vips"] = k.vips
 	conf["nodes"] = k.neighbors
-	conf["priority"] = k.priority
 	conf["useUnicast"] = k.useUnicast
 	conf["vrid"] = k.vrid
 	conf["iface"] = k.iface
 	conf["proxyMode"] = k.proxyMode
 	conf["vipIsEmpty"] = len(k.vips) == 0
 	conf["notify"] = k.notify
+	conf["vrrp"] = k.vrrp
+	conf["faultFile"] = faultFile
+	conf["locality"] = k.vrrp && k.locality
+	conf["localityFile"] = localityFile
+	conf["maintenance"] = k.maintenanceMode == trackPriority
+	conf["maintenanceFile"] = maintenanceFile
+	conf["maintenanceWeight"] = maintenanceWeight
+
+	k.trackLock.Lock()
+	k.svcs = svcs
+	k.groups = k.vrrpGroups(svcs, k.tracks)
+	conf["tracks"] = k.tracks
+	conf["groups"] = k.groups
+	k.trackLock.Unlock()
+	// authentication was removed in VRRP version 3
+	conf["vrrpVersion"] = 3
+	if len(k.vrrpAuth) > 0 {
+		conf["vrrpVersion"] = 2
+	}
 
 	if glog.V(2) {
 		b, _ := json.Marshal(conf)
@@ -105,18 +182,28 @@ func (k *keepalived) WriteCfg(svcs []vip) error {
 		return fmt.Errorf("unexpected error creating keepalived.cfg: %v", err)
 	}
 
-	if k.proxyMode {
-		w, err := os.Create(haproxyCfg)
+	if k.vrrp && k.locality {
+		err = k.writeLocalityFile(svcs)
 		if err != nil {
-			return err
+			return fmt.Errorf("unexpected error writing %v: %v", localityFile, err)
 		}
-		defer w.Close()
-		err = k.haproxyTmpl.Execute(w, conf)
+	}
+
+	if k.vrrp {
+		k.updateBackendTracks()
+	}
+
+	if k.vrrp && k.isStarted() {
+		err = k.ensureVRRPFilter()
 		if err != nil {
-			return fmt.Errorf("unexpected error creating haproxy.cfg: %v", err)
+			glog.Warningf("unexpected error configuring VRRP filter: %v", err)
 		}
 	}
 
+	if k.proxyMode {
+		return k.haproxy.Update(conf, svcs)
+	}
+
 	return nil
 }
 
@@ -142,28 +229,73 @@ func (k *keepalived) Start() {
 		glog.V(2).Infof("chain %v already existed", iptablesChain)
 	}
 
+	if k.vrrp {
+		err = k.ensureVRRPFilter()
+		if err != nil {
+			glog.Fatalf("unexpected error configuring VRRP filter: %v", err)
+		}
+
+		err = k.writeFaultFile()
+		if err != nil {
+			glog.Fatalf("unexpected error writing %v: %v", faultFile, err)
+		}
+
+		if k.maintenanceMode == trackPriority {
+			err = k.writeMaintenanceFile(false)
+			if err != nil {
+				glog.Fatalf("unexpected error writing %v: %v", maintenanceFile, err)
+			}
+		}
+	}
+
 	args := []string{"--dont-fork", "--log-console", "--log-detail"}
 	if k.releaseVips {
 		args = append(args, "--release-vips")
 	}
 
-	k.cmd = exec.Command("keepalived", args...)
+	cmd := exec.Command("keepalived", args...)
 
-	k.cmd.Stdout = os.Stdout
-	k.cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
 
-	k.cmd.SysProcAttr = &syscall.SysProcAttr{
+	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 		Pgid:    0,
 	}
 
-	k.started = true
+	exited := make(chan struct{})
+
+	k.processLock.Lock()
+	k.cmd = cmd
+	k.exited = exited
+	err = cmd.Start()
+	k.started = err == nil
+	k.processLock.Unlock()
+
+	if err == nil {
+		err = cmd.Wait()
+	}
+	close(exited)
 
-	if err := k.cmd.Run(); err != nil {
+	if err != nil && !k.isStopping() {
 		glog.Fatalf("Error starting keepalived: %v", err)
 	}
 }
 
+func (k *keepalived) isStopping() bool {
+	k.processLock.Lock()
+	defer k.processLock.Unlock()
+
+	return k.stopping
+}
+
+func (k *keepalived) isStarted() bool {
+	k.processLock.Lock()
+	defer k.processLock.Unlock()
+
+	return k.started
+}
+
 // Reload sends SIGHUP to keepalived to reload the configuration.
 func (k *keepalived) Reload() error {
 	glog.Info("Waiting for keepalived to start")
@@ -172,7 +304,11 @@ func (k *keepalived) Reload() error {
 	}
 
 	glog.Info("reloading keepalived")
-	err := syscall.Kill(k.cmd.Process.Pid, syscall.SIGHUP)
+	k.processLock.Lock()
+	pid := k.cmd.Process.Pid
+	k.processLock.Unlock()
+
+	err := syscall.Kill(pid, syscall.SIGHUP)
 	if err != nil {
 		return fmt.Errorf("error reloading keepalived: %v", err)
 	}
@@ -182,7 +318,7 @@ func (k *keepalived) Reload() error {
 
 // Whether keepalived process is currently running
 func (k *keepalived) IsRunning() bool {
-	if !k.started {
+	if !k.isStarted() {
 		glog.Error("keepalived not started")
 		return false
 	}
@@ -201,23 +337,48 @@ func (k *keepalived) Healthy() error {
 		return fmt.Errorf("keepalived is not running")
 	}
 
+	if !k.vrrp {
+		return nil
+	}
+
 	if _, err := os.Stat(vrrpPid); os.IsNotExist(err) {
 		return fmt.Errorf("VRRP child process not running")
 	}
 
-	b, err := ioutil.ReadFile(keepalivedState)
-	if err != nil {
-		return err
+	// addresses of each interface
+	ips := map[string]string{}
+	states := readVRRPStates()
+	for _, group := range k.getGroups() {
+		state := states[group.Name]
+		master := state == stateMaster
+
+		for _, addr := range group.Addresses {
+			if _, ok := ips[addr.Interface]; !ok {
+				out, err := interfaceAddresses(addr.Interface)
+				if err != nil {
+					return err
+				}
+				ips[addr.Interface] = out
+			}
+
+			containsVip := strings.Contains(ips[addr.Interface], fmt.Sprintf(" %s ", addr.CIDR()))
+
+			if master && !containsVip {
+				return fmt.Errorf("Missing VIP %s on %s", addr.IP, state)
+			} else if !master && containsVip {
+				return fmt.Errorf("%s should not contain VIP %s", state, addr.IP)
+			}
+		}
 	}
 
-	master := false
-	state := strings.TrimSpace(string(b))
-	if strings.Contains(state, "MASTER") {
-		master = true
-	}
+	// All checks successful
+	return nil
+}
 
+// interfaceAddresses returns the output of ip -brief address for an interface
+func interfaceAddresses(iface string) (string, error) {
 	var out bytes.Buffer
-	cmd := exec.Command("ip", "-brief", "address", "show", k.iface, "up")
+	cmd := exec.Command("ip", "-brief", "address", "show", iface, "up")
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = &out
 	cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -225,58 +386,168 @@ func (k *keepalived) Healthy() error {
 		Pgid:    0,
 	}
 
-	err = cmd.Run()
+	err := cmd.Run()
 	if err != nil {
-		return err
-	}
-
-	ips := out.String()
-	glog.V(3).Infof("Status of %s interface: %s", state, ips)
-
-	for _, vip := range k.vips {
-		containsVip := strings.Contains(ips, fmt.Sprintf(" %s/32 ", vip))
-
-		if master && !containsVip {
-			return fmt.Errorf("Missing VIP %s on %s", vip, state)
-		} else if !master && containsVip {
-			return fmt.Errorf("%s should not contain VIP %s", state, vip)
-		}
+		return "", err
 	}
 
-	// All checks successful
-	return nil
+	glog.V(3).Infof("Status of %s interface: %s", iface, out.String())
+	return out.String(), nil
 }
 
 func (k *keepalived) Cleanup() {
-	glog.Infof("Cleanup: %s", k.vips)
-	for _, vip := range k.vips {
-		k.removeVIP(vip)
+	if k.vrrp {
+		glog.Infof("Cleanup: %s", k.vips)
+		for _, group := range k.getGroups() {
+			for _, addr := range group.Addresses {
+				removeVIP(addr)
+			}
+		}
 	}
 
+	k.removeLinks()
+
 	err := k.ipt.FlushChain(iptables.TableFilter, iptables.Chain(iptablesChain))
 	if err != nil {
 		glog.V(2).Infof("unexpected error flushing iptables chain %v: %v", err, iptablesChain)
 	}
+
+	if k.vrrp && k.vrrpFilter {
+		err = k.ipt.DeleteRule(iptables.TableFilter, iptables.ChainInput, vrrpFilterRule(k.iface)...)
+		if err != nil {
+			glog.V(2).Infof("unexpected error removing VRRP filter of %v: %v", k.iface, err)
+		}
+
+		err = k.ipt.FlushChain(iptables.TableFilter, iptables.Chain(vrrpChain))
+		if err != nil {
+			glog.V(2).Infof("unexpected error flushing iptables chain %v: %v", err, vrrpChain)
+		}
+	}
 }
 
-// Stop stop keepalived process
+// Stop stops the keepalived process and removes the VIPs and iptables rules
+// after the process exits
 func (k *keepalived) Stop() {
+	k.processLock.Lock()
+	k.stopping = true
+	started, cmd, exited := k.started, k.cmd, k.exited
+	k.processLock.Unlock()
+
+	if started && cmd != nil && cmd.Process != nil {
+		err := syscall.Kill(cmd.Process.Pid, syscall.SIGTERM)
+		if err != nil {
+			glog.Errorf("error stopping keepalived: %v", err)
+		}
+
+		select {
+		case <-exited:
+		case <-time.After(keepalivedStopTimeout):
+			glog.Warningf("keepalived did not exit after %v", keepalivedStopTimeout)
+		}
+	}
+
 	k.Cleanup()
+}
 
-	err := syscall.Kill(k.cmd.Process.Pid, syscall.SIGTERM)
-	if err != nil {
-		glog.Errorf("error stopping keepalived: %v", err)
+// setVRRPFilterSources sets the addresses allowed to send VRRP adverts
+func (k *keepalived) setVRRPFilterSources(sources []string) {
+	k.filterLock.Lock()
+	defer k.filterLock.Unlock()
+
+	k.filterSources = append([]string{}, sources...)
+	sort.Strings(k.filterSources)
+}
+
+// ensureVRRPFilter configures iptables to drop the VRRP adverts received
+// in the interface of keepalived from addresses that are not nodes of the
+// cluster. The adverts of the VRRP instances using other interfaces are
+// not filtered, as the nodes can use other addresses in these networks.
+func (k *keepalived) ensureVRRPFilter() error {
+	if !k.vrrpFilter {
+		return nil
 	}
+
+	k.filterLock.Lock()
+	defer k.filterLock.Unlock()
+
+	if k.appliedSources == nil || !reflect.DeepEqual(k.filterSources, k.appliedSources) {
+		chain := iptables.Chain(vrrpChain)
+		_, err := k.ipt.EnsureChain(iptables.TableFilter, chain)
+		if err != nil {
+			return err
+		}
+
+		err = k.ipt.FlushChain(iptables.TableFilter, chain)
+		if err != nil {
+			return err
+		}
+
+		for _, source := range k.filterSources {
+			_, err = k.ipt.EnsureRule(iptables.Append, iptables.TableFilter, chain, "-s", source, "-j", "RETURN")
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = k.ipt.EnsureRule(iptables.Append, iptables.TableFilter, chain, "-j", "DROP")
+		if err != nil {
+			return err
+		}
+
+		glog.Infof("VRRP adverts allowed from %v", k.filterSources)
+		k.appliedSources = append([]string{}, k.filterSources...)
+	}
+
+	_, err := k.ipt.EnsureRule(iptables.Prepend, iptables.TableFilter, iptables.ChainInput, vrrpFilterRule(k.iface)...)
+	return err
+}
+
+func vrrpFilterRule(iface string) []string {
+	return []string{"-i", iface, "-p", "112", "-j", vrrpChain}
 }
 
-func (k *keepalived) removeVIP(vip string) {
-	glog.Infof("removing configured VIP %v", vip)
-	out, err := k8sexec.New().Command("ip", "addr", "del", vip+"/32", "dev", k.iface).CombinedOutput()
+// removeVIP removes a VIP from its interface
+func removeVIP(addr vipAddress) {
+	glog.Infof("removing VIP %v from %v", addr.IP, addr.Interface)
+	out, err := k8sexec.New().Command("ip", "addr", "del", addr.CIDR(), "dev", addr.Interface).CombinedOutput()
 	if err != nil {
-		glog.V(2).Infof("Error removing VIP %s: %v\n%s", vip, err, out)
+		glog.V(2).Infof("Error removing VIP %s: %v\n%s", addr.IP, err, out)
 	}
 }
 
+// SetFault puts the VRRP instance in FAULT state while at least one reason is active
+func (k *keepalived) SetFault(reason string, active bool) error {
+	k.faultLock.Lock()
+	defer k.faultLock.Unlock()
+
+	if k.faults == nil {
+		k.faults = map[string]bool{}
+	}
+
+	if k.faults[reason] == active {
+		return nil
+	}
+
+	if active {
+		glog.Infof("forcing VRRP FAULT state: %v", reason)
+		k.faults[reason] = true
+	} else {
+		glog.Infof("removing VRRP FAULT state: %v", reason)
+		delete(k.faults, reason)
+	}
+
+	return k.writeFaultFile()
+}
+
+func (k *keepalived) writeFaultFile() error {
+	value := "0"
+	if len(k.faults) > 0 {
+		value = "1"
+	}
+
+	return ioutil.WriteFile(faultFile, []byte(value), 0644)
+}
+
 func (k *keepalived) loadTemplates() error {
 	tmpl, err := template.ParseFiles(keepalivedTmpl)
 	if err != nil {
@@ -288,7 +559,10 @@ func (k *keepalived) loadTemplates() error {
 	if err != nil {
 		return err
 	}
-	k.haproxyTmpl = tmpl
+	k.haproxy = &haproxy{
+		tmpl:   tmpl,
+		socket: haproxySocket,
+	}
 
 	return nil
 }
@@ -0,0 +1,97 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/util/iptables"
+	iptablestest "k8s.io/kubernetes/pkg/util/iptables/testing"
+)
+
+// recordingIPTables records the rules of the chains
+type recordingIPTables struct {
+	*iptablestest.FakeIPTables
+	rules   map[iptables.Chain][]string
+	flushes int
+}
+
+func (r *recordingIPTables) FlushChain(table iptables.Table, chain iptables.Chain) error {
+	r.flushes++
+	delete(r.rules, chain)
+	return nil
+}
+
+func (r *recordingIPTables) EnsureRule(position iptables.RulePosition, table iptables.Table, chain iptables.Chain, args ...string) (bool, error) {
+	rule := strings.Join(args, " ")
+	for _, existing := range r.rules[chain] {
+		if existing == rule {
+			return true, nil
+		}
+	}
+	r.rules[chain] = append(r.rules[chain], rule)
+	return false, nil
+}
+
+func TestEnsureVRRPFilter(t *testing.T) {
+	ipt := &recordingIPTables{FakeIPTables: iptablestest.NewFake(), rules: map[iptables.Chain][]string{}}
+	k := &keepalived{iface: "eth0", ipt: ipt, vrrp: true}
+
+	k.setVRRPFilterSources([]string{"10.0.0.2"})
+	if err := k.ensureVRRPFilter(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ipt.rules) != 0 {
+		t.Fatalf("expected no rules when the filter is disabled but returned %v", ipt.rules)
+	}
+
+	k.vrrpFilter = true
+	if err := k.ensureVRRPFilter(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"-s 10.0.0.2 -j RETURN", "-j DROP"}
+	if rules := ipt.rules[vrrpChain]; !reflect.DeepEqual(rules, expected) {
+		t.Errorf("expected %v but returned %v", expected, rules)
+	}
+	if rules := ipt.rules[iptables.ChainInput]; !reflect.DeepEqual(rules, []string{"-i eth0 -p 112 -j " + vrrpChain}) {
+		t.Errorf("unexpected INPUT rules %v", rules)
+	}
+
+	// the chain is not rebuilt when the nodes do not change
+	flushes := ipt.flushes
+	k.setVRRPFilterSources([]string{"10.0.0.2"})
+	if err := k.ensureVRRPFilter(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ipt.flushes != flushes {
+		t.Errorf("expected no changes in the chain")
+	}
+
+	// a node joins the cluster
+	k.setVRRPFilterSources([]string{"10.0.0.3", "10.0.0.2"})
+	if err := k.ensureVRRPFilter(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected = []string{"-s 10.0.0.2 -j RETURN", "-s 10.0.0.3 -j RETURN", "-j DROP"}
+	if rules := ipt.rules[vrrpChain]; !reflect.DeepEqual(rules, expected) {
+		t.Errorf("expected %v but returned %v", expected, rules)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/golang/glog"
+	k8sexec "k8s.io/utils/exec"
+)
+
+// vlanLink is a VLAN interface used by a VRRP group
+type vlanLink struct {
+	Name   string
+	Parent string
+	ID     int
+}
+
+// vlanLinkName returns the name of the VLAN interface in the parent
+// interface. Names are limited to 15 characters, so long parent names are
+// truncated and followed by a hash of the full name to keep them unique.
+func vlanLinkName(parent string, id int) string {
+	name := fmt.Sprintf("%v.%v", parent, id)
+	if len(name) <= 15 {
+		return name
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(parent))
+	hash := fmt.Sprintf("%08x", h.Sum32())[:4]
+
+	suffix := fmt.Sprintf("%v.%v", hash, id)
+	return parent[:15-len(suffix)] + suffix
+}
+
+// vmacLinkName returns the name of the VMAC interface of a VRID created by
+// keepalived (use_vmac)
+func vmacLinkName(vrid int) string {
+	return fmt.Sprintf("vrrp.%v", vrid)
+}
+
+// ensureLinks creates the VLAN interfaces of the VRRP groups
+func (k *keepalived) ensureLinks() {
+	for _, link := range k.vlanLinks {
+		if _, err := net.InterfaceByName(link.Name); err == nil {
+			continue
+		}
+
+		glog.Infof("creating VLAN interface %v (VLAN %v in %v)", link.Name, link.ID, link.Parent)
+		err := ipLink("add", "link", link.Parent, "name", link.Name, "type", "vlan", "id", fmt.Sprintf("%v", link.ID))
+		if err == nil {
+			err = ipLink("set", link.Name, "up")
+		}
+		if err != nil {
+			glog.Errorf("error creating VLAN interface %v: %v", link.Name, err)
+			continue
+		}
+
+		k.createdLinks = appendIfMissing(k.createdLinks, link.Name)
+	}
+}
+
+// removeUnusedLinks removes the VLAN interfaces created by the controller
+// that are not used anymore. It must be called after keepalived reloads the
+// configuration without the interfaces.
+func (k *keepalived) removeUnusedLinks() {
+	created := []string{}
+	for _, name := range k.createdLinks {
+		if _, ok := k.vlanLinks[name]; ok {
+			created = append(created, name)
+			continue
+		}
+
+		glog.Infof("removing VLAN interface %v", name)
+		err := ipLink("del", name)
+		if err != nil {
+			glog.Warningf("error removing VLAN interface %v: %v", name, err)
+		}
+	}
+	k.createdLinks = created
+}
+
+// removeLinks removes the VLAN interfaces created by the controller and the
+// VMAC interfaces of the VRRP groups left by keepalived
+func (k *keepalived) removeLinks() {
+	links := append([]string{}, k.createdLinks...)
+	for _, group := range k.getGroups() {
+		if group.VMAC != "" {
+			links = append(links, group.VMAC)
+		}
+	}
+
+	for _, name := range links {
+		if _, err := net.InterfaceByName(name); err != nil {
+			continue
+		}
+
+		glog.Infof("removing interface %v", name)
+		err := ipLink("del", name)
+		if err != nil {
+			glog.V(2).Infof("error removing interface %v: %v", name, err)
+		}
+	}
+
+	k.createdLinks = []string{}
+}
+
+func ipLink(args ...string) error {
+	out, err := k8sexec.New().Command("ip", append([]string{"link"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v\n%s", err, out)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"io/ioutil"
+	"strconv"
+)
+
+const (
+	// localityFile contains the number of endpoints running in the node.
+	// keepalived adds the value to the priority of the VRRP instance
+	localityFile = "/var/run/keepalived.locality"
+
+	// maxLocalityBoost limits the priority added by the local endpoints
+	maxLocalityBoost = 50
+)
+
+// countLocalEndpoints returns the number of ready endpoints of the VIPs
+// running in the node
+func countLocalEndpoints(svcs []vip, node string) int {
+	endpoints := map[string]bool{}
+	add := func(backends []service) {
+		for _, backend := range backends {
+			if backend.NodeName != "" && backend.NodeName == node {
+				endpoints[backend.IP] = true
+			}
+		}
+	}
+
+	for _, svc := range svcs {
+		add(svc.Backends)
+		for _, r := range svc.Routes {
+			add(r.Backends)
+		}
+	}
+
+	return len(endpoints)
+}
+
+// writeLocalityFile updates the priority added by the endpoints running in
+// the node. keepalived reads the file without a reload.
+func (k *keepalived) writeLocalityFile(svcs []vip) error {
+	boost := countLocalEndpoints(svcs, k.nodeName)
+	if boost > maxLocalityBoost {
+		boost = maxLocalityBoost
+	}
+
+	err := ioutil.WriteFile(localityFile, []byte(strconv.Itoa(boost)), 0644)
+	if err != nil {
+		return err
+	}
+
+	k.localityBoost = boost
+	return nil
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import "testing"
+
+func TestCountLocalEndpoints(t *testing.T) {
+	svcs := []vip{
+		{IP: "10.0.0.10", Port: 80, Backends: []service{
+			{IP: "172.16.0.1", Port: 8080, NodeName: "node-a"},
+			{IP: "172.16.0.2", Port: 8080, NodeName: "node-b"},
+		}},
+		{IP: "10.0.0.10", Port: 443, Backends: []service{
+			{IP: "172.16.0.1", Port: 8443, NodeName: "node-a"},
+		}},
+		{IP: "10.0.0.11", Port: 80, Routes: []route{
+			{Host: "foo.bar", Backends: []service{
+				{IP: "172.16.0.3", Port: 8080, NodeName: "node-a"},
+			}},
+		}},
+		{IP: "10.0.0.12", LVSMethod: "VIP"},
+	}
+
+	testcases := map[string]struct {
+		Node     string
+		Expected int
+	}{
+		"endpoints in the node": {"node-a", 2},
+		"one endpoint":          {"node-b", 1},
+		"no endpoints":          {"node-c", 0},
+		"unknown node":          {"", 0},
+	}
+
+	for k, tc := range testcases {
+		count := countLocalEndpoints(svcs, tc.Node)
+		if count != tc.Expected {
+			t.Errorf("%s: expected %v local endpoints but returned %v", k, tc.Expected, count)
+		}
+	}
+}
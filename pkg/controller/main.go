@@ -21,6 +21,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -35,8 +36,10 @@ import (
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/flowcontrol"
@@ -46,6 +49,7 @@ import (
 	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
 	utilexec "k8s.io/utils/exec"
 
+	"github.com/aledbf/kube-keepalived-vip/pkg/bgp"
 	"github.com/aledbf/kube-keepalived-vip/pkg/k8s"
 	"github.com/aledbf/kube-keepalived-vip/pkg/store"
 	"github.com/aledbf/kube-keepalived-vip/pkg/task"
@@ -58,6 +62,8 @@ const (
 type service struct {
 	IP   string
 	Port int
+	// NodeName is the node running the endpoint
+	NodeName string
 }
 
 type serviceByIPPort []service
@@ -83,6 +89,78 @@ type vip struct {
 	Protocol  string
 	LVSMethod string
 	Backends  []service
+	// Mode is the HAProxy mode (tcp, http or sni) used in proxy mode
+	Mode string
+	// Routes contains the HTTP routes of the VIP in http mode or the
+	// server names in sni mode
+	Routes []route
+	// Certificates used to terminate TLS in http mode
+	Certificates []certificate
+	// Scheduler, Persistence and HealthCheck configure the LVS virtual server
+	Scheduler   string
+	Persistence int
+	HealthCheck healthCheck
+	// Group is the VRRP instance announcing the VIP
+	Group string
+	// Interface is the network interface of the VIP. Empty uses the
+	// interface of the VRRP instance
+	Interface string
+	// Prefix, Label and Scope configure the address of the VIP
+	Prefix int
+	Label  string
+	Scope  string
+}
+
+// bindPorts returns the ports used by the VIP. The VIPs in http mode also
+// use the HTTPS port when TLS is terminated.
+func (v vip) bindPorts() []int {
+	if v.Mode == modeHTTP && len(v.Certificates) > 0 {
+		return []int{v.Port, httpsPort}
+	}
+	return []int{v.Port}
+}
+
+// route is an HTTP route from a host and path (or a TLS server name) to the
+// endpoints of a service
+type route struct {
+	Host string
+	Path string
+	// Backend is the name of the HAProxy backend
+	Backend  string
+	Backends []service
+}
+
+type routeByHostPath []route
+
+func (c routeByHostPath) Len() int      { return len(c) }
+func (c routeByHostPath) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c routeByHostPath) Less(i, j int) bool {
+	// routes with a host and longer paths are more specific and must
+	// be evaluated first
+	iHost := c[i].Host
+	jHost := c[j].Host
+	if (iHost == "") != (jHost == "") {
+		return iHost != ""
+	}
+	if iHost != jHost {
+		return iHost < jHost
+	}
+
+	iPath := c[i].Path
+	jPath := c[j].Path
+	if len(iPath) != len(jPath) {
+		return len(iPath) > len(jPath)
+	}
+	return iPath < jPath
+}
+
+// certificate is a TLS certificate (and key) obtained from a secret
+type certificate struct {
+	// Name of the secret with the format namespace/name
+	Name string
+	// Path of the PEM file used by HAProxy
+	Path string
+	PEM  []byte `json:"-"`
 }
 
 type vipByNameIPPort []vip
@@ -107,26 +185,121 @@ func (c vipByNameIPPort) Less(i, j int) bool {
 	return iPort < jPort
 }
 
+// announcer configures and announces the VIPs in the nodes when VRRP is not used
+type announcer interface {
+	Start() error
+	// Update receives the services of the ConfigMap after each sync
+	Update(svcs []vip) error
+	Healthy() error
+	Stop()
+}
+
 // ipvsControllerController watches the kubernetes api and adds/removes
 // services from LVS throgh ipvsadmin.
 type ipvsControllerController struct {
-	client *kubernetes.Clientset
+	client kubernetes.Interface
 
 	epController  cache.Controller
 	mapController cache.Controller
 	svcController cache.Controller
-
-	svcLister store.ServiceLister
-	epLister  store.EndpointLister
-	mapLister store.ConfigMapLister
+	// allSvcController watches the services of all the namespaces to
+	// detect conflicts when the services are filtered
+	allSvcController cache.Controller
+
+	authSecretController cache.Controller
+	vrrpMapController    cache.Controller
+	poolsMapController   cache.Controller
+	allocMapController   cache.Controller
+	nodeController       cache.Controller
+
+	svcLister    store.ServiceLister
+	allSvcLister store.ServiceLister
+	epLister     store.EndpointLister
+	mapListers   []store.ConfigMapLister
+	// tlsSecrets watches the secrets used to terminate TLS in HAProxy
+	tlsSecrets *secretInformers
+
+	authSecretLister store.SecretLister
+	vrrpMapLister    store.ConfigMapLister
+	poolsMapLister   store.ConfigMapLister
+	allocMapLister   store.ConfigMapLister
+	nodeLister       store.NodeLister
 
 	reloadRateLimiter flowcontrol.RateLimiter
 
 	keepalived *keepalived
 
-	configMapName string
-
-	httpPort int
+	// announcer announces the VIPs when VRRP is not used
+	announcer announcer
+
+	// configMapNames contains the namespace/name of the ConfigMaps with
+	// VIPs and configMapSelector selects other ConfigMaps with VIPs
+	configMapNames    []string
+	configMapSelector labels.Selector
+	// configMapCrossNamespace allows the ConfigMaps selected by
+	// configMapSelector to reference services and secrets of other namespaces
+	configMapCrossNamespace bool
+	// vipConflicts contains the VIPs defined in more than one ConfigMap or
+	// used by other objects of the cluster
+	vipConflicts map[string]bool
+	// serviceSelector is the label selector of the services that can be
+	// exposed and watchNamespaces the namespaces of the services
+	serviceSelector string
+	watchNamespaces []string
+
+	// information about the pod running the controller
+	podName      string
+	podNamespace string
+	nodeName     string
+	// nodeAddressPolicy selects the address of the nodes used as VRRP peers
+	nodeAddressPolicy *k8s.NodeAddressPolicy
+
+	splitBrainDetection bool
+	splitBrainStepDown  bool
+	// steppedDown is true while the node is in FAULT state due to a split brain
+	steppedDown    bool
+	splitBrainLock sync.Mutex
+	splitBrain     splitBrain
+	// peerMasters contains the VIPs held by other nodes in the last check
+	peerMasters map[string]bool
+
+	// authSecretName is the namespace/name of the secret with the VRRP passwords
+	authSecretName string
+	rotationTimer  *time.Timer
+
+	// vrrpConfigMapName is the namespace/name of the ConfigMap with the
+	// settings of the VRRP instances
+	vrrpConfigMapName string
+	// poolsConfigMapName is the namespace/name of the ConfigMap with the
+	// pools of VIPs. Empty allows any address
+	poolsConfigMapName string
+	ipPools            map[string]*ipPool
+	// vrrpMasters contains the VRRP groups in MASTER state in the last check
+	vrrpMasters map[string]bool
+
+	// maintenanceReason is the reason to move the VIPs away from the node
+	maintenanceReason string
+
+	// duplicateAddressDetection probes the VIPs before announcing them
+	duplicateAddressDetection bool
+	addressProbe              addressProbe
+	// dadResults contains the result of the last probe of each VIP
+	dadResults map[string]*dadResult
+	dadLock    sync.Mutex
+	// dadTimer probes again the VIPs used by other hosts
+	dadTimer *time.Timer
+
+	httpPort   int
+	httpServer *http.Server
+
+	// handoffTimeout is the maximum time to wait for other node to become
+	// MASTER during the shutdown
+	handoffTimeout time.Duration
+
+	webhookPort     int
+	webhookCertFile string
+	webhookKeyFile  string
+	webhookServer   *http.Server
 
 	ruMD5 string
 
@@ -173,7 +346,11 @@ func (ipvsc *ipvsControllerController) getEndpoints(
 				continue
 			}
 			for _, epAddress := range ss.Addresses {
-				endpoints = append(endpoints, service{IP: epAddress.IP, Port: targetPort})
+				nodeName := ""
+				if epAddress.NodeName != nil {
+					nodeName = *epAddress.NodeName
+				}
+				endpoints = append(endpoints, service{IP: epAddress.IP, Port: targetPort, NodeName: nodeName})
 			}
 		}
 	}
@@ -186,9 +363,9 @@ func (ipvsc *ipvsControllerController) getServices(cfgMap *apiv1.ConfigMap) []vi
 	svcs := []vip{}
 
 	// k -> IP to use
-	// v -> <namespace>/<service name>:<lvs method>
-	for externalIP, nsSvcLvs := range cfgMap.Data {
-		if nsSvcLvs == "" {
+	// v -> <namespace>/<service name>:<lvs method> or a YAML document
+	for externalIP, value := range cfgMap.Data {
+		if value == "" {
 			// if target is empty string we will not forward to any service but
 			// instead just configure the IP on the machine and let it up to
 			// another Pod or daemon to bind to the IP address
@@ -199,31 +376,74 @@ func (ipvsc *ipvsControllerController) getServices(cfgMap *apiv1.ConfigMap) []vi
 				LVSMethod: "VIP",
 				Backends:  nil,
 				Protocol:  "TCP",
+				Group:     defaultGroup,
 			})
 			glog.V(2).Infof("Adding VIP only service: %v", externalIP)
 			continue
 		}
 
-		ns, svc, lvsm, err := parseNsSvcLVS(nsSvcLvs)
+		cfg, err := parseVIPConfig(value)
 		if err != nil {
-			glog.Warningf("%v", err)
+			glog.Warningf("VIP %v: %v", externalIP, err)
 			continue
 		}
 
-		nsSvc := fmt.Sprintf("%v/%v", ns, svc)
-		svcObj, svcExists, err := ipvsc.svcLister.Store.GetByKey(nsSvc)
-		if err != nil {
-			glog.Warningf("error getting service %v: %v", nsSvc, err)
+		if ip := net.ParseIP(externalIP); ip != nil {
+			if err := cfg.validateAddress(ip); err != nil {
+				glog.Warningf("VIP %v: %v", externalIP, err)
+				continue
+			}
+		}
+
+		if err := ipvsc.checkReferences(cfgMap, cfg); err != nil {
+			glog.Warningf("VIP %v: %v", externalIP, err)
 			continue
 		}
 
-		if !svcExists {
-			glog.Warningf("service %v not found", nsSvc)
+		if cfg.Mode == modeHTTP || len(cfg.SNI) > 0 {
+			if !ipvsc.keepalived.proxyMode {
+				glog.Warningf("VIP %v: http mode and sni require --proxy-protocol-mode", externalIP)
+				continue
+			}
+
+			if len(cfg.SNI) > 0 {
+				svcs = append(svcs, ipvsc.getSNIService(externalIP, cfg))
+			}
+
+			if cfg.Mode == modeHTTP {
+				svcs = append(svcs, ipvsc.getHTTPService(externalIP, cfg))
+			}
+
+			if cfg.Service == "" {
+				continue
+			}
+		}
+
+		s, err := ipvsc.getService(cfg.Service)
+		if err != nil {
+			glog.Warningf("%v", err)
 			continue
 		}
 
-		s := svcObj.(*apiv1.Service)
-		for _, servicePort := range s.Spec.Ports {
+		servicePorts := s.Spec.Ports
+		if len(cfg.Ports) > 0 {
+			servicePorts = []apiv1.ServicePort{}
+			for _, port := range cfg.Ports {
+				servicePort, err := findServicePort(s, port)
+				if err != nil {
+					glog.Warningf("VIP %v: %v", externalIP, err)
+					continue
+				}
+				servicePorts = append(servicePorts, *servicePort)
+			}
+		}
+
+		for _, servicePort := range servicePorts {
+			if len(cfg.SNI) > 0 && servicePort.Port == sniPort {
+				glog.Warningf("VIP %v: port %v of service %v is used by the sni rules", externalIP, sniPort, cfg.Service)
+				continue
+			}
+
 			ep := ipvsc.getEndpoints(s, &servicePort)
 			if len(ep) == 0 {
 				glog.Warningf("no endpoints found for service %v, port %+v", s.Name, servicePort)
@@ -233,12 +453,21 @@ func (ipvsc *ipvsControllerController) getServices(cfgMap *apiv1.ConfigMap) []vi
 			sort.Sort(serviceByIPPort(ep))
 
 			svcs = append(svcs, vip{
-				Name:      fmt.Sprintf("%v-%v", s.Namespace, s.Name),
-				IP:        externalIP,
-				Port:      int(servicePort.Port),
-				LVSMethod: lvsm,
-				Backends:  ep,
-				Protocol:  fmt.Sprintf("%v", servicePort.Protocol),
+				Name:        fmt.Sprintf("%v-%v", s.Namespace, s.Name),
+				IP:          externalIP,
+				Port:        int(servicePort.Port),
+				LVSMethod:   cfg.Method,
+				Backends:    ep,
+				Protocol:    fmt.Sprintf("%v", servicePort.Protocol),
+				Mode:        modeTCP,
+				Scheduler:   cfg.Scheduler,
+				Persistence: *cfg.Persistence,
+				HealthCheck: *cfg.HealthCheck,
+				Group:       cfg.Group,
+				Interface:   cfg.Interface,
+				Prefix:      cfg.Prefix,
+				Label:       cfg.Label,
+				Scope:       cfg.Scope,
 			})
 			glog.V(2).Infof("found service: %v:%v", s.Name, servicePort.Port)
 		}
@@ -249,32 +478,225 @@ func (ipvsc *ipvsControllerController) getServices(cfgMap *apiv1.ConfigMap) []vi
 	return svcs
 }
 
+// getService returns the service with the format namespace/name from the cache
+func (ipvsc *ipvsControllerController) getService(nsSvc string) (*apiv1.Service, error) {
+	svcObj, svcExists, err := ipvsc.svcLister.Store.GetByKey(nsSvc)
+	if err != nil {
+		return nil, fmt.Errorf("error getting service %v: %v", nsSvc, err)
+	}
+
+	if !svcExists {
+		if ipvsc.serviceSelector != "" {
+			return nil, fmt.Errorf("service %v not found in the watched namespaces or not matching the selector %v", nsSvc, ipvsc.serviceSelector)
+		}
+		return nil, fmt.Errorf("service %v not found", nsSvc)
+	}
+
+	return svcObj.(*apiv1.Service), nil
+}
+
+// getHTTPService returns the VIP of an entry in http mode, containing the
+// HTTP routes to the services and the certificates used to terminate TLS.
+func (ipvsc *ipvsControllerController) getHTTPService(externalIP string, cfg *vipConfig) vip {
+	routes := []route{}
+	for _, rule := range cfg.Rules {
+		s, err := ipvsc.getService(rule.Service)
+		if err != nil {
+			glog.Warningf("VIP %v: %v", externalIP, err)
+			continue
+		}
+
+		servicePort, err := findServicePort(s, rule.Port)
+		if err != nil {
+			glog.Warningf("VIP %v: %v", externalIP, err)
+			continue
+		}
+
+		ep := ipvsc.getEndpoints(s, servicePort)
+		sort.Sort(serviceByIPPort(ep))
+
+		routes = append(routes, route{
+			Host:     rule.Host,
+			Path:     rule.Path,
+			Backend:  fmt.Sprintf("http-%v-%v-%v", s.Namespace, s.Name, servicePort.Port),
+			Backends: ep,
+		})
+	}
+
+	sort.Sort(routeByHostPath(routes))
+
+	certs := []certificate{}
+	for _, secret := range cfg.TLS {
+		cert, err := ipvsc.getCertificate(secret)
+		if err != nil {
+			glog.Warningf("VIP %v: %v", externalIP, err)
+			continue
+		}
+
+		certs = append(certs, *cert)
+	}
+
+	return vip{
+		Name:         fmt.Sprintf("http-%v", externalIP),
+		IP:           externalIP,
+		Port:         httpPort,
+		LVSMethod:    cfg.Method,
+		Protocol:     "TCP",
+		Mode:         modeHTTP,
+		Routes:       routes,
+		Certificates: certs,
+		Group:        cfg.Group,
+		Interface:    cfg.Interface,
+		Prefix:       cfg.Prefix,
+		Label:        cfg.Label,
+		Scope:        cfg.Scope,
+	}
+}
+
+// getSNIService returns the VIP of an entry with SNI rules, routing the TLS
+// connections in the port 443 to the services using the server name.
+func (ipvsc *ipvsControllerController) getSNIService(externalIP string, cfg *vipConfig) vip {
+	routes := []route{}
+	for _, rule := range cfg.SNI {
+		s, err := ipvsc.getService(rule.Service)
+		if err != nil {
+			glog.Warningf("VIP %v: %v", externalIP, err)
+			continue
+		}
+
+		servicePort, err := findServicePort(s, rule.Port)
+		if err != nil {
+			glog.Warningf("VIP %v: %v", externalIP, err)
+			continue
+		}
+
+		ep := ipvsc.getEndpoints(s, servicePort)
+		sort.Sort(serviceByIPPort(ep))
+
+		routes = append(routes, route{
+			Host:     rule.Host,
+			Backend:  fmt.Sprintf("sni-%v-%v-%v", s.Namespace, s.Name, servicePort.Port),
+			Backends: ep,
+		})
+	}
+
+	sort.Sort(routeByHostPath(routes))
+
+	return vip{
+		Name:      fmt.Sprintf("sni-%v", externalIP),
+		IP:        externalIP,
+		Port:      sniPort,
+		LVSMethod: cfg.Method,
+		Protocol:  "TCP",
+		Mode:      modeSNI,
+		Routes:    routes,
+		Group:     cfg.Group,
+		Interface: cfg.Interface,
+		Prefix:    cfg.Prefix,
+		Label:     cfg.Label,
+		Scope:     cfg.Scope,
+	}
+}
+
+// getCertificate returns the certificate and key contained in a TLS secret
+func (ipvsc *ipvsControllerController) getCertificate(nsName string) (*certificate, error) {
+	secret, exists, err := ipvsc.tlsSecrets.get(nsName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting secret %v: %v", nsName, err)
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("secret %v not found", nsName)
+	}
+
+	if secret.Type != apiv1.SecretTypeTLS {
+		return nil, fmt.Errorf("secret %v is not of type %v", nsName, apiv1.SecretTypeTLS)
+	}
+
+	crt, okCrt := secret.Data[apiv1.TLSCertKey]
+	key, okKey := secret.Data[apiv1.TLSPrivateKeyKey]
+	if !okCrt || !okKey {
+		return nil, fmt.Errorf("secret %v does not contain %v and %v", nsName, apiv1.TLSCertKey, apiv1.TLSPrivateKeyKey)
+	}
+
+	pem := append([]byte{}, crt...)
+	if len(pem) > 0 && pem[len(pem)-1] != '\n' {
+		pem = append(pem, '\n')
+	}
+	pem = append(pem, key...)
+
+	return &certificate{
+		Name: nsName,
+		Path: fmt.Sprintf("%v/%v-%v.pem", haproxyCertsDir, secret.Namespace, secret.Name),
+		PEM:  pem,
+	}, nil
+}
+
 // sync all services with the
 func (ipvsc *ipvsControllerController) sync(key interface{}) error {
 	ipvsc.reloadRateLimiter.Accept()
 
-	ns, name, err := parseNsName(ipvsc.configMapName)
+	cfgMaps, err := ipvsc.getServicesConfigMaps()
 	if err != nil {
-		glog.Warningf("%v", err)
-		return err
+		return fmt.Errorf("unexpected error searching configmaps: %v", err)
 	}
 
-	cfgMap, err := ipvsc.getConfigMap(ns, name)
+	cfgMaps, err = ipvsc.resolveAddresses(cfgMaps)
 	if err != nil {
-		return fmt.Errorf("unexpected error searching configmap %v: %v", ipvsc.configMapName, err)
+		return err
+	}
+
+	sources := []configMapServices{}
+	for _, cfgMap := range cfgMaps {
+		sources = append(sources, configMapServices{
+			Key:    configMapKey(cfgMap),
+			VIPs:   ipvsc.getServices(cfgMap),
+			Tracks: getBackendTracks(cfgMap),
+		})
+	}
+
+	if ipvsc.tlsSecrets != nil {
+		ipvsc.tlsSecrets.prune()
+	}
+
+	sources, clusterConflicts := findClusterConflicts(sources, ipvsc.clusterAddresses())
+	svc, tracks, conflicts := mergeServices(sources)
+
+	reported := []configMapConflict{}
+	for _, conflict := range clusterConflicts {
+		reported = append(reported, conflict)
 	}
+	for _, conflict := range conflicts {
+		reported = append(reported, conflict)
+	}
+	ipvsc.reportConflicts(reported, cfgMaps)
+
+	ipvsc.keepalived.vrrpAuth = ipvsc.getVRRPAuth()
+	ipvsc.keepalived.setVRRPFilterSources(ipvsc.neighborAddresses())
+	ipvsc.keepalived.vrrpInstances = ipvsc.getVRRPInstances()
 
-	svc := ipvsc.getServices(cfgMap)
+	svc = ipvsc.keepalived.resolveInterfaces(svc)
+	ipvsc.keepalived.ensureLinks()
+	svc = ipvsc.checkDuplicateAddresses(svc)
+	ipvsc.keepalived.setBackendTracks(tracks)
 
 	err = ipvsc.keepalived.WriteCfg(svc)
 	if err != nil {
 		return err
 	}
 
+	if ipvsc.announcer != nil {
+		err = ipvsc.announcer.Update(svc)
+		if err != nil {
+			return err
+		}
+	}
+
 	glog.V(2).Infof("services: %v", svc)
 
 	md5, err := checksum(keepalivedCfg)
 	if err == nil && md5 == ipvsc.ruMD5 {
+		ipvsc.keepalived.removeUnusedLinks()
 		return nil
 	}
 
@@ -282,8 +704,11 @@ func (ipvsc *ipvsControllerController) sync(key interface{}) error {
 	err = ipvsc.keepalived.Reload()
 	if err != nil {
 		glog.Errorf("error reloading keepalived: %v", err)
+		return nil
 	}
 
+	// keepalived does not use the VLAN interfaces removed from the configuration
+	ipvsc.keepalived.removeUnusedLinks()
 	return nil
 }
 
@@ -297,23 +722,80 @@ func (ipvsc *ipvsControllerController) Start() {
 
 	go handleSigterm(ipvsc)
 
-	// Wait for all involved caches to be synced, before processing items from the queue is started
-	if !cache.WaitForCacheSync(ipvsc.stopCh,
+	cacheSyncs := []cache.InformerSynced{
 		ipvsc.epController.HasSynced,
 		ipvsc.svcController.HasSynced,
 		ipvsc.mapController.HasSynced,
-	) {
+	}
+
+	if ipvsc.allSvcController != nil {
+		go ipvsc.allSvcController.Run(ipvsc.stopCh)
+		cacheSyncs = append(cacheSyncs, ipvsc.allSvcController.HasSynced)
+	}
+
+	if ipvsc.authSecretController != nil {
+		go ipvsc.authSecretController.Run(ipvsc.stopCh)
+		cacheSyncs = append(cacheSyncs, ipvsc.authSecretController.HasSynced)
+	}
+
+	if ipvsc.vrrpMapController != nil {
+		go ipvsc.vrrpMapController.Run(ipvsc.stopCh)
+		cacheSyncs = append(cacheSyncs, ipvsc.vrrpMapController.HasSynced)
+	}
+
+	if ipvsc.poolsMapController != nil {
+		go ipvsc.poolsMapController.Run(ipvsc.stopCh)
+		go ipvsc.allocMapController.Run(ipvsc.stopCh)
+		cacheSyncs = append(cacheSyncs, ipvsc.poolsMapController.HasSynced, ipvsc.allocMapController.HasSynced)
+	}
+
+	if ipvsc.nodeController != nil {
+		go ipvsc.nodeController.Run(ipvsc.stopCh)
+		cacheSyncs = append(cacheSyncs, ipvsc.nodeController.HasSynced)
+	}
+
+	// Wait for all involved caches to be synced, before processing items from the queue is started
+	if !cache.WaitForCacheSync(ipvsc.stopCh, cacheSyncs...) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
 	}
 
 	go func() {
 		glog.Infof("Starting HTTP server on port %d", ipvsc.httpPort)
-		err := http.ListenAndServe(fmt.Sprintf(":%d", ipvsc.httpPort), nil)
-		if err != nil {
+		err := ipvsc.httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			glog.Error(err.Error())
 		}
 	}()
 
+	if ipvsc.webhookPort > 0 {
+		ipvsc.webhookServer = ipvsc.newWebhookServer()
+		go ipvsc.startWebhook()
+	}
+
+	if ipvsc.splitBrainDetection {
+		go wait.Until(ipvsc.checkSplitBrain, splitBrainInterval, ipvsc.stopCh)
+	}
+
+	if ipvsc.keepalived.vrrp {
+		go wait.Until(ipvsc.watchVRRPState, time.Second, ipvsc.stopCh)
+		go wait.Until(ipvsc.keepalived.updateBackendTracks, trackInterval, ipvsc.stopCh)
+	}
+
+	if ipvsc.keepalived.proxyMode {
+		go wait.Until(ipvsc.checkHAProxyReload, haproxyReloadInterval, ipvsc.stopCh)
+	}
+
+	if ipvsc.keepalived.maintenanceMode != "" {
+		go wait.Until(ipvsc.checkNodeMaintenance, maintenanceInterval, ipvsc.stopCh)
+	}
+
+	if ipvsc.announcer != nil {
+		err := ipvsc.announcer.Start()
+		if err != nil {
+			glog.Fatalf("unexpected error starting VIP announcer: %v", err)
+		}
+	}
+
 	glog.Info("starting keepalived to announce VIPs")
 	ipvsc.keepalived.Start()
 }
@@ -344,22 +826,130 @@ func (ipvsc *ipvsControllerController) Stop() error {
 		close(ipvsc.stopCh)
 		go ipvsc.syncQueue.Shutdown()
 
+		if ipvsc.announcer != nil {
+			ipvsc.announcer.Stop()
+		}
+
+		// other node must hold the VIPs before removing them
+		ipvsc.keepalived.Handoff(ipvsc.handoffTimeout)
 		ipvsc.keepalived.Stop()
 
+		if ipvsc.tlsSecrets != nil {
+			ipvsc.tlsSecrets.stop()
+		}
+
+		ipvsc.stopHTTPServers()
+
 		return nil
 	}
 
 	return fmt.Errorf("shutdown already in progress")
 }
 
+// Configuration contains the settings required to create the controller
+type Configuration struct {
+	// WatchNamespaces are the namespaces where services and endpoints are
+	// watched. Empty watches all the namespaces
+	WatchNamespaces []string
+	// ServiceSelector is a label selector of the services that can be exposed
+	ServiceSelector string
+	// ConfigMapNames contains the namespace/name of the ConfigMaps with the VIPs
+	ConfigMapNames []string
+	// ConfigMapSelector is a label selector of other ConfigMaps with VIPs
+	ConfigMapSelector string
+	// ConfigMapCrossNamespace allows the ConfigMaps selected by the label
+	// selector to reference services and secrets of other namespaces
+	ConfigMapCrossNamespace bool
+	UseUnicast              bool
+	VRID                    int
+	ProxyMode               bool
+	// Iface is the network interface used by keepalived. If empty the
+	// interface of the node IP address is used
+	Iface string
+	// ExcludeIfaces contains the patterns of the interfaces never used by
+	// the controller. Nil uses DefaultExcludedIfaces
+	ExcludeIfaces []string
+	// NodeAddressPolicy selects the address of the nodes used as VRRP peers.
+	// Nil prefers the ExternalIP over the InternalIP
+	NodeAddressPolicy *k8s.NodeAddressPolicy
+	HTTPPort          int
+	ReleaseVips       bool
+
+	// WebhookPort is the port used by the validating admission webhook.
+	// Zero disables the webhook
+	WebhookPort     int
+	WebhookCertFile string
+	WebhookKeyFile  string
+
+	// AnnounceMode is the protocol used to announce the VIPs (vrrp, bgp or lease)
+	AnnounceMode string
+	// BGP contains the settings of the BGP speaker. If RouterID or NextHop
+	// are empty the node IP address is used
+	BGP      bgp.Config
+	BGPPeers []bgp.Peer
+
+	// VRRPAuthSecret is the namespace/name of the secret with the VRRP
+	// passwords. The keys of the secret are the names of the VRRP instances
+	VRRPAuthSecret string
+	// VRRPSourceFilter drops the VRRP adverts received in the interface of
+	// keepalived from addresses that are not nodes of the cluster
+	VRRPSourceFilter bool
+	// VRRPConfigMap is the namespace/name of the ConfigMap with the settings
+	// of the VRRP instances. The keys are the names of the instances
+	VRRPConfigMap string
+	// IPPoolsConfigMap is the namespace/name of the ConfigMap with the pools
+	// of VIPs
+	IPPoolsConfigMap string
+
+	// SplitBrainDetection publishes the VRRP state of the node in a Lease
+	// to detect VIPs held by more than one node
+	SplitBrainDetection bool
+	// SplitBrainStepDown forces the FAULT state in the node with lower
+	// priority when a split brain is detected
+	SplitBrainStepDown bool
+
+	// LocalityPriority raises the VRRP priority of the node by the number
+	// of endpoints of the VIPs running in the node
+	LocalityPriority bool
+
+	// HandoffTimeout is the maximum time to wait during the shutdown for
+	// other node to become MASTER before removing the VIPs
+	HandoffTimeout time.Duration
+
+	// NodeMaintenance moves the VIPs away from the node when it is cordoned,
+	// not ready or annotated for maintenance, forcing the FAULT state (fault)
+	// or lowering the priority (priority). Empty disables it
+	NodeMaintenance string
+
+	// DuplicateAddressDetection probes the VIPs in the interface before
+	// announcing them and holds back the VIPs used by other hosts
+	DuplicateAddressDetection bool
+}
+
 // NewIPVSController creates a new controller from the given config.
-func NewIPVSController(kubeClient *kubernetes.Clientset, namespace string, useUnicast bool, configMapName string, vrid int, proxyMode bool, iface string, httpPort int, releaseVips bool) *ipvsControllerController {
+func NewIPVSController(kubeClient kubernetes.Interface, cfg *Configuration) *ipvsControllerController {
 	ipvsc := ipvsControllerController{
-		client:            kubeClient,
-		reloadRateLimiter: flowcontrol.NewTokenBucketRateLimiter(0.5, 1),
-		configMapName:     configMapName,
-		httpPort:          httpPort,
-		stopCh:            make(chan struct{}),
+		client:                  kubeClient,
+		reloadRateLimiter:       flowcontrol.NewTokenBucketRateLimiter(0.5, 1),
+		configMapNames:          cfg.ConfigMapNames,
+		configMapCrossNamespace: cfg.ConfigMapCrossNamespace,
+		authSecretName:          cfg.VRRPAuthSecret,
+		vrrpConfigMapName:       cfg.VRRPConfigMap,
+		poolsConfigMapName:      cfg.IPPoolsConfigMap,
+		splitBrainDetection:     cfg.SplitBrainDetection,
+		splitBrainStepDown:      cfg.SplitBrainDetection && cfg.SplitBrainStepDown,
+		serviceSelector:         cfg.ServiceSelector,
+		watchNamespaces:         cfg.WatchNamespaces,
+		nodeAddressPolicy:       cfg.NodeAddressPolicy,
+		httpPort:                cfg.HTTPPort,
+		httpServer:              &http.Server{Addr: fmt.Sprintf(":%d", cfg.HTTPPort)},
+		handoffTimeout:          cfg.HandoffTimeout,
+		addressProbe:            probeAddresses,
+		dadResults:              map[string]*dadResult{},
+		webhookPort:             cfg.WebhookPort,
+		webhookCertFile:         cfg.WebhookCertFile,
+		webhookKeyFile:          cfg.WebhookKeyFile,
+		stopCh:                  make(chan struct{}),
 	}
 
 	podInfo, err := k8s.GetPodDetails(kubeClient)
@@ -372,17 +962,55 @@ func NewIPVSController(kubeClient *kubernetes.Clientset, namespace string, useUn
 		glog.Fatalf("Error getting %v: %v", podInfo.Name, err)
 	}
 
+	ipvsc.podName = podInfo.Name
+	ipvsc.podNamespace = podInfo.Namespace
+	ipvsc.nodeName = pod.Spec.NodeName
+
 	selector := parseNodeSelector(pod.Spec.NodeSelector)
-	clusterNodes := getClusterNodesIP(kubeClient, selector)
+	clusterNodes := getClusterNodesIP(kubeClient, selector, cfg.NodeAddressPolicy)
+
+	nodeIP := podInfo.NodeIP
+	if cfg.NodeAddressPolicy != nil {
+		node, err := kubeClient.CoreV1().Nodes().Get(pod.Spec.NodeName, metav1.GetOptions{})
+		if err != nil {
+			glog.Fatalf("Error getting node %v: %v", pod.Spec.NodeName, err)
+		}
+
+		nodeIP = k8s.NodeAddress(node, cfg.NodeAddressPolicy)
+		if nodeIP == "" {
+			glog.Fatalf("Node %v has no address selected by the node address policy %v", pod.Spec.NodeName, cfg.NodeAddressPolicy)
+		}
+	}
+
+	if cfg.ExcludeIfaces != nil {
+		err = setExcludedInterfaces(cfg.ExcludeIfaces)
+		if err != nil {
+			glog.Fatalf("Error in the excluded interfaces: %v", err)
+		}
+	}
 
-	nodeInfo, err := getNetworkInfo(podInfo.NodeIP)
+	// the unicast adverts use the node address as source, so it must be
+	// an address of the node
+	nodeInfo, err := getNetworkInfo(nodeIP, cfg.NodeAddressPolicy != nil || cfg.UseUnicast)
 	if err != nil {
 		glog.Fatalf("Error getting local IP from nodes in the cluster: %v", err)
 	}
+
+	if cfg.Iface != "" && cfg.Iface != nodeInfo.iface {
+		if cfg.NodeAddressPolicy != nil {
+			glog.Fatalf("The address %v selected by the node address policy %v is in the interface %v, not in %v",
+				nodeInfo.ip, cfg.NodeAddressPolicy, nodeInfo.iface, cfg.Iface)
+		}
+		if cfg.UseUnicast {
+			glog.Fatalf("The node address %v used in the unicast VRRP adverts is in the interface %v, not in %v. Please use --node-address-policy",
+				nodeInfo.ip, nodeInfo.iface, cfg.Iface)
+		}
+	}
 	neighbors := getNodeNeighbors(nodeInfo, clusterNodes)
 
 	notify := os.Getenv("KEEPALIVED_NOTIFY")
 
+	iface := cfg.Iface
 	if iface == "" {
 		iface = nodeInfo.iface
 		glog.Info("No interface was provided, proceeding with the node's default: ", iface)
@@ -394,16 +1022,53 @@ func NewIPVSController(kubeClient *kubernetes.Clientset, namespace string, useUn
 	ipvsc.keepalived = &keepalived{
 		iface:       iface,
 		ip:          nodeInfo.ip,
+		ipIface:     nodeInfo.iface,
 		netmask:     nodeInfo.netmask,
 		nodes:       clusterNodes,
 		neighbors:   neighbors,
 		priority:    getNodePriority(nodeInfo.ip, clusterNodes),
-		useUnicast:  useUnicast,
+		nodeName:    pod.Spec.NodeName,
+		locality:    cfg.LocalityPriority,
+		useUnicast:  cfg.UseUnicast,
 		ipt:         iptInterface,
-		vrid:        vrid,
-		proxyMode:   proxyMode,
-		notify:     notify,
-		releaseVips: releaseVips,
+		vrid:        cfg.VRID,
+		proxyMode:   cfg.ProxyMode,
+		notify:      notify,
+		releaseVips: cfg.ReleaseVips,
+		vrrpFilter:  cfg.VRRPSourceFilter,
+		vrrp:        cfg.AnnounceMode != announceBGP && cfg.AnnounceMode != announceLease,
+	}
+
+	// the sources are updated with the nodes of the cluster in each sync
+	ipvsc.keepalived.setVRRPFilterSources(neighbors)
+
+	if cfg.AnnounceMode == announceBGP {
+		nodeIP := net.ParseIP(nodeInfo.ip)
+
+		bgpCfg := cfg.BGP
+		if bgpCfg.RouterID == nil {
+			bgpCfg.RouterID = nodeIP
+		}
+		if bgpCfg.RouterID.To4() == nil {
+			glog.Fatalf("The BGP router ID must be an IPv4 address. Please use --bgp-router-id")
+		}
+
+		if nodeIP.To4() == nil {
+			if bgpCfg.NextHopIPv6 == nil {
+				bgpCfg.NextHopIPv6 = nodeIP
+			}
+		} else if bgpCfg.NextHop == nil {
+			bgpCfg.NextHop = nodeIP
+		}
+
+		ipvsc.announcer = newBGPAnnouncer(bgpCfg, cfg.BGPPeers, iface)
+	}
+
+	// the VIPs are not added to the interface using BGP
+	ipvsc.duplicateAddressDetection = cfg.DuplicateAddressDetection && cfg.AnnounceMode != announceBGP
+
+	if cfg.AnnounceMode == announceLease {
+		ipvsc.announcer = newLeaseAnnouncer(kubeClient, podInfo.Namespace, pod.Spec.NodeName, iface, cfg.VRID)
 	}
 
 	ipvsc.syncQueue = task.NewTaskQueue(ipvsc.sync)
@@ -413,13 +1078,24 @@ func NewIPVSController(kubeClient *kubernetes.Clientset, namespace string, useUn
 		glog.Fatalf("Error loading templates: %v", err)
 	}
 
+	if cfg.ConfigMapSelector != "" {
+		ipvsc.configMapSelector, err = labels.Parse(cfg.ConfigMapSelector)
+		if err != nil {
+			glog.Fatalf("Error parsing configmap selector: %v", err)
+		}
+	}
+
 	mapEventHandler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ipvsc.syncQueue.Enqueue(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			ipvsc.syncQueue.Enqueue(obj)
+		},
 		UpdateFunc: func(old, cur interface{}) {
 			if !reflect.DeepEqual(old, cur) {
-				upCmap := cur.(*apiv1.ConfigMap)
-				mapKey := fmt.Sprintf("%s/%s", upCmap.Namespace, upCmap.Name)
 				// updates to configuration configmaps can trigger an update
-				if mapKey == ipvsc.configMapName {
+				if ipvsc.isServicesConfigMap(cur.(*apiv1.ConfigMap)) {
 					ipvsc.syncQueue.Enqueue(cur)
 				}
 			}
@@ -440,26 +1116,150 @@ func NewIPVSController(kubeClient *kubernetes.Clientset, namespace string, useUn
 		},
 	}
 
-	ipvsc.svcLister.Store, ipvsc.svcController = cache.NewInformer(
-		cache.NewListWatchFromClient(ipvsc.client.CoreV1().RESTClient(), "services", namespace, fields.Everything()),
-		&apiv1.Service{}, resyncPeriod, cache.ResourceEventHandlerFuncs{})
+	// the endpoints controller copies the labels of the services, so only
+	// changes of the addresses used by the services trigger a sync
+	ipvsc.svcLister.Store, ipvsc.svcController = newNamespacedInformer(ipvsc.client.CoreV1().RESTClient(),
+		"services", cfg.WatchNamespaces, cfg.ServiceSelector, &apiv1.Service{}, cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(old, cur interface{}) {
+				if serviceAddressesChanged(old.(*apiv1.Service), cur.(*apiv1.Service)) {
+					ipvsc.syncQueue.Enqueue(cur)
+				}
+			},
+		})
+
+	ipvsc.epLister.Store, ipvsc.epController = newNamespacedInformer(ipvsc.client.CoreV1().RESTClient(),
+		"endpoints", cfg.WatchNamespaces, cfg.ServiceSelector, &apiv1.Endpoints{}, eventHandlers)
+
+	// the addresses of the services outside the watched namespaces or not
+	// matching the selector are also checked to detect VIP conflicts
+	if len(cfg.WatchNamespaces) > 0 || cfg.ServiceSelector != "" {
+		ipvsc.allSvcLister.Store, ipvsc.allSvcController = cache.NewInformer(
+			cache.NewListWatchFromClient(ipvsc.client.CoreV1().RESTClient(), "services", apiv1.NamespaceAll, fields.Everything()),
+			&apiv1.Service{}, resyncPeriod, cache.ResourceEventHandlerFuncs{
+				AddFunc: func(obj interface{}) {
+					ipvsc.syncQueue.Enqueue(obj)
+				},
+				DeleteFunc: func(obj interface{}) {
+					ipvsc.syncQueue.Enqueue(obj)
+				},
+				UpdateFunc: func(old, cur interface{}) {
+					if serviceAddressesChanged(old.(*apiv1.Service), cur.(*apiv1.Service)) {
+						ipvsc.syncQueue.Enqueue(cur)
+					}
+				},
+			})
+	}
+
+	if cfg.ProxyMode {
+		// secrets are only used to terminate TLS in HAProxy and only the
+		// secrets referenced by the ConfigMaps are watched
+		ipvsc.tlsSecrets = newSecretInformers(ipvsc.client.CoreV1().RESTClient(), eventHandlers)
+	}
+
+	// one informer for each ConfigMap and other for the selector
+	mapControllers := multiController{}
+	for _, name := range ipvsc.configMapNames {
+		cmns, cmn, err := parseNsName(name)
+		if err != nil {
+			glog.Fatalf("Error parsing configmap name: %v", err)
+		}
 
-	ipvsc.epLister.Store, ipvsc.epController = cache.NewInformer(
-		cache.NewListWatchFromClient(ipvsc.client.CoreV1().RESTClient(), "endpoints", namespace, fields.Everything()),
-		&apiv1.Endpoints{}, resyncPeriod, eventHandlers)
+		lister := store.ConfigMapLister{}
+		var controller cache.Controller
+		lister.Store, controller = cache.NewInformer(
+			cache.NewListWatchFromClient(ipvsc.client.CoreV1().RESTClient(), "configmaps", cmns,
+				fields.OneTermEqualSelector(api.ObjectNameField, cmn)),
+			&apiv1.ConfigMap{}, resyncPeriod, mapEventHandler)
 
-	cmns, cmn, err := parseNsName(ipvsc.configMapName)
-	if err != nil {
-		glog.Fatalf("Error parsing configmap name: %v", err)
+		ipvsc.mapListers = append(ipvsc.mapListers, lister)
+		mapControllers = append(mapControllers, controller)
 	}
 
-	ipvsc.mapLister.Store, ipvsc.mapController = cache.NewInformer(
-		cache.NewListWatchFromClient(ipvsc.client.CoreV1().RESTClient(), "configmaps", cmns,
-			fields.OneTermEqualSelector(api.ObjectNameField, cmn)),
-		&apiv1.ConfigMap{}, resyncPeriod, mapEventHandler)
+	if cfg.ConfigMapSelector != "" {
+		lister := store.ConfigMapLister{}
+		var controller cache.Controller
+		lister.Store, controller = newNamespacedInformer(ipvsc.client.CoreV1().RESTClient(),
+			"configmaps", nil, cfg.ConfigMapSelector, &apiv1.ConfigMap{}, mapEventHandler)
+
+		ipvsc.mapListers = append(ipvsc.mapListers, lister)
+		mapControllers = append(mapControllers, controller)
+	}
+	ipvsc.mapController = mapControllers
+
+	if ipvsc.authSecretName != "" {
+		sns, sn, err := parseNsName(ipvsc.authSecretName)
+		if err != nil {
+			glog.Fatalf("Error parsing VRRP authentication secret name: %v", err)
+		}
+
+		ipvsc.authSecretLister.Store, ipvsc.authSecretController = cache.NewInformer(
+			cache.NewListWatchFromClient(ipvsc.client.CoreV1().RESTClient(), "secrets", sns,
+				fields.OneTermEqualSelector(api.ObjectNameField, sn)),
+			&apiv1.Secret{}, resyncPeriod, eventHandlers)
+	}
+
+	if ipvsc.vrrpConfigMapName != "" {
+		vns, vn, err := parseNsName(ipvsc.vrrpConfigMapName)
+		if err != nil {
+			glog.Fatalf("Error parsing VRRP configmap name: %v", err)
+		}
+
+		ipvsc.vrrpMapLister.Store, ipvsc.vrrpMapController = cache.NewInformer(
+			cache.NewListWatchFromClient(ipvsc.client.CoreV1().RESTClient(), "configmaps", vns,
+				fields.OneTermEqualSelector(api.ObjectNameField, vn)),
+			&apiv1.ConfigMap{}, resyncPeriod, eventHandlers)
+	}
+
+	if ipvsc.poolsConfigMapName != "" {
+		pns, pn, err := parseNsName(ipvsc.poolsConfigMapName)
+		if err != nil {
+			glog.Fatalf("Error parsing pools configmap name: %v", err)
+		}
+
+		ipvsc.poolsMapLister.Store, ipvsc.poolsMapController = cache.NewInformer(
+			cache.NewListWatchFromClient(ipvsc.client.CoreV1().RESTClient(), "configmaps", pns,
+				fields.OneTermEqualSelector(api.ObjectNameField, pn)),
+			&apiv1.ConfigMap{}, resyncPeriod, eventHandlers)
+
+		// the allocations are updated by all the nodes
+		ans, an := ipvsc.allocationsName()
+		ipvsc.allocMapLister.Store, ipvsc.allocMapController = cache.NewInformer(
+			cache.NewListWatchFromClient(ipvsc.client.CoreV1().RESTClient(), "configmaps", ans,
+				fields.OneTermEqualSelector(api.ObjectNameField, an)),
+			&apiv1.ConfigMap{}, resyncPeriod, eventHandlers)
+	}
+
+	if cfg.NodeMaintenance != "" && ipvsc.keepalived.vrrp {
+		ipvsc.keepalived.maintenanceMode = cfg.NodeMaintenance
+		if cfg.NodeMaintenance == trackPriority && ipvsc.vrrpConfigMapName == "" {
+			glog.Warningf("--node-maintenance=priority does not move the VIPs without preempt: all the VRRP instances use nopreempt without --vrrp-configmap")
+		}
+	}
+
+	// the addresses of the nodes are checked to detect VIP conflicts
+	ipvsc.nodeLister.Store, ipvsc.nodeController = cache.NewInformer(
+		cache.NewListWatchFromClient(ipvsc.client.CoreV1().RESTClient(), "nodes", apiv1.NamespaceAll, fields.Everything()),
+		&apiv1.Node{}, resyncPeriod, cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				ipvsc.syncQueue.Enqueue(obj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				ipvsc.syncQueue.Enqueue(obj)
+			},
+			UpdateFunc: func(old, cur interface{}) {
+				if nodeAddressesChanged(old.(*apiv1.Node), cur.(*apiv1.Node)) {
+					ipvsc.syncQueue.Enqueue(cur)
+				}
+			},
+		})
+
+	http.HandleFunc("/metrics", ipvsc.handleMetrics)
 
 	http.HandleFunc("/health", func(rw http.ResponseWriter, req *http.Request) {
 		err := ipvsc.keepalived.Healthy()
+		if err == nil && ipvsc.announcer != nil {
+			err = ipvsc.announcer.Healthy()
+		}
 		if err != nil {
 			glog.Errorf("Health check unsuccessful: %v", err)
 			http.Error(rw, fmt.Sprintf("keepalived not healthy: %v", err), 500)
@@ -470,18 +1270,18 @@ func NewIPVSController(kubeClient *kubernetes.Clientset, namespace string, useUn
 		fmt.Fprint(rw, "OK")
 	})
 
-	return &ipvsc
-}
+	http.HandleFunc("/status", func(rw http.ResponseWriter, req *http.Request) {
+		if ipvsc.splitBrainDetection {
+			if err := ipvsc.splitBrainError(); err != nil {
+				http.Error(rw, err.Error(), 500)
+				return
+			}
+		}
 
-func (ipvsc *ipvsControllerController) getConfigMap(ns, name string) (*apiv1.ConfigMap, error) {
-	s, exists, err := ipvsc.mapLister.Store.GetByKey(fmt.Sprintf("%v/%v", ns, name))
-	if err != nil {
-		return nil, err
-	}
-	if !exists {
-		return nil, fmt.Errorf("configmap %v was not found", name)
-	}
-	return s.(*apiv1.ConfigMap), nil
+		fmt.Fprint(rw, "OK")
+	})
+
+	return &ipvsc
 }
 
 func checksum(filename string) (string, error) {
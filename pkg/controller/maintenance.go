@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// maintenanceAnnotation in a node with the value "true" moves the VIPs
+	// to other nodes
+	maintenanceAnnotation = "kube-keepalived-vip/maintenance"
+	// handoffAnnotation is added to the node with the value "completed"
+	// when the node in maintenance does not hold the VIPs
+	handoffAnnotation = "kube-keepalived-vip/handoff"
+	handoffCompleted  = "completed"
+
+	// maintenanceFault is the reason used to force the FAULT state
+	maintenanceFault = "node maintenance"
+
+	// maintenanceFile contains 1 when the priority of the VRRP instance
+	// must be lowered by maintenanceWeight
+	maintenanceFile   = "/var/run/keepalived.maintenance"
+	maintenanceWeight = 50
+
+	maintenanceInterval = 2 * time.Second
+)
+
+// maintenanceReason returns the reason to move the VIPs away from the node
+// or an empty string if the node is not in maintenance
+func maintenanceReason(node *apiv1.Node) string {
+	if node.Annotations[maintenanceAnnotation] == "true" {
+		return "maintenance annotation"
+	}
+
+	if node.Spec.Unschedulable {
+		return "node cordoned"
+	}
+
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == apiv1.NodeReady && condition.Status != apiv1.ConditionTrue {
+			return "node not ready"
+		}
+	}
+
+	return ""
+}
+
+// SetMaintenance forces the FAULT state or lowers the priority of the VRRP
+// instance, depending on the maintenance mode
+func (k *keepalived) SetMaintenance(active bool) error {
+	if k.maintenanceMode == trackFault {
+		return k.SetFault(maintenanceFault, active)
+	}
+
+	return k.writeMaintenanceFile(active)
+}
+
+func (k *keepalived) writeMaintenanceFile(active bool) error {
+	value := "0"
+	if active {
+		value = "1"
+	}
+
+	return ioutil.WriteFile(maintenanceFile, []byte(value), 0644)
+}
+
+// checkNodeMaintenance moves the VIPs away from the node while it is
+// cordoned, not ready or annotated for maintenance, and reports in the
+// node when the handoff is completed
+func (ipvsc *ipvsControllerController) checkNodeMaintenance() {
+	obj, exists, err := ipvsc.nodeLister.Store.GetByKey(ipvsc.nodeName)
+	if err != nil || !exists {
+		glog.Warningf("node %v not found: %v", ipvsc.nodeName, err)
+		return
+	}
+
+	node := obj.(*apiv1.Node)
+	reason := maintenanceReason(node)
+
+	if reason != ipvsc.maintenanceReason {
+		if reason != "" {
+			msg := fmt.Sprintf("moving VIPs to other nodes: %v", reason)
+			glog.Info(msg)
+			ipvsc.recordEvent(apiv1.EventTypeNormal, "Maintenance", msg)
+		} else {
+			glog.Infof("node %v is not in maintenance", ipvsc.nodeName)
+		}
+
+		err := ipvsc.keepalived.SetMaintenance(reason != "")
+		if err != nil {
+			glog.Errorf("error changing VRRP priority for node maintenance: %v", err)
+			return
+		}
+
+		ipvsc.maintenanceReason = reason
+	}
+
+	handoff := ""
+	if reason != "" && !ipvsc.keepalived.isMaster(readVRRPStates()) {
+		handoff = handoffCompleted
+	}
+
+	if node.Annotations[handoffAnnotation] == handoff {
+		return
+	}
+
+	err = ipvsc.annotateNode(handoffAnnotation, handoff)
+	if err != nil {
+		glog.Warningf("error updating annotation %v of node %v: %v", handoffAnnotation, ipvsc.nodeName, err)
+		return
+	}
+
+	if handoff != "" {
+		msg := "the node does not hold VIPs, handoff completed"
+		glog.Info(msg)
+		ipvsc.recordEvent(apiv1.EventTypeNormal, "HandoffCompleted", msg)
+	}
+}
+
+// annotateNode changes an annotation of the node. An empty value removes it
+func (ipvsc *ipvsControllerController) annotateNode(name, value string) error {
+	patch, err := annotationPatch(name, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = ipvsc.client.CoreV1().Nodes().Patch(ipvsc.nodeName, types.MergePatchType, patch)
+	return err
+}
+
+// annotationPatch returns a JSON merge patch that changes an annotation.
+// A null value removes the annotation.
+func annotationPatch(name, value string) ([]byte, error) {
+	var annotation interface{}
+	if value != "" {
+		annotation = value
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{name: annotation},
+		},
+	})
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMaintenanceReason(t *testing.T) {
+	ready := []apiv1.NodeCondition{{Type: apiv1.NodeReady, Status: apiv1.ConditionTrue}}
+	notReady := []apiv1.NodeCondition{{Type: apiv1.NodeReady, Status: apiv1.ConditionUnknown}}
+
+	testcases := map[string]struct {
+		Node     apiv1.Node
+		Expected string
+	}{
+		"ready": {apiv1.Node{Status: apiv1.NodeStatus{Conditions: ready}}, ""},
+		"cordoned": {apiv1.Node{
+			Spec:   apiv1.NodeSpec{Unschedulable: true},
+			Status: apiv1.NodeStatus{Conditions: ready},
+		}, "node cordoned"},
+		"not ready": {apiv1.Node{Status: apiv1.NodeStatus{Conditions: notReady}}, "node not ready"},
+		"annotation": {apiv1.Node{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{maintenanceAnnotation: "true"}},
+			Status:     apiv1.NodeStatus{Conditions: ready},
+		}, "maintenance annotation"},
+		"annotation disabled": {apiv1.Node{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{maintenanceAnnotation: "false"}},
+			Status:     apiv1.NodeStatus{Conditions: ready},
+		}, ""},
+	}
+
+	for k, tc := range testcases {
+		reason := maintenanceReason(&tc.Node)
+		if reason != tc.Expected {
+			t.Errorf("%s: expected reason %q but returned %q", k, tc.Expected, reason)
+		}
+	}
+}
+
+func TestAnnotateNode(t *testing.T) {
+	client := fake.NewSimpleClientset(&apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}})
+	ipvsc := &ipvsControllerController{client: client, nodeName: "node-a"}
+
+	err := ipvsc.annotateNode(handoffAnnotation, handoffCompleted)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	node, _ := client.CoreV1().Nodes().Get("node-a", metav1.GetOptions{})
+	if node.Annotations[handoffAnnotation] != handoffCompleted {
+		t.Errorf("expected annotation %v but returned %v", handoffCompleted, node.Annotations)
+	}
+
+	patch, err := annotationPatch(handoffAnnotation, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `{"metadata":{"annotations":{"kube-keepalived-vip/handoff":null}}}`
+	if string(patch) != expected {
+		t.Errorf("expected patch %v but returned %s", expected, patch)
+	}
+}
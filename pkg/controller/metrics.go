@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// handleMetrics writes the metrics of the controller using the Prometheus
+// text format
+func (ipvsc *ipvsControllerController) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	states := readVRRPStates()
+	instances := []string{}
+	for instance := range states {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+
+	writeMetricHeader(rw, "keepalived_vip_vrrp_master", "Whether the VRRP instance is in MASTER state")
+	for _, instance := range instances {
+		fmt.Fprintf(rw, "keepalived_vip_vrrp_master{instance=%q} %v\n", instance, boolToInt(states[instance] == stateMaster))
+	}
+
+	ipvsc.splitBrainLock.Lock()
+	sb := ipvsc.splitBrain
+	ipvsc.splitBrainLock.Unlock()
+
+	vips := []string{}
+	for vip := range sb {
+		vips = append(vips, vip)
+	}
+	sort.Strings(vips)
+
+	writeMetricHeader(rw, "keepalived_vip_split_brain", "Whether more than one node holds a VIP")
+	fmt.Fprintf(rw, "keepalived_vip_split_brain %v\n", boolToInt(len(sb) > 0))
+
+	writeMetricHeader(rw, "keepalived_vip_split_brain_nodes", "Number of nodes holding a VIP held by more than one node")
+	for _, vip := range vips {
+		fmt.Fprintf(rw, "keepalived_vip_split_brain_nodes{vip=%q} %v\n", vip, len(sb[vip]))
+	}
+
+	duplicates := ipvsc.duplicateAddresses()
+	vips = []string{}
+	for vip := range duplicates {
+		vips = append(vips, vip)
+	}
+	sort.Strings(vips)
+
+	writeMetricHeader(rw, "keepalived_vip_duplicate_address", "Whether a VIP is held back because other host uses it")
+	for _, vip := range vips {
+		fmt.Fprintf(rw, "keepalived_vip_duplicate_address{vip=%q,mac=%q} 1\n", vip, duplicates[vip])
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v gauge\n", name)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+	api "k8s.io/kubernetes/pkg/apis/core"
+)
+
+const (
+	// secretSyncTimeout is the maximum time to wait for the first
+	// list of a secret referenced by a new tls entry
+	secretSyncTimeout = 5 * time.Second
+)
+
+// secretInformer watches a single secret
+type secretInformer struct {
+	store      cache.Store
+	controller cache.Controller
+	stopCh     chan struct{}
+}
+
+// secretInformers watches the secrets referenced by the tls entries of the
+// ConfigMaps. Each secret uses an informer restricted to its name, so the
+// controller only requires access to the secrets used by HAProxy.
+type secretInformers struct {
+	client  cache.Getter
+	handler cache.ResourceEventHandler
+
+	mu sync.Mutex
+	// informers contains the informer of each secret by namespace/name
+	informers map[string]*secretInformer
+	// used contains the secrets referenced since the last call to prune
+	used map[string]bool
+}
+
+func newSecretInformers(client cache.Getter, handler cache.ResourceEventHandler) *secretInformers {
+	return &secretInformers{
+		client:    client,
+		handler:   handler,
+		informers: map[string]*secretInformer{},
+		used:      map[string]bool{},
+	}
+}
+
+// get returns the secret with the given namespace/name, starting an
+// informer for the secret the first time it is referenced
+func (s *secretInformers) get(nsName string) (*apiv1.Secret, bool, error) {
+	ns, name, err := parseNsName(nsName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.mu.Lock()
+	informer, ok := s.informers[nsName]
+	if !ok {
+		informer = &secretInformer{stopCh: make(chan struct{})}
+		informer.store, informer.controller = cache.NewInformer(
+			cache.NewListWatchFromClient(s.client, "secrets", ns,
+				fields.OneTermEqualSelector(api.ObjectNameField, name)),
+			&apiv1.Secret{}, resyncPeriod, s.handler)
+		go informer.controller.Run(informer.stopCh)
+
+		glog.Infof("watching secret %v", nsName)
+		s.informers[nsName] = informer
+	}
+	s.used[nsName] = true
+	s.mu.Unlock()
+
+	if !informer.controller.HasSynced() {
+		timeout := make(chan struct{})
+		timer := time.AfterFunc(secretSyncTimeout, func() { close(timeout) })
+		synced := cache.WaitForCacheSync(timeout, informer.controller.HasSynced)
+		timer.Stop()
+		if !synced {
+			return nil, false, fmt.Errorf("timed out waiting for secret %v", nsName)
+		}
+	}
+
+	obj, exists, err := informer.store.GetByKey(nsName)
+	if err != nil || !exists {
+		return nil, exists, err
+	}
+
+	return obj.(*apiv1.Secret), true, nil
+}
+
+// prune stops the informers of the secrets not referenced since the
+// previous call
+func (s *secretInformers) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for nsName, informer := range s.informers {
+		if s.used[nsName] {
+			continue
+		}
+
+		glog.Infof("secret %v is not used anymore", nsName)
+		close(informer.stopCh)
+		delete(s.informers, nsName)
+	}
+
+	s.used = map[string]bool{}
+}
+
+// stop stops all the informers
+func (s *secretInformers) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for nsName, informer := range s.informers {
+		close(informer.stopCh)
+		delete(s.informers, nsName)
+	}
+}
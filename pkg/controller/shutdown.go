@@ -0,0 +1,261 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// shutdownFault is the reason used to release the VIPs before stopping
+	shutdownFault = "shutdown"
+
+	vrrpProtocol   = 112
+	vrrpAdvertType = 1
+
+	// keepalivedStopTimeout is the time to wait for the keepalived process
+	// to exit after SIGTERM
+	keepalivedStopTimeout = 5 * time.Second
+	httpShutdownTimeout   = 5 * time.Second
+)
+
+var (
+	vrrpMulticastGroup     = net.IPv4(224, 0, 0, 18)
+	vrrpMulticastGroupIPv6 = net.ParseIP("ff02::12")
+)
+
+// vrrpAdvert is a VRRP advertisement received during the handoff
+type vrrpAdvert struct {
+	Source   net.IP
+	VRID     int
+	Priority int
+}
+
+// parseVRRPAdvert returns the source address, the VRID and the priority of
+// a VRRP advertisement received in a raw socket (including the IP header)
+func parseVRRPAdvert(packet []byte) (net.IP, int, int, bool) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return nil, 0, 0, false
+	}
+
+	headerLen := int(packet[0]&0x0f) * 4
+	if headerLen < 20 || len(packet) < headerLen || packet[9] != vrrpProtocol {
+		return nil, 0, 0, false
+	}
+
+	vrid, priority, ok := parseVRRPHeader(packet[headerLen:])
+	if !ok {
+		return nil, 0, 0, false
+	}
+
+	return net.IP(packet[12:16]), vrid, priority, true
+}
+
+// parseVRRPHeader returns the VRID and the priority of a VRRP advertisement.
+// IPv6 raw sockets return the packet without the IP header.
+func parseVRRPHeader(vrrp []byte) (int, int, bool) {
+	if len(vrrp) < 8 || vrrp[0]&0x0f != vrrpAdvertType {
+		return 0, 0, false
+	}
+
+	return int(vrrp[1]), int(vrrp[2]), true
+}
+
+// Handoff forces the FAULT state of the VRRP instances, so keepalived sends
+// an advertisement with priority 0, and waits until other node becomes
+// MASTER of each instance where the node was MASTER (it sends adverts with
+// the VRID of the group) or the timeout expires.
+func (k *keepalived) Handoff(timeout time.Duration) {
+	if !k.vrrp || !k.isStarted() {
+		return
+	}
+
+	// groups where the node is MASTER by VRID
+	states := readVRRPStates()
+	pending := map[int]string{}
+	for _, group := range k.getGroups() {
+		if states[group.Name] == stateMaster {
+			pending[group.VRID] = group.Name
+		}
+	}
+
+	// the sockets are opened before the FAULT state to receive the first
+	// advertisement of the new MASTER
+	adverts := make(chan vrrpAdvert)
+	done := make(chan struct{})
+	defer close(done)
+
+	receiving := false
+	for _, ipv6 := range []bool{false, true} {
+		fd, err := k.openVRRPSocket(ipv6)
+		if err != nil {
+			glog.Warningf("error creating VRRP socket (IPv6 %v): %v", ipv6, err)
+			continue
+		}
+
+		go receiveVRRPAdverts(fd, ipv6, adverts, done)
+		receiving = true
+	}
+
+	glog.Info("releasing VIPs before shutdown")
+	err := k.SetFault(shutdownFault, true)
+	if err != nil {
+		glog.Errorf("error forcing VRRP FAULT state: %v", err)
+		return
+	}
+
+	if len(pending) == 0 || !receiving || timeout <= 0 {
+		return
+	}
+
+	glog.Infof("waiting up to %v for other nodes to become MASTER of %v", timeout, pendingGroups(pending))
+	expired := time.After(timeout)
+	for len(pending) > 0 {
+		select {
+		case advert := <-adverts:
+			name, ok := pending[advert.VRID]
+			if !ok || advert.Priority == 0 || advert.Source.String() == k.ip {
+				continue
+			}
+
+			glog.Infof("node %v is MASTER of VRRP instance %v", advert.Source, name)
+			delete(pending, advert.VRID)
+		case <-expired:
+			glog.Warningf("no other node became MASTER of %v after %v", pendingGroups(pending), timeout)
+			return
+		}
+	}
+
+	glog.Info("handoff completed")
+}
+
+// pendingGroups returns the sorted names of the groups without a new MASTER
+func pendingGroups(pending map[int]string) []string {
+	names := []string{}
+	for _, name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openVRRPSocket returns a raw socket receiving the VRRP adverts of the
+// family, joining the multicast group in the interfaces of the VRRP
+// instances. Unicast adverts do not require the multicast group.
+func (k *keepalived) openVRRPSocket(ipv6 bool) (int, error) {
+	family := unix.AF_INET
+	if ipv6 {
+		family = unix.AF_INET6
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_RAW, vrrpProtocol)
+	if err != nil {
+		return -1, err
+	}
+
+	for _, name := range k.vrrpInterfaces() {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+
+		if ipv6 {
+			mreq := &unix.IPv6Mreq{Interface: uint32(iface.Index)}
+			copy(mreq.Multiaddr[:], vrrpMulticastGroupIPv6)
+			err = unix.SetsockoptIPv6Mreq(fd, unix.IPPROTO_IPV6, unix.IPV6_JOIN_GROUP, mreq)
+		} else {
+			mreq := &unix.IPMreqn{Ifindex: int32(iface.Index)}
+			copy(mreq.Multiaddr[:], vrrpMulticastGroup.To4())
+			err = unix.SetsockoptIPMreqn(fd, unix.IPPROTO_IP, unix.IP_ADD_MEMBERSHIP, mreq)
+		}
+		if err != nil {
+			glog.V(2).Infof("error joining VRRP multicast group in %v (IPv6 %v): %v", name, ipv6, err)
+		}
+	}
+
+	tv := unix.NsecToTimeval(int64(500 * time.Millisecond))
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+
+	return fd, nil
+}
+
+// receiveVRRPAdverts sends the adverts received in the socket to the
+// channel until done is closed. The socket is closed before returning.
+func receiveVRRPAdverts(fd int, ipv6 bool, adverts chan<- vrrpAdvert, done <-chan struct{}) {
+	defer unix.Close(fd)
+
+	buf := make([]byte, 1500)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			continue
+		}
+
+		var advert vrrpAdvert
+		var ok bool
+		if ipv6 {
+			sa, isIPv6 := from.(*unix.SockaddrInet6)
+			if !isIPv6 {
+				continue
+			}
+			advert.Source = net.IP(append([]byte{}, sa.Addr[:]...))
+			advert.VRID, advert.Priority, ok = parseVRRPHeader(buf[:n])
+		} else {
+			advert.Source, advert.VRID, advert.Priority, ok = parseVRRPAdvert(buf[:n])
+			advert.Source = append(net.IP{}, advert.Source...)
+		}
+		if !ok {
+			continue
+		}
+
+		select {
+		case adverts <- advert:
+		case <-done:
+			return
+		}
+	}
+}
+
+// stopHTTPServers stops the HTTP servers waiting for the active requests
+func (ipvsc *ipvsControllerController) stopHTTPServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+
+	for _, server := range []*http.Server{ipvsc.httpServer, ipvsc.webhookServer} {
+		if server == nil {
+			continue
+		}
+
+		err := server.Shutdown(ctx)
+		if err != nil {
+			glog.Warningf("error stopping HTTP server %v: %v", server.Addr, err)
+		}
+	}
+}
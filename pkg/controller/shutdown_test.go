@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVRRPAdvert(t *testing.T) {
+	header := []byte{
+		0x45, 0xc0, 0, 40, 0, 0, 0, 0, 255, vrrpProtocol, 0, 0,
+		10, 0, 0, 2, // source
+		224, 0, 0, 18, // destination
+	}
+
+	testcases := map[string]struct {
+		Packet   []byte
+		Source   string
+		VRID     int
+		Priority int
+		Valid    bool
+	}{
+		"advert":     {append(append([]byte{}, header...), 0x31, 50, 101, 1, 0, 1, 0, 0, 10, 0, 0, 10), "10.0.0.2", 50, 101, true},
+		"priority 0": {append(append([]byte{}, header...), 0x31, 50, 0, 1, 0, 1, 0, 0, 10, 0, 0, 10), "10.0.0.2", 50, 0, true},
+		"truncated":  {header[:16], "", 0, 0, false},
+		"no vrrp":    {header, "", 0, 0, false},
+		"other type": {append(append([]byte{}, header...), 0x32, 50, 101, 1, 0, 1, 0, 0), "", 0, 0, false},
+		"ipv6":       {append([]byte{0x60}, header[1:]...), "", 0, 0, false},
+	}
+
+	for k, tc := range testcases {
+		src, vrid, priority, ok := parseVRRPAdvert(tc.Packet)
+		if ok != tc.Valid {
+			t.Errorf("%s: expected valid %v but returned %v", k, tc.Valid, ok)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		if src.String() != tc.Source || vrid != tc.VRID || priority != tc.Priority {
+			t.Errorf("%s: expected %v/%v/%v but returned %v/%v/%v", k, tc.Source, tc.VRID, tc.Priority, src, vrid, priority)
+		}
+	}
+}
+
+func TestParseVRRPHeader(t *testing.T) {
+	testcases := map[string]struct {
+		Packet   []byte
+		VRID     int
+		Priority int
+		Valid    bool
+	}{
+		"vrrpv3 advert": {[]byte{0x31, 50, 101, 0, 0, 100, 0, 0}, 50, 101, true},
+		"truncated":     {[]byte{0x31, 50, 101}, 0, 0, false},
+		"other type":    {[]byte{0x32, 50, 101, 0, 0, 100, 0, 0}, 0, 0, false},
+	}
+
+	for k, tc := range testcases {
+		vrid, priority, ok := parseVRRPHeader(tc.Packet)
+		if ok != tc.Valid || vrid != tc.VRID || priority != tc.Priority {
+			t.Errorf("%s: expected %v/%v/%v but returned %v/%v/%v", k, tc.VRID, tc.Priority, tc.Valid, vrid, priority, ok)
+		}
+	}
+}
+
+func TestPendingGroups(t *testing.T) {
+	pending := map[int]string{52: "web", 50: "vips", 51: "db"}
+
+	expected := []string{"db", "vips", "web"}
+	if names := pendingGroups(pending); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v but returned %v", expected, names)
+	}
+}
@@ -0,0 +1,381 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// vridLabel groups the leases of the nodes using the same VRID
+	vridLabel = "kube-keepalived-vip/vrid"
+	// vrrpStatusAnnotation contains the VRRP state of the node (vrrpStatus)
+	vrrpStatusAnnotation = "kube-keepalived-vip/vrrp-status"
+
+	leaseDuration      = 15 * time.Second
+	splitBrainInterval = 5 * time.Second
+
+	stateMaster = "MASTER"
+
+	// splitBrainFault is the reason used to step down from MASTER
+	splitBrainFault = "split brain"
+)
+
+// vrrpStatus is the VRRP state of one node
+type vrrpStatus struct {
+	Node     string `json:"node"`
+	Priority int    `json:"priority"`
+	// Instances contains the state of each VRRP instance
+	Instances map[string]string `json:"instances"`
+	// VIPs contains the addresses held by the node (MASTER)
+	VIPs []string `json:"vips"`
+}
+
+// splitBrain contains the VIPs claimed by more than one node
+type splitBrain map[string][]string
+
+// readVRRPStates returns the state of each VRRP instance written by the
+// notify script (keepalived-check.sh)
+func readVRRPStates() map[string]string {
+	states := map[string]string{}
+
+	files, err := filepath.Glob("/var/run/keepalived.*.state")
+	if err != nil {
+		return states
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		instance := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "keepalived."), ".state")
+		states[instance] = strings.TrimSpace(string(b))
+	}
+
+	return states
+}
+
+// localVRRPStatus returns the VRRP state of this node
+func (ipvsc *ipvsControllerController) localVRRPStatus() vrrpStatus {
+	_, priority := ipvsc.keepalived.vrrpState("vips")
+	status := vrrpStatus{
+		Node:      ipvsc.nodeName,
+		Priority:  priority + ipvsc.keepalived.localityBoost,
+		Instances: readVRRPStates(),
+		VIPs:      []string{},
+	}
+
+	status.VIPs = append(status.VIPs, ipvsc.keepalived.masterVIPs(status.Instances)...)
+
+	return status
+}
+
+// isMaster returns true if the VRRP instance of at least one group is MASTER
+func (k *keepalived) isMaster(states map[string]string) bool {
+	return len(k.masterVIPs(states)) > 0
+}
+
+func (ipvsc *ipvsControllerController) leaseName() string {
+	return fmt.Sprintf("kube-keepalived-vip-%v-%v", ipvsc.keepalived.vrid, ipvsc.nodeName)
+}
+
+// updateLease records the VRRP state of the node in a Lease
+func (ipvsc *ipvsControllerController) updateLease(status vrrpStatus) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	leases := ipvsc.client.CoordinationV1().Leases(ipvsc.podNamespace)
+
+	lease, err := leases.Get(ipvsc.leaseName(), metav1.GetOptions{})
+	create := errors.IsNotFound(err)
+	if create {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ipvsc.leaseName(),
+				Namespace: ipvsc.podNamespace,
+			},
+		}
+	} else if err != nil {
+		return err
+	}
+
+	holder := ipvsc.nodeName
+	duration := int32(leaseDuration / time.Second)
+	now := metav1.NewMicroTime(time.Now())
+
+	if lease.Labels == nil {
+		lease.Labels = map[string]string{}
+	}
+	lease.Labels[vridLabel] = fmt.Sprintf("%v", ipvsc.keepalived.vrid)
+
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+	lease.Annotations[vrrpStatusAnnotation] = string(b)
+
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+
+	if create {
+		_, err = leases.Create(lease)
+	} else {
+		_, err = leases.Update(lease)
+	}
+
+	return err
+}
+
+// listVRRPStatus returns the VRRP state of the nodes with a valid lease
+func (ipvsc *ipvsControllerController) listVRRPStatus() ([]vrrpStatus, error) {
+	selector := labels.SelectorFromSet(labels.Set{
+		vridLabel: fmt.Sprintf("%v", ipvsc.keepalived.vrid),
+	})
+
+	leases, err := ipvsc.client.CoordinationV1().Leases(ipvsc.podNamespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []vrrpStatus{}
+	for _, lease := range leases.Items {
+		if isLeaseExpired(&lease, time.Now()) {
+			continue
+		}
+
+		status := vrrpStatus{}
+		err := json.Unmarshal([]byte(lease.Annotations[vrrpStatusAnnotation]), &status)
+		if err != nil {
+			glog.Warningf("invalid VRRP status in lease %v: %v", lease.Name, err)
+			continue
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func isLeaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	return lease.Spec.RenewTime.Add(duration).Before(now)
+}
+
+// findSplitBrain returns the VIPs held by more than one node
+func findSplitBrain(statuses []vrrpStatus) splitBrain {
+	holders := map[string][]string{}
+	for _, status := range statuses {
+		for _, vip := range status.VIPs {
+			holders[vip] = appendIfMissing(holders[vip], status.Node)
+		}
+	}
+
+	sb := splitBrain{}
+	for vip, nodes := range holders {
+		if len(nodes) > 1 {
+			sort.Strings(nodes)
+			sb[vip] = nodes
+		}
+	}
+
+	return sb
+}
+
+// involves returns the VIPs of the split brain held by the node
+func (sb splitBrain) involves(node string) []string {
+	vips := []string{}
+	for vip, nodes := range sb {
+		if contains(nodes, node) {
+			vips = append(vips, vip)
+		}
+	}
+
+	sort.Strings(vips)
+	return vips
+}
+
+// preferredHolder returns the first node preferred over the local node
+// that holds one of the given VIPs. A node is preferred if it has a higher
+// priority or, with the same priority, a lower node name.
+func preferredHolder(local vrrpStatus, vips []string, statuses []vrrpStatus) string {
+	for _, status := range statuses {
+		if status.Node == local.Node || status.Priority < local.Priority {
+			continue
+		}
+		if status.Priority == local.Priority && status.Node > local.Node {
+			continue
+		}
+
+		for _, vip := range status.VIPs {
+			if contains(vips, vip) {
+				return status.Node
+			}
+		}
+	}
+
+	return ""
+}
+
+// checkSplitBrain publishes the VRRP state of the node and compares it with
+// the state of the other nodes
+func (ipvsc *ipvsControllerController) checkSplitBrain() {
+	local := ipvsc.localVRRPStatus()
+
+	err := ipvsc.updateLease(local)
+	if err != nil {
+		glog.Warningf("error updating VRRP status lease: %v", err)
+		return
+	}
+
+	statuses, err := ipvsc.listVRRPStatus()
+	if err != nil {
+		glog.Warningf("error listing VRRP status leases: %v", err)
+		return
+	}
+
+	sb := findSplitBrain(statuses)
+
+	peers := map[string]bool{}
+	for _, status := range statuses {
+		if status.Node == local.Node {
+			continue
+		}
+
+		for _, vip := range status.VIPs {
+			peers[normalizeIP(vip)] = true
+		}
+	}
+
+	ipvsc.splitBrainLock.Lock()
+	previous := ipvsc.splitBrain
+	ipvsc.splitBrain = sb
+	ipvsc.peerMasters = peers
+	ipvsc.splitBrainLock.Unlock()
+
+	for vip, nodes := range sb {
+		if fmt.Sprintf("%v", previous[vip]) == fmt.Sprintf("%v", nodes) {
+			continue
+		}
+
+		msg := fmt.Sprintf("VIP %v is held by more than one node: %v", vip, strings.Join(nodes, ", "))
+		glog.Warning(msg)
+		ipvsc.recordEvent(apiv1.EventTypeWarning, "SplitBrain", msg)
+	}
+
+	if !ipvsc.splitBrainStepDown {
+		return
+	}
+
+	// the node steps down when a preferred node holds the same VIPs and
+	// stays in FAULT state while that node is the MASTER
+	held := sb.involves(local.Node)
+	if ipvsc.steppedDown {
+		held = ipvsc.keepalived.vips
+	}
+
+	holder := preferredHolder(local, held, statuses)
+	stepDown := holder != "" && (ipvsc.steppedDown || len(sb.involves(local.Node)) > 0)
+
+	if stepDown && !ipvsc.steppedDown {
+		msg := fmt.Sprintf("stepping down from MASTER, node %v is preferred (priority or name)", holder)
+		glog.Warning(msg)
+		ipvsc.recordEvent(apiv1.EventTypeWarning, "SplitBrainStepDown", msg)
+	}
+
+	err = ipvsc.keepalived.SetFault(splitBrainFault, stepDown)
+	if err != nil {
+		glog.Errorf("error changing VRRP FAULT state: %v", err)
+		return
+	}
+
+	ipvsc.steppedDown = stepDown
+}
+
+// splitBrainError returns an error if the node holds a VIP also held by
+// other node. It is reported in /status, not in the liveness check, to
+// avoid restarting all the nodes holding the VIP.
+func (ipvsc *ipvsControllerController) splitBrainError() error {
+	ipvsc.splitBrainLock.Lock()
+	defer ipvsc.splitBrainLock.Unlock()
+
+	vips := ipvsc.splitBrain.involves(ipvsc.nodeName)
+	if len(vips) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("split brain detected, VIPs held by more than one node: %v", strings.Join(vips, ", "))
+}
+
+// recordEvent creates an event in the pod running the controller
+func (ipvsc *ipvsControllerController) recordEvent(eventType, reason, msg string) {
+	ipvsc.recordEventFor(apiv1.ObjectReference{
+		Kind:      "Pod",
+		Namespace: ipvsc.podNamespace,
+		Name:      ipvsc.podName,
+	}, eventType, reason, msg)
+}
+
+// recordEventFor creates an event in an object
+func (ipvsc *ipvsControllerController) recordEventFor(obj apiv1.ObjectReference, eventType, reason, msg string) {
+	now := metav1.Now()
+	event := &apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: obj.Name + ".",
+			Namespace:    obj.Namespace,
+		},
+		InvolvedObject: obj,
+		Reason:         reason,
+		Message:        msg,
+		Type:           eventType,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Source: apiv1.EventSource{
+			Component: "kube-keepalived-vip",
+			Host:      ipvsc.nodeName,
+		},
+	}
+
+	_, err := ipvsc.client.CoreV1().Events(obj.Namespace).Create(event)
+	if err != nil {
+		glog.Warningf("error creating event %v: %v", reason, err)
+	}
+}
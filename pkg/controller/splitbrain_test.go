@@ -0,0 +1,140 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFindSplitBrain(t *testing.T) {
+	statuses := []vrrpStatus{
+		{Node: "node1", Priority: 100, VIPs: []string{"10.4.0.50", "10.4.0.51"}},
+		{Node: "node2", Priority: 101, VIPs: []string{"10.4.0.50"}},
+		{Node: "node3", Priority: 102, VIPs: []string{}},
+	}
+
+	sb := findSplitBrain(statuses)
+	expected := splitBrain{"10.4.0.50": {"node1", "node2"}}
+	if !reflect.DeepEqual(sb, expected) {
+		t.Errorf("expected %v but returned %v", expected, sb)
+	}
+
+	if vips := sb.involves("node1"); !reflect.DeepEqual(vips, []string{"10.4.0.50"}) {
+		t.Errorf("expected node1 to be involved in the split brain but returned %v", vips)
+	}
+
+	if vips := sb.involves("node3"); len(vips) != 0 {
+		t.Errorf("expected node3 not to be involved in the split brain but returned %v", vips)
+	}
+
+	if holder := preferredHolder(statuses[0], []string{"10.4.0.50"}, statuses); holder != "node2" {
+		t.Errorf("expected node2 as higher priority holder but returned %v", holder)
+	}
+
+	if holder := preferredHolder(statuses[1], []string{"10.4.0.50"}, statuses); holder != "" {
+		t.Errorf("expected no higher priority holder but returned %v", holder)
+	}
+}
+
+func TestPreferredHolderSamePriority(t *testing.T) {
+	statuses := []vrrpStatus{
+		{Node: "node1", Priority: 100, VIPs: []string{"10.4.0.50"}},
+		{Node: "node2", Priority: 100, VIPs: []string{"10.4.0.50"}},
+	}
+
+	// only the node with the higher name steps down
+	if holder := preferredHolder(statuses[1], []string{"10.4.0.50"}, statuses); holder != "node1" {
+		t.Errorf("expected node1 as preferred holder but returned %v", holder)
+	}
+
+	if holder := preferredHolder(statuses[0], []string{"10.4.0.50"}, statuses); holder != "" {
+		t.Errorf("expected no preferred holder but returned %v", holder)
+	}
+}
+
+func TestIsLeaseExpired(t *testing.T) {
+	now := time.Now()
+	duration := int32(15)
+	renew := metav1.NewMicroTime(now.Add(-10 * time.Second))
+	old := metav1.NewMicroTime(now.Add(-20 * time.Second))
+
+	testcases := map[string]struct {
+		Spec    coordinationv1.LeaseSpec
+		Expired bool
+	}{
+		"valid":    {coordinationv1.LeaseSpec{RenewTime: &renew, LeaseDurationSeconds: &duration}, false},
+		"expired":  {coordinationv1.LeaseSpec{RenewTime: &old, LeaseDurationSeconds: &duration}, true},
+		"no renew": {coordinationv1.LeaseSpec{LeaseDurationSeconds: &duration}, true},
+	}
+
+	for k, tc := range testcases {
+		expired := isLeaseExpired(&coordinationv1.Lease{Spec: tc.Spec}, now)
+		if expired != tc.Expired {
+			t.Errorf("%s: expected %v but returned %v", k, tc.Expired, expired)
+		}
+	}
+}
+
+func TestVRRPStatusLease(t *testing.T) {
+	ipvsc := &ipvsControllerController{
+		client:       fake.NewSimpleClientset(),
+		podNamespace: "kube-system",
+		nodeName:     "node1",
+		keepalived:   &keepalived{vrid: 50},
+	}
+
+	status := vrrpStatus{
+		Node:      "node1",
+		Priority:  100,
+		Instances: map[string]string{"vips": stateMaster},
+		VIPs:      []string{"10.4.0.50"},
+	}
+
+	// the first update creates the lease and the second one renews it
+	for i := 0; i < 2; i++ {
+		err := ipvsc.updateLease(status)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	statuses, err := ipvsc.listVRRPStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(statuses, []vrrpStatus{status}) {
+		t.Errorf("expected %v but returned %v", []vrrpStatus{status}, statuses)
+	}
+
+	// leases of other VRIDs are ignored
+	ipvsc.keepalived.vrid = 51
+	statuses, err = ipvsc.listVRRPStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(statuses) != 0 {
+		t.Errorf("expected no status but returned %v", statuses)
+	}
+}
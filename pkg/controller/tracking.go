@@ -0,0 +1,323 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	// trackFault forces the FAULT state when the VIP has no healthy backends
+	trackFault = "fault"
+	// trackPriority lowers the priority when the VIP has no healthy backends
+	trackPriority = "priority"
+
+	defaultTrackWeight = 50
+
+	trackInterval = 2 * time.Second
+
+	ipvsProcFile = "/proc/net/ip_vs"
+)
+
+// backendTrack is a VIP that changes the state of the VRRP instance when
+// none of its backends is healthy
+type backendTrack struct {
+	VIP string
+	// Mode is fault or priority
+	Mode string
+	// Weight is subtracted from the priority in priority mode
+	Weight int
+}
+
+// Name returns the name of the keepalived track file of the VIP
+func (t backendTrack) Name() string {
+	return "backends_" + strings.NewReplacer(".", "_", ":", "_").Replace(t.VIP)
+}
+
+// File returns the path of the file read by keepalived
+func (t backendTrack) File() string {
+	return fmt.Sprintf("/var/run/keepalived.%v", t.Name())
+}
+
+// KeepalivedWeight returns the weight of the track file. A weight of zero
+// forces the FAULT state when the file contains a value different than zero.
+func (t backendTrack) KeepalivedWeight() int {
+	if t.Mode == trackFault {
+		return 0
+	}
+
+	return -t.Weight
+}
+
+// getBackendTracks returns the VIPs of the services ConfigMap that track
+// the health of their backends, sorted by VIP
+func getBackendTracks(cfgMap *apiv1.ConfigMap) []backendTrack {
+	tracks := []backendTrack{}
+	for externalIP, value := range cfgMap.Data {
+		if value == "" {
+			continue
+		}
+
+		cfg, err := parseVIPConfig(value)
+		if err != nil || cfg.TrackBackends == "" {
+			continue
+		}
+
+		weight := cfg.TrackWeight
+		if weight == 0 {
+			weight = defaultTrackWeight
+		}
+
+		tracks = append(tracks, backendTrack{
+			VIP:    externalIP,
+			Mode:   cfg.TrackBackends,
+			Weight: weight,
+		})
+	}
+
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].VIP < tracks[j].VIP
+	})
+
+	return tracks
+}
+
+// parseIPVSDestinations returns the number of destinations with a weight
+// greater than zero of the virtual services of each VIP, using the content
+// of /proc/net/ip_vs. keepalived removes the real servers failing the checks.
+func parseIPVSDestinations(r io.Reader) (map[string]int, error) {
+	destinations := map[string]int{}
+	current := ""
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "TCP", "UDP", "SCTP":
+			ip, err := parseIPVSAddress(fields[1])
+			if err != nil {
+				return nil, err
+			}
+
+			current = ip
+			if _, ok := destinations[current]; !ok {
+				destinations[current] = 0
+			}
+		case "FWM":
+			current = ""
+		case "->":
+			if current == "" || len(fields) < 4 {
+				continue
+			}
+
+			weight, err := strconv.Atoi(fields[3])
+			if err == nil && weight > 0 {
+				destinations[current]++
+			}
+		}
+	}
+
+	return destinations, scanner.Err()
+}
+
+// parseIPVSAddress returns the IP address of an address with the format
+// used in /proc/net/ip_vs (0A00000A:0050 or [2001:0db8:...:0001]:0050)
+func parseIPVSAddress(addr string) (string, error) {
+	idx := strings.LastIndex(addr, ":")
+	if idx == -1 {
+		return "", fmt.Errorf("invalid IPVS address %v", addr)
+	}
+
+	host := addr[:idx]
+	if strings.HasPrefix(host, "[") {
+		ip := net.ParseIP(strings.Trim(host, "[]"))
+		if ip == nil {
+			return "", fmt.Errorf("invalid IPVS address %v", addr)
+		}
+		return ip.String(), nil
+	}
+
+	b, err := hex.DecodeString(host)
+	if err != nil || len(b) != net.IPv4len {
+		return "", fmt.Errorf("invalid IPVS address %v", addr)
+	}
+
+	return net.IP(b).String(), nil
+}
+
+// parseHAProxyBackendStatus returns true for each backend with at least one
+// server UP, using the output of the runtime API command show stat
+func parseHAProxyBackendStatus(stat string) map[string]bool {
+	status := map[string]bool{}
+	for _, line := range strings.Split(stat, "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) < 18 || fields[1] != "BACKEND" {
+			continue
+		}
+
+		status[fields[0]] = strings.HasPrefix(fields[17], "UP")
+	}
+
+	return status
+}
+
+// vipHealthy returns false if all the checks of the backends of the VIP are
+// failing. Missing information about the checks (the configuration was not
+// applied yet) is considered healthy. A VIP without endpoints is also
+// considered healthy: the endpoints are the same in all the nodes, so none
+// of them can serve the VIP and demoting the node only moves the other VIPs.
+func vipHealthy(ip string, svcs []vip, proxyMode bool, destinations map[string]int, backends map[string]bool) bool {
+	endpoints := false
+	names := []string{}
+	for _, svc := range svcs {
+		if svc.IP != ip || svc.LVSMethod == "VIP" {
+			continue
+		}
+
+		if hasBackends(svc) {
+			endpoints = true
+		}
+
+		if len(svc.Routes) == 0 {
+			names = append(names, haproxyBackendName(svc))
+		}
+		for _, r := range svc.Routes {
+			names = append(names, r.Backend)
+		}
+	}
+
+	if !endpoints {
+		return true
+	}
+
+	if !proxyMode {
+		count, ok := destinations[ip]
+		return !ok || count > 0
+	}
+
+	found := false
+	for _, name := range names {
+		up, ok := backends[name]
+		if !ok {
+			continue
+		}
+		if up {
+			return true
+		}
+		found = true
+	}
+
+	return !found
+}
+
+// updateBackendTracks writes the track file of each VIP that tracks the
+// health of its backends. keepalived reads the files without a reload.
+func (k *keepalived) updateBackendTracks() {
+	k.trackLock.Lock()
+	defer k.trackLock.Unlock()
+
+	if len(k.tracks) == 0 {
+		return
+	}
+
+	var destinations map[string]int
+	var backends map[string]bool
+	if k.proxyMode {
+		stat, err := k.haproxy.runtimeCommand("show stat")
+		if err != nil {
+			glog.V(2).Infof("error reading HAProxy status: %v", err)
+		}
+		backends = parseHAProxyBackendStatus(stat)
+	} else {
+		f, err := os.Open(ipvsProcFile)
+		if err == nil {
+			destinations, err = parseIPVSDestinations(f)
+			f.Close()
+		}
+		if err != nil {
+			glog.V(2).Infof("error reading IPVS status: %v", err)
+		}
+	}
+
+	for _, track := range k.tracks {
+		down := !vipHealthy(track.VIP, k.svcs, k.proxyMode, destinations, backends)
+		previous, known := k.trackDown[track.VIP]
+		if known && previous == down {
+			continue
+		}
+
+		value := "0"
+		if down {
+			value = "1"
+			glog.Warningf("VIP %v has no healthy backends (track mode %v)", track.VIP, track.Mode)
+		} else if known {
+			glog.Infof("VIP %v has healthy backends again", track.VIP)
+		}
+
+		err := ioutil.WriteFile(track.File(), []byte(value), 0644)
+		if err != nil {
+			glog.Errorf("error writing %v: %v", track.File(), err)
+			continue
+		}
+
+		k.trackDown[track.VIP] = down
+	}
+}
+
+// setBackendTracks changes the VIPs that track the health of their backends
+func (k *keepalived) setBackendTracks(tracks []backendTrack) {
+	k.trackLock.Lock()
+	defer k.trackLock.Unlock()
+
+	current := map[string]bool{}
+	for _, track := range tracks {
+		current[track.VIP] = true
+	}
+
+	if k.trackDown == nil {
+		k.trackDown = map[string]bool{}
+	}
+	for ip := range k.trackDown {
+		if !current[ip] {
+			delete(k.trackDown, ip)
+		}
+	}
+
+	k.tracks = tracks
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const ipvsContent = `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP  0A00000A:0050 wlc persistent 1800
+  -> AC100001:1F90      Masq    1      0          0
+  -> AC100002:1F90      Masq    0      0          0
+TCP  0A00000B:0050 wlc persistent 1800
+  -> AC100001:1F90      Masq    0      0          0
+FWM  00000001 wlc
+  -> AC100003:1F90      Masq    1      0          0
+TCP  [2001:0db8:0000:0000:0000:0000:0000:0001]:0050 wlc
+  -> [2001:0db8:0000:0000:0000:0000:0000:0002]:1F90      Masq    1      0          0
+`
+
+func TestParseIPVSDestinations(t *testing.T) {
+	destinations, err := parseIPVSDestinations(strings.NewReader(ipvsContent))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]int{"10.0.0.10": 1, "10.0.0.11": 0, "2001:db8::1": 1}
+	if !reflect.DeepEqual(destinations, expected) {
+		t.Errorf("expected %v but returned %v", expected, destinations)
+	}
+
+	_, err = parseIPVSDestinations(strings.NewReader("TCP  0A0000:0050 wlc\n"))
+	if err == nil {
+		t.Errorf("expected an error parsing an invalid address")
+	}
+}
+
+func TestParseHAProxyBackendStatus(t *testing.T) {
+	stat := `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status,weight
+default-echoheaders-80,server1,0,0,0,0,,0,0,0,,0,,0,0,0,0,DOWN,1
+default-echoheaders-80,BACKEND,0,0,0,0,,0,0,0,,0,,0,0,0,0,DOWN,0
+default-other-8080,server1,0,0,0,0,,0,0,0,,0,,0,0,0,0,UP,1
+default-other-8080,BACKEND,0,0,0,0,,0,0,0,,0,,0,0,0,0,UP,1
+`
+	expected := map[string]bool{"default-echoheaders-80": false, "default-other-8080": true}
+	status := parseHAProxyBackendStatus(stat)
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("expected %v but returned %v", expected, status)
+	}
+}
+
+func TestVIPHealthy(t *testing.T) {
+	svcs := []vip{
+		{Name: "default-echoheaders", IP: "10.0.0.10", Port: 80, Backends: []service{{IP: "172.16.0.1", Port: 8080}}},
+		{Name: "default-other", IP: "10.0.0.11", Port: 80, Backends: []service{{IP: "172.16.0.2", Port: 8080}}},
+		{IP: "10.0.0.12", LVSMethod: "VIP"},
+		{Name: "default-empty", IP: "10.0.0.14", Port: 80},
+	}
+
+	destinations := map[string]int{"10.0.0.10": 1, "10.0.0.11": 0}
+	backends := map[string]bool{"default-echoheaders-80": true, "default-other-80": false}
+
+	testcases := map[string]struct {
+		VIP       string
+		ProxyMode bool
+		Expected  bool
+	}{
+		"real servers":         {"10.0.0.10", false, true},
+		"failing real servers": {"10.0.0.11", false, false},
+		"only VIP":             {"10.0.0.12", false, true},
+		"no endpoints":         {"10.0.0.14", false, true},
+		"no endpoints proxy":   {"10.0.0.14", true, true},
+		"haproxy backend up":   {"10.0.0.10", true, true},
+		"haproxy backend down": {"10.0.0.11", true, false},
+		"unknown VIP":          {"10.0.0.13", false, true},
+	}
+
+	for k, tc := range testcases {
+		healthy := vipHealthy(tc.VIP, svcs, tc.ProxyMode, destinations, backends)
+		if healthy != tc.Expected {
+			t.Errorf("%s: expected %v but returned %v", k, tc.Expected, healthy)
+		}
+	}
+
+	// the checks of a new virtual server are not available yet
+	if !vipHealthy("10.0.0.10", svcs, false, map[string]int{}, nil) {
+		t.Errorf("expected a VIP without IPVS information to be healthy")
+	}
+}
+
+func TestGetBackendTracks(t *testing.T) {
+	cfgMap := &apiv1.ConfigMap{Data: map[string]string{
+		"10.0.0.12": "service: default/other\ntrackBackends: fault",
+		"10.0.0.11": "service: default/echoheaders\ntrackBackends: priority",
+		"10.0.0.10": "default/echoheaders:NAT",
+		"10.0.0.13": "",
+	}}
+
+	expected := []backendTrack{
+		{VIP: "10.0.0.11", Mode: trackPriority, Weight: defaultTrackWeight},
+		{VIP: "10.0.0.12", Mode: trackFault, Weight: defaultTrackWeight},
+	}
+
+	tracks := getBackendTracks(cfgMap)
+	if !reflect.DeepEqual(tracks, expected) {
+		t.Errorf("expected %v but returned %v", expected, tracks)
+	}
+
+	if tracks[0].KeepalivedWeight() != -defaultTrackWeight || tracks[1].KeepalivedWeight() != 0 {
+		t.Errorf("unexpected keepalived weights %v and %v", tracks[0].KeepalivedWeight(), tracks[1].KeepalivedWeight())
+	}
+
+	if tracks[0].Name() != "backends_10_0_0_11" {
+		t.Errorf("unexpected track name %v", tracks[0].Name())
+	}
+}
@@ -25,19 +25,18 @@ import (
 
 	"github.com/golang/glog"
 
+	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/aledbf/kube-keepalived-vip/pkg/k8s"
 )
 
 var (
-	invalidIfaces = []string{"lo", "docker0", "flannel.1", "cbr0"}
-	nsSvcLbRegex  = regexp.MustCompile(`(.*)/(.*):(.*)|(.*)/(.*)`)
-	vethRegex     = regexp.MustCompile(`^veth.*`)
-	caliRegex     = regexp.MustCompile(`^cali.*`)
-	lvsRegex      = regexp.MustCompile(`NAT|DR|PROXY`)
+	nsSvcLbRegex = regexp.MustCompile(`(.*)/(.*):(.*)|(.*)/(.*)`)
+	lvsRegex     = regexp.MustCompile(`NAT|DR|PROXY`)
 )
 
 type nodeInfo struct {
@@ -46,12 +45,34 @@ type nodeInfo struct {
 	netmask int
 }
 
-// getNetworkInfo returns information of the node where the pod is running
-func getNetworkInfo(ip string) (*nodeInfo, error) {
+// getNetworkInfo returns information of the node where the pod is running.
+// If no interface has the IP address the interface of the default route is
+// used, unless the address is required. The node IP address is kept because
+// it identifies the node in the priorities and the neighbors of the VRRP
+// instance.
+func getNetworkInfo(ip string, required bool) (*nodeInfo, error) {
 	iface, mask, err := interfaceByIP(ip)
-	if err != nil {
+	if err != nil && required {
 		return nil, err
 	}
+	if err != nil {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid node IP address %q", ip)
+		}
+
+		routeIface, routeErr := defaultRouteInterface()
+		if routeErr != nil {
+			return nil, fmt.Errorf("%v and the interface of the default route was not found: %v", err, routeErr)
+		}
+
+		ipMasks, routeErr := ipsByInterface(routeIface)
+		if routeErr != nil || len(ipMasks) == 0 {
+			return nil, fmt.Errorf("%v and the interface of the default route %v has no IPv4 address", err, routeIface)
+		}
+
+		glog.Warningf("%v, using the interface of the default route %v with the node address %v", err, routeIface, ip)
+		iface, mask = routeIface, ipMasks[0].mask
+	}
 	return &nodeInfo{
 		iface:   iface,
 		ip:      ip,
@@ -60,7 +81,8 @@ func getNetworkInfo(ip string) (*nodeInfo, error) {
 }
 
 // netInterfaces returns a slice containing the local network interfaces
-// excluding lo, docker0, flannel.1 and veth interfaces.
+// excluding the interfaces matching the exclusion patterns and the ports of
+// bonds and bridges.
 func netInterfaces() ([]net.Interface, error) {
 	validIfaces := []net.Interface{}
 	ifaces, err := net.Interfaces()
@@ -70,9 +92,7 @@ func netInterfaces() ([]net.Interface, error) {
 	}
 
 	for _, iface := range ifaces {
-		if !vethRegex.MatchString(iface.Name) &&
-			!caliRegex.MatchString(iface.Name) &&
-			stringSlice(invalidIfaces).pos(iface.Name) == -1 {
+		if !isExcludedInterface(iface.Name) && !isEnslaved(iface.Name) {
 			validIfaces = append(validIfaces, iface)
 		}
 	}
@@ -150,7 +170,8 @@ func (slice stringSlice) pos(value string) int {
 }
 
 // getClusterNodesIP returns the IP address of each node in the kubernetes cluster
-func getClusterNodesIP(kubeClient *kubernetes.Clientset, nodeSelector string) (clusterNodes []string) {
+// selected by the node address policy
+func getClusterNodesIP(kubeClient kubernetes.Interface, nodeSelector string, policy *k8s.NodeAddressPolicy) (clusterNodes []string) {
 	listOpts := metav1.ListOptions{}
 
 	if nodeSelector != "" {
@@ -166,8 +187,12 @@ func getClusterNodesIP(kubeClient *kubernetes.Clientset, nodeSelector string) (c
 		glog.Fatalf("Error getting running nodes: %v", err)
 	}
 
-	for _, nodo := range nodes.Items {
-		nodeIP := k8s.GetNodeIP(kubeClient, nodo.Name)
+	for i := range nodes.Items {
+		nodeIP := k8s.NodeAddress(&nodes.Items[i], policy)
+		if nodeIP == "" {
+			glog.Warningf("node %v has no address selected by the node address policy %v", nodes.Items[i].Name, policy)
+			continue
+		}
 		clusterNodes = append(clusterNodes, nodeIP)
 	}
 	sort.Strings(clusterNodes)
@@ -239,6 +264,33 @@ func parseNsSvcLVS(input string) (string, string, string, error) {
 	return ns, svc, kind, nil
 }
 
+// findServicePort returns the port of a service matching a port number or
+// name. If the port is empty the first port of the service is returned.
+func findServicePort(svc *apiv1.Service, port intstr.IntOrString) (*apiv1.ServicePort, error) {
+	if len(svc.Spec.Ports) == 0 {
+		return nil, fmt.Errorf("service %v/%v does not define ports", svc.Namespace, svc.Name)
+	}
+
+	if port.Type == intstr.Int && port.IntVal == 0 {
+		return &svc.Spec.Ports[0], nil
+	}
+
+	for i, servicePort := range svc.Spec.Ports {
+		switch port.Type {
+		case intstr.Int:
+			if int(servicePort.Port) == port.IntValue() {
+				return &svc.Spec.Ports[i], nil
+			}
+		case intstr.String:
+			if servicePort.Name == port.StrVal {
+				return &svc.Spec.Ports[i], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("service %v/%v does not contain port %v", svc.Namespace, svc.Name, port.String())
+}
+
 type nodeSelector map[string]string
 
 func (ns nodeSelector) String() string {
@@ -253,3 +305,13 @@ func (ns nodeSelector) String() string {
 func parseNodeSelector(data map[string]string) string {
 	return nodeSelector(data).String()
 }
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
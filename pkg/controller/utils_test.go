@@ -17,7 +17,14 @@ limitations under the License.
 package controller
 
 import (
+	"reflect"
 	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/aledbf/kube-keepalived-vip/pkg/k8s"
 )
 
 func TestParseNsSvcLVS(t *testing.T) {
@@ -56,3 +63,44 @@ func TestParseNsSvcLVS(t *testing.T) {
 		}
 	}
 }
+
+func TestGetClusterNodesIP(t *testing.T) {
+	node := func(name, internal, external string) *apiv1.Node {
+		return &apiv1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status: apiv1.NodeStatus{
+				Addresses: []apiv1.NodeAddress{
+					{Type: apiv1.NodeInternalIP, Address: internal},
+					{Type: apiv1.NodeExternalIP, Address: external},
+				},
+			},
+		}
+	}
+
+	client := fake.NewSimpleClientset(
+		node("node-a", "10.0.0.2", "203.0.113.2"),
+		node("node-b", "10.0.0.1", "203.0.113.1"),
+		node("node-c", "10.1.0.1", ""),
+	)
+
+	testcases := map[string]struct {
+		Policy string
+		Nodes  []string
+	}{
+		"default":  {Policy: "", Nodes: []string{"10.1.0.1", "203.0.113.1", "203.0.113.2"}},
+		"internal": {Policy: "InternalIP", Nodes: []string{"10.0.0.1", "10.0.0.2", "10.1.0.1"}},
+		"cidr":     {Policy: "10.0.0.0/24", Nodes: []string{"10.0.0.1", "10.0.0.2"}},
+	}
+
+	for name, tc := range testcases {
+		policy, err := k8s.ParseNodeAddressPolicy(tc.Policy)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+
+		nodes := getClusterNodesIP(client, "", policy)
+		if !reflect.DeepEqual(nodes, tc.Nodes) {
+			t.Errorf("%v: expected %v but returned %v", name, tc.Nodes, nodes)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	apiv1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// defaultResendGARPRepeat is the number of gratuitous ARP sent by the
+	// controller after a MASTER transition
+	defaultResendGARPRepeat = 3
+
+	stateBackup = "BACKUP"
+
+	// maxPreemptDelay is the maximum preempt_delay (seconds) accepted by keepalived
+	maxPreemptDelay = 1000
+
+	// maxVRRPPriority is the highest priority of a node that is not the
+	// owner of the VIPs
+	maxVRRPPriority = 254
+)
+
+// vrrpInstanceConfig contains the settings of a VRRP instance. It is the
+// value of an entry of the VRRP ConfigMap, where the key is the name of
+// the instance. Empty values use the keepalived defaults.
+type vrrpInstanceConfig struct {
+	// GARPMasterDelay is the delay (seconds) of the second set of
+	// gratuitous ARP after the transition to MASTER
+	GARPMasterDelay *int `json:"garpMasterDelay,omitempty"`
+	// GARPMasterRepeat is the number of gratuitous ARP sent at once
+	GARPMasterRepeat *int `json:"garpMasterRepeat,omitempty"`
+	// GARPMasterRefresh is the interval (seconds) to send gratuitous ARP
+	// while MASTER. Zero disables it
+	GARPMasterRefresh       *int `json:"garpMasterRefresh,omitempty"`
+	GARPMasterRefreshRepeat *int `json:"garpMasterRefreshRepeat,omitempty"`
+	// GARPLowerPrioDelay and GARPLowerPrioRepeat control the gratuitous ARP
+	// sent when an advert with lower priority is received
+	GARPLowerPrioDelay  *int `json:"garpLowerPrioDelay,omitempty"`
+	GARPLowerPrioRepeat *int `json:"garpLowerPrioRepeat,omitempty"`
+	// LowerPrioNoAdvert avoids sending adverts after receiving one with
+	// lower priority
+	LowerPrioNoAdvert bool `json:"lowerPrioNoAdvert,omitempty"`
+
+	// ResendGARP makes the controller send gratuitous ARP (or unsolicited
+	// neighbor advertisements) for all the VIPs after a MASTER transition
+	ResendGARP       bool `json:"resendGARP,omitempty"`
+	ResendGARPRepeat *int `json:"resendGARPRepeat,omitempty"`
+
+	// State is the initial state of the instance (MASTER or BACKUP)
+	State string `json:"state,omitempty"`
+	// PrimaryNode is the name of the node that starts as MASTER with the
+	// highest priority, holding the VIPs unless it is down
+	PrimaryNode string `json:"primaryNode,omitempty"`
+	// Preempt allows a node with higher priority to take over the VIPs
+	// from the MASTER. By default the MASTER keeps the VIPs (nopreempt)
+	Preempt bool `json:"preempt,omitempty"`
+	// PreemptDelay is the time (seconds) to wait after the startup before
+	// preempting the MASTER
+	PreemptDelay *int `json:"preemptDelay,omitempty"`
+
+	// VRID is the virtual router ID of a VRRP group. The group vips uses
+	// the flag --vrid
+	VRID *int `json:"vrid,omitempty"`
+	// Interface is the network interface of the instance or a CIDR of an
+	// address of the interface. Default --iface
+	Interface string `json:"interface,omitempty"`
+	// VLAN is the ID of a VLAN of the interface used by the instance. The
+	// controller creates the VLAN interface
+	VLAN *int `json:"vlan,omitempty"`
+	// UseVMAC makes keepalived use an interface with the virtual MAC
+	// address of the VRID (use_vmac) for the VIPs
+	UseVMAC bool `json:"useVMAC,omitempty"`
+}
+
+// validate checks the settings of a VRRP instance
+func (cfg *vrrpInstanceConfig) validate() error {
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"garpMasterDelay", cfg.GARPMasterDelay},
+		{"garpMasterRepeat", cfg.GARPMasterRepeat},
+		{"garpMasterRefresh", cfg.GARPMasterRefresh},
+		{"garpMasterRefreshRepeat", cfg.GARPMasterRefreshRepeat},
+		{"garpLowerPrioDelay", cfg.GARPLowerPrioDelay},
+		{"garpLowerPrioRepeat", cfg.GARPLowerPrioRepeat},
+		{"resendGARPRepeat", cfg.ResendGARPRepeat},
+		{"preemptDelay", cfg.PreemptDelay},
+	} {
+		if field.value != nil && *field.value < 0 {
+			return fmt.Errorf("%v must not be negative", field.name)
+		}
+	}
+
+	switch cfg.State {
+	case "", stateBackup:
+	case stateMaster:
+		if !cfg.Preempt {
+			return fmt.Errorf("state %v requires preempt", stateMaster)
+		}
+	default:
+		return fmt.Errorf("invalid state %v (MASTER or BACKUP)", cfg.State)
+	}
+
+	if cfg.PrimaryNode != "" && !cfg.Preempt {
+		return fmt.Errorf("primaryNode requires preempt")
+	}
+
+	if cfg.VRID != nil && (*cfg.VRID < 1 || *cfg.VRID > 255) {
+		return fmt.Errorf("invalid vrid %v (1-255)", *cfg.VRID)
+	}
+
+	if cfg.Interface != "" {
+		if err := validateInterface(cfg.Interface); err != nil {
+			return err
+		}
+	}
+
+	if cfg.VLAN != nil && (*cfg.VLAN < 1 || *cfg.VLAN > 4094) {
+		return fmt.Errorf("invalid vlan %v (1-4094)", *cfg.VLAN)
+	}
+
+	// keepalived creates the VMAC interface in the interface of the adverts,
+	// not in the VLAN interface of the VIPs
+	if cfg.VLAN != nil && cfg.UseVMAC {
+		return fmt.Errorf("vlan cannot be used with useVMAC")
+	}
+
+	if cfg.PreemptDelay != nil {
+		if !cfg.Preempt {
+			return fmt.Errorf("preemptDelay requires preempt")
+		}
+		if *cfg.PreemptDelay > maxPreemptDelay {
+			return fmt.Errorf("preemptDelay must not be greater than %v", maxPreemptDelay)
+		}
+	}
+
+	return nil
+}
+
+// parseVRRPInstances returns the configuration of each VRRP instance
+// contained in a ConfigMap
+func parseVRRPInstances(cfgMap *apiv1.ConfigMap) (map[string]*vrrpInstanceConfig, error) {
+	instances := map[string]*vrrpInstanceConfig{}
+
+	names := []string{}
+	for name := range cfgMap.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vrids := map[int]string{}
+	for _, name := range names {
+		cfg := &vrrpInstanceConfig{}
+		err := yaml.UnmarshalStrict([]byte(cfgMap.Data[name]), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration of VRRP instance %v: %v", name, err)
+		}
+
+		err = cfg.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration of VRRP instance %v: %v", name, err)
+		}
+
+		if name == defaultGroup && cfg.VRID != nil {
+			return nil, fmt.Errorf("invalid configuration of VRRP instance %v: the vrid is set with --vrid", name)
+		}
+
+		if cfg.VRID != nil {
+			if other, ok := vrids[*cfg.VRID]; ok {
+				return nil, fmt.Errorf("invalid configuration of VRRP instance %v: vrid %v is used by %v", name, *cfg.VRID, other)
+			}
+			vrids[*cfg.VRID] = name
+		}
+
+		instances[name] = cfg
+	}
+
+	return instances, nil
+}
+
+// getVRRPInstances returns the configuration of the VRRP instances. In case
+// of errors the current configuration is used.
+func (ipvsc *ipvsControllerController) getVRRPInstances() map[string]*vrrpInstanceConfig {
+	current := ipvsc.keepalived.vrrpInstances
+	if ipvsc.vrrpConfigMapName == "" {
+		return current
+	}
+
+	obj, exists, err := ipvsc.vrrpMapLister.Store.GetByKey(ipvsc.vrrpConfigMapName)
+	if err != nil || !exists {
+		glog.Warningf("VRRP configmap %v not found: %v", ipvsc.vrrpConfigMapName, err)
+		return current
+	}
+
+	instances, err := parseVRRPInstances(obj.(*apiv1.ConfigMap))
+	if err != nil {
+		glog.Warningf("%v", err)
+		return current
+	}
+
+	if ipvsc.keepalived.maintenanceMode == trackPriority && !reflect.DeepEqual(instances, current) {
+		if names := withoutPreempt(instances); len(names) > 0 {
+			glog.Warningf("--node-maintenance=priority does not move the VIPs of the VRRP instances without preempt: %v", strings.Join(names, ", "))
+		}
+	}
+
+	return instances
+}
+
+// withoutPreempt returns the sorted names of the VRRP instances using nopreempt
+func withoutPreempt(instances map[string]*vrrpInstanceConfig) []string {
+	names := []string{}
+	for name, cfg := range instances {
+		if !cfg.Preempt {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// vrrpState returns the initial state and the priority of a VRRP instance
+// in the node. The primary node of the instance uses a priority higher than
+// any other node, including the priority added by the local endpoints.
+func (k *keepalived) vrrpState(instance string) (string, int) {
+	cfg := k.vrrpInstances[instance]
+	if cfg == nil {
+		return stateBackup, k.priority
+	}
+
+	if cfg.PrimaryNode != "" && cfg.PrimaryNode == k.nodeName {
+		return stateMaster, k.primaryPriority()
+	}
+
+	if cfg.State != "" {
+		return cfg.State, k.priority
+	}
+
+	return stateBackup, k.priority
+}
+
+// primaryPriority returns the priority of the primary node of a VRRP
+// instance. The priority of the other nodes goes up to 99+len(nodes) plus
+// the locality boost, limited by keepalived to maxVRRPPriority.
+func (k *keepalived) primaryPriority() int {
+	priority := 100 + len(k.nodes)
+	if k.locality {
+		priority += maxLocalityBoost
+	}
+
+	if priority > maxVRRPPriority {
+		glog.Warningf("the priority of the primary node (%v) exceeds %v, other nodes can reach the same priority", priority, maxVRRPPriority)
+		return maxVRRPPriority
+	}
+
+	return priority
+}
+
+// watchVRRPState sends gratuitous ARP for the VIPs of a VRRP group when
+// its instance changes to MASTER and the instance is configured to do it
+func (ipvsc *ipvsControllerController) watchVRRPState() {
+	k := ipvsc.keepalived
+
+	states := readVRRPStates()
+	masters := map[string]bool{}
+	for _, group := range k.getGroups() {
+		if states[group.Name] != stateMaster {
+			continue
+		}
+
+		masters[group.Name] = true
+		if ipvsc.vrrpMasters[group.Name] {
+			continue
+		}
+
+		cfg := group.Config
+		if cfg == nil || !cfg.ResendGARP {
+			continue
+		}
+
+		repeat := defaultResendGARPRepeat
+		if cfg.ResendGARPRepeat != nil {
+			repeat = *cfg.ResendGARPRepeat
+		}
+
+		glog.Infof("VRRP instance %v is MASTER, sending gratuitous ARP for %v", group.Name, group.VIPs)
+		go sendGratuitousRepeat(group.Addresses, repeat)
+	}
+
+	ipvsc.vrrpMasters = masters
+}
+
+// sendGratuitousRepeat sends gratuitous ARP for the VIPs, one per second
+func sendGratuitousRepeat(addresses []vipAddress, repeat int) {
+	for i := 0; i < repeat; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+
+		for _, addr := range addresses {
+			err := sendGratuitous(addr.Interface, net.ParseIP(addr.IP))
+			if err != nil {
+				glog.Warningf("error sending gratuitous ARP for VIP %v: %v", addr.IP, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestParseVRRPInstances(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+
+	testcases := map[string]struct {
+		Data     map[string]string
+		Expected map[string]*vrrpInstanceConfig
+		Error    bool
+	}{
+		"valid": {
+			map[string]string{"vips": "garpMasterDelay: 5\ngarpMasterRefresh: 0\nlowerPrioNoAdvert: true\nresendGARP: true"},
+			map[string]*vrrpInstanceConfig{"vips": {
+				GARPMasterDelay:   intPtr(5),
+				GARPMasterRefresh: intPtr(0),
+				LowerPrioNoAdvert: true,
+				ResendGARP:        true,
+			}},
+			false,
+		},
+		"empty":         {map[string]string{"vips": ""}, map[string]*vrrpInstanceConfig{"vips": {}}, false},
+		"unknown field": {map[string]string{"vips": "garpDelay: 5"}, nil, true},
+		"negative":      {map[string]string{"vips": "garpMasterRepeat: -1"}, nil, true},
+		"invalid type":  {map[string]string{"vips": "garpMasterRepeat: many"}, nil, true},
+		"preempt delay": {
+			map[string]string{"vips": "preempt: true\npreemptDelay: 30\nstate: MASTER"},
+			map[string]*vrrpInstanceConfig{"vips": {Preempt: true, PreemptDelay: intPtr(30), State: "MASTER"}},
+			false,
+		},
+		"delay without preempt":   {map[string]string{"vips": "preemptDelay: 30"}, nil, true},
+		"delay too long":          {map[string]string{"vips": "preempt: true\npreemptDelay: 1001"}, nil, true},
+		"master without preempt":  {map[string]string{"vips": "state: MASTER"}, nil, true},
+		"primary without preempt": {map[string]string{"vips": "primaryNode: node-a"}, nil, true},
+		"invalid state":           {map[string]string{"vips": "state: FAULT"}, nil, true},
+		"group vrid":              {map[string]string{"public": "vrid: 80"}, map[string]*vrrpInstanceConfig{"public": {VRID: intPtr(80)}}, false},
+		"invalid vrid":            {map[string]string{"public": "vrid: 256"}, nil, true},
+		"vrid of vips":            {map[string]string{"vips": "vrid: 80"}, nil, true},
+		"duplicate vrid":          {map[string]string{"public": "vrid: 80", "internal": "vrid: 80"}, nil, true},
+		"group interface":         {map[string]string{"public": "interface: eth1"}, map[string]*vrrpInstanceConfig{"public": {Interface: "eth1"}}, false},
+		"invalid interface":       {map[string]string{"public": "interface: 10.0.0.1"}, nil, true},
+		"group vlan":              {map[string]string{"public": "vlan: 100"}, map[string]*vrrpInstanceConfig{"public": {VLAN: intPtr(100)}}, false},
+		"group vmac":              {map[string]string{"public": "useVMAC: true"}, map[string]*vrrpInstanceConfig{"public": {UseVMAC: true}}, false},
+		"vlan and vmac":           {map[string]string{"public": "vlan: 100\nuseVMAC: true"}, nil, true},
+		"invalid vlan":            {map[string]string{"public": "vlan: 4095"}, nil, true},
+	}
+
+	for k, tc := range testcases {
+		instances, err := parseVRRPInstances(&apiv1.ConfigMap{Data: tc.Data})
+		if tc.Error {
+			if err == nil {
+				t.Errorf("%s: expected an error", k)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", k, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(instances, tc.Expected) {
+			t.Errorf("%s: expected %v but returned %v", k, tc.Expected, instances)
+		}
+	}
+}
+
+func TestVRRPState(t *testing.T) {
+	testcases := map[string]struct {
+		Config   *vrrpInstanceConfig
+		Node     string
+		Locality bool
+		State    string
+		Priority int
+	}{
+		"default":               {nil, "node-a", false, "BACKUP", 101},
+		"initial state":         {&vrrpInstanceConfig{State: "MASTER", Preempt: true}, "node-a", false, "MASTER", 101},
+		"primary node":          {&vrrpInstanceConfig{PrimaryNode: "node-a", Preempt: true}, "node-a", false, "MASTER", 103},
+		"primary node locality": {&vrrpInstanceConfig{PrimaryNode: "node-a", Preempt: true}, "node-a", true, "MASTER", 153},
+		"not primary node":      {&vrrpInstanceConfig{PrimaryNode: "node-b", Preempt: true}, "node-a", false, "BACKUP", 101},
+	}
+
+	for k, tc := range testcases {
+		ka := &keepalived{
+			nodeName:      tc.Node,
+			nodes:         []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			priority:      101,
+			locality:      tc.Locality,
+			vrrpInstances: map[string]*vrrpInstanceConfig{},
+		}
+		if tc.Config != nil {
+			ka.vrrpInstances["vips"] = tc.Config
+		}
+
+		state, priority := ka.vrrpState("vips")
+		if state != tc.State || priority != tc.Priority {
+			t.Errorf("%s: expected %v/%v but returned %v/%v", k, tc.State, tc.Priority, state, priority)
+		}
+	}
+}
+
+func TestWithoutPreempt(t *testing.T) {
+	instances := map[string]*vrrpInstanceConfig{
+		"web":  {},
+		"vips": {Preempt: true},
+		"db":   {State: "BACKUP"},
+	}
+
+	expected := []string{"db", "web"}
+	names := withoutPreempt(instances)
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v but returned %v", expected, names)
+	}
+}
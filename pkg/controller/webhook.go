@@ -0,0 +1,450 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	webhookPath = "/validate"
+)
+
+// newWebhookServer returns the HTTPS server used by the validating
+// admission webhook of the services ConfigMap.
+func (ipvsc *ipvsControllerController) newWebhookServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(webhookPath, ipvsc.handleValidate)
+
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", ipvsc.webhookPort),
+		Handler: mux,
+	}
+}
+
+// startWebhook starts the HTTPS server of the validating admission webhook
+func (ipvsc *ipvsControllerController) startWebhook() {
+	glog.Infof("Starting validating webhook on port %d", ipvsc.webhookPort)
+	err := ipvsc.webhookServer.ListenAndServeTLS(ipvsc.webhookCertFile, ipvsc.webhookKeyFile)
+	if err != nil && err != http.ErrServerClosed {
+		glog.Errorf("unexpected error in validating webhook: %v", err)
+	}
+}
+
+// handleValidate decodes an AdmissionReview request and rejects changes to
+// the services ConfigMap with invalid content.
+func (ipvsc *ipvsControllerController) handleValidate(rw http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("error reading request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	review := admissionv1beta1.AdmissionReview{}
+	err = json.Unmarshal(body, &review)
+	if err != nil || review.Request == nil {
+		http.Error(rw, fmt.Sprintf("invalid AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	review.Response = ipvsc.reviewConfigMap(review.Request)
+	review.Response.UID = review.Request.UID
+
+	b, err := json.Marshal(review)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("error encoding response: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(b)
+}
+
+// reviewConfigMap returns the admission response for a request. Only the
+// ConfigMaps used by the controller are validated, anything else is allowed.
+func (ipvsc *ipvsControllerController) reviewConfigMap(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	allowed := &admissionv1beta1.AdmissionResponse{Allowed: true}
+
+	if req.Kind.Kind != "ConfigMap" || req.Operation == admissionv1beta1.Delete {
+		return allowed
+	}
+
+	cfgMap := &apiv1.ConfigMap{}
+	err := json.Unmarshal(req.Object.Raw, cfgMap)
+	if err != nil {
+		if !contains(ipvsc.configMapNames, fmt.Sprintf("%v/%v", req.Namespace, req.Name)) {
+			return allowed
+		}
+
+		return &admissionv1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("invalid ConfigMap: %v", err),
+			},
+		}
+	}
+
+	// the object of the request may not contain the namespace or the name
+	if cfgMap.Namespace == "" {
+		cfgMap.Namespace = req.Namespace
+	}
+	if cfgMap.Name == "" {
+		cfgMap.Name = req.Name
+	}
+
+	if !ipvsc.isServicesConfigMap(cfgMap) {
+		return allowed
+	}
+
+	errs := ipvsc.validateConfigMap(cfgMap)
+	if len(errs) == 0 {
+		return allowed
+	}
+
+	msgs := []string{}
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	glog.Infof("rejecting changes to configmap %v: %v", configMapKey(cfgMap), msgs)
+	return &admissionv1beta1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: strings.Join(msgs, "; "),
+		},
+	}
+}
+
+// validateConfigMap checks the content of a services ConfigMap and returns
+// the list of problems found. Keys must be valid IP addresses not used by
+// any node and not repeated, and the referenced services must exist. When
+// pools are configured the addresses must be part of a pool and the keys
+// can be the name of an entry using a pool.
+func (ipvsc *ipvsControllerController) validateConfigMap(cfgMap *apiv1.ConfigMap) []error {
+	errs := []error{}
+
+	nodeIPs := ipvsc.getNodeAddresses()
+
+	keys := []string{}
+	for k := range cfgMap.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pools map[string]*ipPool
+	if ipvsc.poolsConfigMapName != "" {
+		pools = ipvsc.getIPPools()
+	}
+
+	seen := map[string]string{}
+	for _, externalIP := range keys {
+		ip := net.ParseIP(externalIP)
+		if ip == nil && pools == nil {
+			errs = append(errs, fmt.Errorf("%v is not a valid IP address", externalIP))
+			continue
+		}
+
+		if ip == nil {
+			err := validatePoolEntry(pools, cfgMap.Namespace, cfgMap.Data[externalIP])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("entry %v: %v", externalIP, err))
+				continue
+			}
+		} else {
+			if pools != nil {
+				err := checkPools(pools, ip, cfgMap.Namespace)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("VIP %v: %v", externalIP, err))
+				}
+			}
+
+			if other, ok := seen[ip.String()]; ok {
+				errs = append(errs, fmt.Errorf("VIP %v overlaps with %v", externalIP, other))
+			}
+			seen[ip.String()] = externalIP
+
+			if node, ok := nodeIPs[ip.String()]; ok {
+				errs = append(errs, fmt.Errorf("VIP %v is an address of node %v", externalIP, node))
+			}
+		}
+
+		value := cfgMap.Data[externalIP]
+		if value == "" {
+			continue
+		}
+
+		cfg, err := parseVIPConfig(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("VIP %v: %v", externalIP, err))
+			continue
+		}
+
+		if ip != nil {
+			if err := cfg.validateAddress(ip); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if ip != nil && pools != nil && cfg.Pool != "" {
+			if pool, ok := pools[cfg.Pool]; !ok || !pool.contains(ip) {
+				errs = append(errs, fmt.Errorf("VIP %v is not part of pool %v", externalIP, cfg.Pool))
+			}
+		}
+
+		if err := ipvsc.checkReferences(cfgMap, cfg); err != nil {
+			errs = append(errs, fmt.Errorf("VIP %v: %v", externalIP, err))
+		}
+
+		for _, nsSvc := range cfg.services() {
+			_, exists, err := ipvsc.svcLister.Store.GetByKey(nsSvc)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("VIP %v: error getting service %v: %v", externalIP, nsSvc, err))
+				continue
+			}
+
+			// the controller ignores the services outside the watched
+			// namespaces or not matching the selector
+			if !exists && ipvsc.watchesAllServices(nsSvc) {
+				errs = append(errs, fmt.Errorf("VIP %v: service %v not found", externalIP, nsSvc))
+			}
+		}
+
+		// named ports of the service cannot use the port of the sni rules
+		if cfg.Service != "" && len(cfg.SNI) > 0 {
+			obj, exists, _ := ipvsc.svcLister.Store.GetByKey(cfg.Service)
+			for _, port := range cfg.Ports {
+				if !exists {
+					break
+				}
+
+				servicePort, err := findServicePort(obj.(*apiv1.Service), port)
+				if err == nil && servicePort.Port == sniPort {
+					errs = append(errs, fmt.Errorf("VIP %v: port %v of service %v is used by the sni rules", externalIP, port.String(), cfg.Service))
+				}
+			}
+		}
+	}
+
+	return append(errs, ipvsc.checkConflicts(cfgMap)...)
+}
+
+// checkConflicts returns the VIPs and ports of the ConfigMap already used
+// by another services ConfigMap or allocated to an entry of another
+// ConfigMap, which the controller ignores when the ConfigMaps are merged
+func (ipvsc *ipvsControllerController) checkConflicts(cfgMap *apiv1.ConfigMap) []error {
+	errs := []error{}
+	key := configMapKey(cfgMap)
+
+	allocations := map[string]string{}
+	if ipvsc.poolsConfigMapName != "" {
+		allocCfgMap, _, err := ipvsc.getAllocations()
+		if err == nil {
+			allocations, err = parseAllocations(allocCfgMap)
+		}
+		if err != nil {
+			return []error{fmt.Errorf("error getting VIP allocations: %v", err)}
+		}
+	}
+
+	allocated := map[string]string{}
+	for owner, ip := range allocations {
+		allocated[normalizeIP(ip)] = owner
+	}
+
+	// a new ConfigMap is the newest one, so it cannot take the VIPs of the
+	// existing ConfigMaps
+	current := cfgMap.DeepCopy()
+	if current.CreationTimestamp.IsZero() {
+		current.CreationTimestamp = metav1.Now()
+	}
+
+	cfgMaps := []*apiv1.ConfigMap{current}
+	others, _ := ipvsc.getServicesConfigMaps()
+	for _, other := range others {
+		if configMapKey(other) != key {
+			cfgMaps = append(cfgMaps, other)
+		}
+	}
+	sortConfigMaps(cfgMaps)
+
+	sources := []configMapServices{}
+	for _, c := range cfgMaps {
+		keys := []string{}
+		for k := range c.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		source := configMapServices{Key: configMapKey(c)}
+		for _, k := range keys {
+			ip := k
+			if net.ParseIP(k) == nil {
+				ip = allocations[allocationOwner(c, k)]
+			} else if other, ok := allocated[normalizeIP(k)]; ok && other != allocationOwner(c, k) {
+				if c == current {
+					errs = append(errs, fmt.Errorf("VIP %v is allocated to %v", k, other))
+				}
+				continue
+			}
+
+			if ip == "" {
+				continue
+			}
+
+			for _, port := range ipvsc.entryPorts(c.Data[k]) {
+				svc := vip{IP: ip, Port: port}
+				if port == 0 {
+					svc.LVSMethod = "VIP"
+				}
+				source.VIPs = append(source.VIPs, svc)
+			}
+		}
+		sources = append(sources, source)
+	}
+
+	_, _, conflicts := mergeServices(sources)
+	for _, conflict := range conflicts {
+		if conflict.Loser == key {
+			errs = append(errs, fmt.Errorf("%v", conflict))
+		}
+	}
+
+	return errs
+}
+
+// entryPorts returns the ports used by the VIP of an entry, where zero
+// means all the ports (VIP only). It is an approximation of the services
+// built by the controller that does not require the endpoints.
+func (ipvsc *ipvsControllerController) entryPorts(value string) []int {
+	if value == "" {
+		return []int{0}
+	}
+
+	cfg, err := parseVIPConfig(value)
+	if err != nil {
+		return nil
+	}
+
+	ports := []int{}
+	if cfg.Mode == modeHTTP {
+		ports = append(ports, httpPort)
+		if len(cfg.TLS) > 0 {
+			ports = append(ports, httpsPort)
+		}
+	}
+	if len(cfg.SNI) > 0 {
+		ports = append(ports, sniPort)
+	}
+
+	if cfg.Service == "" {
+		return ports
+	}
+
+	obj, exists, err := ipvsc.svcLister.Store.GetByKey(cfg.Service)
+	if err != nil || !exists {
+		return ports
+	}
+
+	svc := obj.(*apiv1.Service)
+	servicePorts := svc.Spec.Ports
+	if len(cfg.Ports) > 0 {
+		servicePorts = []apiv1.ServicePort{}
+		for _, port := range cfg.Ports {
+			servicePort, err := findServicePort(svc, port)
+			if err == nil {
+				servicePorts = append(servicePorts, *servicePort)
+			}
+		}
+	}
+
+	for _, servicePort := range servicePorts {
+		if len(cfg.SNI) > 0 && servicePort.Port == sniPort {
+			continue
+		}
+		ports = append(ports, int(servicePort.Port))
+	}
+
+	return ports
+}
+
+// validatePoolEntry checks an entry that gets its VIP from a pool
+func validatePoolEntry(pools map[string]*ipPool, namespace, value string) error {
+	if !isStructuredValue(value) {
+		return fmt.Errorf("the key must be an IP address or the value must contain a pool")
+	}
+
+	cfg, err := parseVIPConfig(value)
+	if err != nil {
+		// reported with the other errors of the value
+		return nil
+	}
+
+	pool, ok := pools[cfg.Pool]
+	if !ok {
+		return fmt.Errorf("pool %q not found", cfg.Pool)
+	}
+
+	if !pool.allows(namespace) {
+		return fmt.Errorf("pool %v cannot be used in namespace %v", cfg.Pool, namespace)
+	}
+
+	return nil
+}
+
+// watchesAllServices returns true if the services lister contains all the
+// services of the namespace of a service (namespace/name), so a service not
+// found does not exist
+func (ipvsc *ipvsControllerController) watchesAllServices(nsSvc string) bool {
+	if ipvsc.serviceSelector != "" {
+		return false
+	}
+
+	ns, _, err := parseNsName(nsSvc)
+	if err != nil {
+		return false
+	}
+
+	return len(ipvsc.watchNamespaces) == 0 || contains(ipvsc.watchNamespaces, ns)
+}
+
+// getNodeAddresses returns the addresses of all the nodes in the cluster
+// mapped to the name of the node.
+func (ipvsc *ipvsControllerController) getNodeAddresses() map[string]string {
+	addresses := map[string]string{}
+	for _, obj := range ipvsc.nodeLister.Store.List() {
+		node := obj.(*apiv1.Node)
+		for _, address := range node.Status.Addresses {
+			ip := net.ParseIP(address.Address)
+			if ip == nil {
+				continue
+			}
+			addresses[ip.String()] = node.Name
+		}
+	}
+
+	return addresses
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/aledbf/kube-keepalived-vip/pkg/store"
+)
+
+func newWebhookTestController() *ipvsControllerController {
+	ipvsc := &ipvsControllerController{
+		client:         fake.NewSimpleClientset(),
+		configMapNames: []string{"default/vip-configmap"},
+	}
+	ipvsc.nodeLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	ipvsc.nodeLister.Store.Add(&apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Status: apiv1.NodeStatus{
+			Addresses: []apiv1.NodeAddress{
+				{Type: apiv1.NodeInternalIP, Address: "10.0.0.1"},
+			},
+		},
+	})
+	ipvsc.svcLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	ipvsc.svcLister.Store.Add(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "echoheaders"},
+		Spec: apiv1.ServiceSpec{
+			Ports: []apiv1.ServicePort{{Name: "http", Port: 80}, {Name: "https", Port: 443}},
+		},
+	})
+
+	return ipvsc
+}
+
+func TestValidateConfigMap(t *testing.T) {
+	testcases := map[string]struct {
+		Data   map[string]string
+		Errors int
+	}{
+		"valid":                  {map[string]string{"10.0.0.50": "default/echoheaders"}, 0},
+		"valid VIP only":         {map[string]string{"10.0.0.50": ""}, 0},
+		"invalid IP":             {map[string]string{"10.0.0.500": "default/echoheaders"}, 1},
+		"node IP":                {map[string]string{"10.0.0.1": "default/echoheaders"}, 1},
+		"invalid forward method": {map[string]string{"10.0.0.50": "default/echoheaders:AJAX"}, 1},
+		"missing service":        {map[string]string{"10.0.0.50": "default/missing"}, 1},
+		"overlapping VIPs":       {map[string]string{"fd00::1": "", "fd00:0::1": ""}, 1},
+		"ipv4 prefix":            {map[string]string{"10.0.0.50": "service: default/echoheaders\nprefix: 24"}, 0},
+		"invalid ipv4 prefix":    {map[string]string{"10.0.0.50": "service: default/echoheaders\nprefix: 64"}, 1},
+		"sni and service":        {map[string]string{"10.0.0.50": "service: default/echoheaders\nports: [http]\nsni:\n- service: default/echoheaders"}, 0},
+		"sni and https service":  {map[string]string{"10.0.0.50": "service: default/echoheaders\nports: [https]\nsni:\n- service: default/echoheaders"}, 1},
+	}
+
+	ipvsc := newWebhookTestController()
+	for k, tc := range testcases {
+		errs := ipvsc.validateConfigMap(&apiv1.ConfigMap{Data: tc.Data})
+		if len(errs) != tc.Errors {
+			t.Errorf("%s: expected %v errors but returned %v: %v", k, tc.Errors, len(errs), errs)
+		}
+	}
+}
+
+func TestValidateConfigMapWatchScope(t *testing.T) {
+	testcases := map[string]struct {
+		Namespaces []string
+		Selector   string
+		Service    string
+		Errors     int
+	}{
+		"missing service":          {Service: "default/missing", Errors: 1},
+		"missing in watched ns":    {Namespaces: []string{"default"}, Service: "default/missing", Errors: 1},
+		"service of unwatched ns":  {Namespaces: []string{"default"}, Service: "other/echoheaders", Errors: 0},
+		"service not in selector":  {Selector: "expose=true", Service: "default/missing", Errors: 0},
+		"existing with a selector": {Selector: "expose=true", Service: "default/echoheaders", Errors: 0},
+	}
+
+	for k, tc := range testcases {
+		ipvsc := newWebhookTestController()
+		ipvsc.watchNamespaces = tc.Namespaces
+		ipvsc.serviceSelector = tc.Selector
+
+		errs := ipvsc.validateConfigMap(&apiv1.ConfigMap{Data: map[string]string{"10.0.0.50": tc.Service}})
+		if len(errs) != tc.Errors {
+			t.Errorf("%s: expected %v errors but returned %v: %v", k, tc.Errors, len(errs), errs)
+		}
+	}
+}
+
+func TestReviewConfigMap(t *testing.T) {
+	testcases := map[string]struct {
+		Namespace string
+		Name      string
+		Raw       string
+		Allowed   bool
+	}{
+		"valid":         {"default", "vip-configmap", `{"data":{"10.0.0.50":"default/echoheaders"}}`, true},
+		"invalid":       {"default", "vip-configmap", `{"data":{"10.0.0.1":"default/echoheaders"}}`, false},
+		"other":         {"default", "other", `{"data":{"10.0.0.1":"default/echoheaders"}}`, true},
+		"invalid json":  {"default", "vip-configmap", `{"data":`, false},
+		"other ns":      {"kube-system", "vip-configmap", `{"data":{"invalid":""}}`, true},
+		"invalid value": {"default", "vip-configmap", `{"data":{"10.0.0.50":"echoheaders"}}`, false},
+	}
+
+	ipvsc := newWebhookTestController()
+	for k, tc := range testcases {
+		req := &admissionv1beta1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+			Namespace: tc.Namespace,
+			Name:      tc.Name,
+			Operation: admissionv1beta1.Update,
+		}
+		req.Object.Raw = []byte(tc.Raw)
+
+		resp := ipvsc.reviewConfigMap(req)
+		if resp.Allowed != tc.Allowed {
+			t.Errorf("%s: expected allowed %v but returned %v (%v)", k, tc.Allowed, resp.Allowed, resp.Result)
+		}
+	}
+}
+
+func TestValidateConfigMapPools(t *testing.T) {
+	testcases := map[string]struct {
+		Data   map[string]string
+		Errors int
+	}{
+		"address in pool":     {map[string]string{"10.0.0.50": "default/echoheaders"}, 0},
+		"address outside":     {map[string]string{"10.1.0.50": "default/echoheaders"}, 1},
+		"entry with pool":     {map[string]string{"web": "service: default/echoheaders\npool: public"}, 0},
+		"entry without pool":  {map[string]string{"web": "default/echoheaders"}, 1},
+		"entry missing pool":  {map[string]string{"web": "service: default/echoheaders\npool: other"}, 1},
+		"pool of other ns":    {map[string]string{"web": "service: default/echoheaders\npool: private"}, 1},
+		"entry missing svc":   {map[string]string{"web": "service: default/missing\npool: public"}, 1},
+		"address not in pool": {map[string]string{"10.0.0.50": "service: default/echoheaders\npool: private"}, 1},
+		"allocated address":   {map[string]string{"10.0.0.60": ""}, 1},
+		"allocated to entry":  {map[string]string{"web": "service: default/echoheaders\npool: public", "10.0.0.61": ""}, 1},
+	}
+
+	ipvsc := newWebhookTestController()
+	ipvsc.poolsConfigMapName = "kube-system/pools"
+	ipvsc.poolsMapLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	ipvsc.poolsMapLister.Store.Add(&apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "pools"},
+		Data: map[string]string{
+			"public":  "addresses: [10.0.0.0/24]",
+			"private": "addresses: [10.2.0.0/24]\nnamespaces: [team-b]",
+		},
+	})
+	ipvsc.allocMapLister.Store = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	ipvsc.allocMapLister.Store.Add(&apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "pools" + allocationsSuffix},
+		Data: map[string]string{
+			allocationsKey: `{"team-b/vips/web":"10.0.0.60","default/vip-configmap/web":"10.0.0.61"}`,
+		},
+	})
+
+	for k, tc := range testcases {
+		errs := ipvsc.validateConfigMap(&apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vip-configmap"},
+			Data:       tc.Data,
+		})
+		if len(errs) != tc.Errors {
+			t.Errorf("%s: expected %v errors but returned %v: %v", k, tc.Errors, len(errs), errs)
+		}
+	}
+}
+
+func TestValidateConfigMapConflicts(t *testing.T) {
+	testcases := map[string]struct {
+		Data   map[string]string
+		Errors int
+	}{
+		"free VIP":            {map[string]string{"10.0.0.60": ""}, 0},
+		"VIP only":            {map[string]string{"10.0.0.50": ""}, 1},
+		"same port":           {map[string]string{"10.0.0.50": "service: default/echoheaders\nports: [http]"}, 1},
+		"other port":          {map[string]string{"10.0.0.50": "service: default/echoheaders\nports: [https]"}, 0},
+		"VIP only of other":   {map[string]string{"10.0.0.51": "default/echoheaders"}, 2},
+		"http with tls":       {map[string]string{"10.0.0.52": "mode: http\ntls: [default/cert]\nrules:\n- service: default/echoheaders"}, 1},
+		"ipv6 representation": {map[string]string{"fd00::0:1": "service: default/echoheaders\nports: [http]"}, 1},
+	}
+
+	older := metav1.NewTime(time.Now().Add(-time.Hour))
+
+	ipvsc := newWebhookTestController()
+	ipvsc.configMapNames = []string{"default/vip-configmap", "team-a/vips"}
+	ipvsc.mapListers = []store.ConfigMapLister{{Store: cache.NewStore(cache.MetaNamespaceKeyFunc)}}
+	ipvsc.mapListers[0].Store.Add(&apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "vips", CreationTimestamp: older},
+		Data: map[string]string{
+			"10.0.0.50": "service: default/echoheaders\nports: [http]",
+			"10.0.0.51": "",
+			"10.0.0.52": "service: default/echoheaders\nports: [https]",
+			"fd00::1":   "",
+		},
+	})
+
+	for k, tc := range testcases {
+		errs := ipvsc.validateConfigMap(&apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vip-configmap"},
+			Data:       tc.Data,
+		})
+		if len(errs) != tc.Errors {
+			t.Errorf("%s: expected %v errors but returned %v: %v", k, tc.Errors, len(errs), errs)
+		}
+	}
+}
@@ -18,21 +18,110 @@ package k8s
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strings"
 
 	api "k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	clientset "k8s.io/client-go/kubernetes"
 )
 
+const annotationPolicyPrefix = "annotation:"
+
+// NodeAddressPolicy selects the address of a node: an address of a type
+// (InternalIP or ExternalIP), an address in a CIDR or the address in an
+// annotation of the node
+type NodeAddressPolicy struct {
+	Type       api.NodeAddressType
+	CIDR       *net.IPNet
+	Annotation string
+}
+
+// ParseNodeAddressPolicy parses a policy with the format InternalIP,
+// ExternalIP, a CIDR or annotation:<key>. An empty value returns nil.
+func ParseNodeAddressPolicy(value string) (*NodeAddressPolicy, error) {
+	switch {
+	case value == "":
+		return nil, nil
+	case value == string(api.NodeInternalIP) || value == string(api.NodeExternalIP):
+		return &NodeAddressPolicy{Type: api.NodeAddressType(value)}, nil
+	case strings.HasPrefix(value, annotationPolicyPrefix):
+		key := strings.TrimPrefix(value, annotationPolicyPrefix)
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid annotation %v: %v", key, strings.Join(errs, ", "))
+		}
+		return &NodeAddressPolicy{Annotation: key}, nil
+	}
+
+	_, cidr, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node address policy %v. Use InternalIP, ExternalIP, a CIDR or annotation:<key>", value)
+	}
+
+	return &NodeAddressPolicy{CIDR: cidr}, nil
+}
+
+func (p *NodeAddressPolicy) String() string {
+	switch {
+	case p == nil:
+		return "default"
+	case p.CIDR != nil:
+		return p.CIDR.String()
+	case p.Annotation != "":
+		return annotationPolicyPrefix + p.Annotation
+	}
+
+	return string(p.Type)
+}
+
+// NodeAddress returns the address of a node selected by the policy. A nil
+// policy prefers the ExternalIP over the InternalIP.
+func NodeAddress(node *api.Node, policy *NodeAddressPolicy) string {
+	if policy == nil {
+		return defaultNodeAddress(node)
+	}
+
+	if policy.Annotation != "" {
+		ip := net.ParseIP(node.Annotations[policy.Annotation])
+		if ip == nil {
+			return ""
+		}
+		return ip.String()
+	}
+
+	for _, address := range node.Status.Addresses {
+		ip := net.ParseIP(address.Address)
+		if ip == nil {
+			continue
+		}
+
+		if policy.CIDR != nil && policy.CIDR.Contains(ip) {
+			return address.Address
+		}
+
+		if policy.CIDR == nil && address.Type == policy.Type {
+			return address.Address
+		}
+	}
+
+	return ""
+}
+
 // GetNodeIP returns the IP address of a node in the cluster
 func GetNodeIP(kubeClient clientset.Interface, name string) string {
-	var externalIP string
 	node, err := kubeClient.CoreV1().Nodes().Get(name, meta_v1.GetOptions{})
 	if err != nil {
-		return externalIP
+		return ""
 	}
 
+	return defaultNodeAddress(node)
+}
+
+// defaultNodeAddress returns the ExternalIP of a node or the InternalIP
+func defaultNodeAddress(node *api.Node) string {
+	var externalIP string
 	for _, address := range node.Status.Addresses {
 		if address.Type == api.NodeExternalIP {
 			if address.Address != "" {
@@ -208,3 +208,74 @@ func TestGetPodDetails(t *testing.T) {
 		t.Errorf("expected a PodInfo but returned nil")
 	}
 }
+
+func TestParseNodeAddressPolicy(t *testing.T) {
+	testcases := map[string]struct {
+		Value  string
+		Policy string
+		Error  bool
+	}{
+		"default":            {Value: "", Policy: "default"},
+		"internal":           {Value: "InternalIP", Policy: "InternalIP"},
+		"external":           {Value: "ExternalIP", Policy: "ExternalIP"},
+		"cidr":               {Value: "10.0.0.0/24", Policy: "10.0.0.0/24"},
+		"annotation":         {Value: "annotation:example.com/vrrp-address", Policy: "annotation:example.com/vrrp-address"},
+		"invalid type":       {Value: "Hostname", Error: true},
+		"invalid annotation": {Value: "annotation:example.com/vrrp/address", Error: true},
+	}
+
+	for name, tc := range testcases {
+		policy, err := ParseNodeAddressPolicy(tc.Value)
+		if tc.Error {
+			if err == nil {
+				t.Errorf("%v: expected an error", name)
+			}
+			continue
+		}
+
+		if err != nil || policy.String() != tc.Policy {
+			t.Errorf("%v: expected %v but returned %v (%v)", name, tc.Policy, policy, err)
+		}
+	}
+}
+
+func TestNodeAddress(t *testing.T) {
+	node := &api.Node{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:        "demo",
+			Annotations: map[string]string{"example.com/vrrp-address": "192.168.10.2"},
+		},
+		Status: api.NodeStatus{
+			Addresses: []api.NodeAddress{
+				{Type: api.NodeHostName, Address: "demo"},
+				{Type: api.NodeInternalIP, Address: "10.0.0.1"},
+				{Type: api.NodeInternalIP, Address: "172.16.0.1"},
+				{Type: api.NodeExternalIP, Address: "203.0.113.1"},
+			},
+		},
+	}
+
+	testcases := map[string]struct {
+		Policy  string
+		Address string
+	}{
+		"default":            {Policy: "", Address: "203.0.113.1"},
+		"internal":           {Policy: "InternalIP", Address: "10.0.0.1"},
+		"external":           {Policy: "ExternalIP", Address: "203.0.113.1"},
+		"cidr":               {Policy: "172.16.0.0/16", Address: "172.16.0.1"},
+		"cidr not found":     {Policy: "192.168.0.0/16", Address: ""},
+		"annotation":         {Policy: "annotation:example.com/vrrp-address", Address: "192.168.10.2"},
+		"missing annotation": {Policy: "annotation:example.com/other", Address: ""},
+	}
+
+	for name, tc := range testcases {
+		policy, err := ParseNodeAddressPolicy(tc.Policy)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+
+		if address := NodeAddress(node, policy); address != tc.Address {
+			t.Errorf("%v: expected %v but returned %v", name, tc.Address, address)
+		}
+	}
+}
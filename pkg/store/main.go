@@ -38,6 +38,16 @@ type EndpointLister struct {
 	cache.Store
 }
 
+// SecretLister makes a Store that lists Secrets.
+type SecretLister struct {
+	cache.Store
+}
+
+// NodeLister makes a Store that lists Nodes.
+type NodeLister struct {
+	cache.Store
+}
+
 // GetServiceEndpoints returns the endpoints of a service, matched on service name.
 func (s *EndpointLister) GetServiceEndpoints(svc *api.Service) (ep api.Endpoints, err error) {
 	for _, m := range s.Store.List() {
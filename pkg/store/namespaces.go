@@ -0,0 +1,181 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NamespacedStore is a Store that contains the objects of the stores of
+// several namespaces, filled by one informer per namespace.
+type NamespacedStore struct {
+	stores map[string]cache.Store
+}
+
+// NewNamespacedStore returns a Store using the store of each namespace
+func NewNamespacedStore(stores map[string]cache.Store) *NamespacedStore {
+	return &NamespacedStore{stores: stores}
+}
+
+func (s *NamespacedStore) storeFor(obj interface{}) (cache.Store, error) {
+	if key, ok := obj.(cache.ExplicitKey); ok {
+		ns, _, err := cache.SplitMetaNamespaceKey(string(key))
+		if err != nil {
+			return nil, err
+		}
+		return s.namespace(ns)
+	}
+
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.namespace(m.GetNamespace())
+}
+
+func (s *NamespacedStore) namespace(ns string) (cache.Store, error) {
+	store, ok := s.stores[ns]
+	if !ok {
+		return nil, fmt.Errorf("namespace %v is not watched", ns)
+	}
+
+	return store, nil
+}
+
+// Add adds an object to the store of its namespace
+func (s *NamespacedStore) Add(obj interface{}) error {
+	store, err := s.storeFor(obj)
+	if err != nil {
+		return err
+	}
+	return store.Add(obj)
+}
+
+// Update updates an object in the store of its namespace
+func (s *NamespacedStore) Update(obj interface{}) error {
+	store, err := s.storeFor(obj)
+	if err != nil {
+		return err
+	}
+	return store.Update(obj)
+}
+
+// Delete removes an object from the store of its namespace
+func (s *NamespacedStore) Delete(obj interface{}) error {
+	store, err := s.storeFor(obj)
+	if err != nil {
+		return err
+	}
+	return store.Delete(obj)
+}
+
+// List returns the objects of all the namespaces
+func (s *NamespacedStore) List() []interface{} {
+	list := []interface{}{}
+	for _, ns := range s.namespaces() {
+		list = append(list, s.stores[ns].List()...)
+	}
+	return list
+}
+
+// ListKeys returns the keys of the objects of all the namespaces
+func (s *NamespacedStore) ListKeys() []string {
+	keys := []string{}
+	for _, ns := range s.namespaces() {
+		keys = append(keys, s.stores[ns].ListKeys()...)
+	}
+	return keys
+}
+
+// Get returns an object from the store of its namespace
+func (s *NamespacedStore) Get(obj interface{}) (interface{}, bool, error) {
+	store, err := s.storeFor(obj)
+	if err != nil {
+		return nil, false, nil
+	}
+	return store.Get(obj)
+}
+
+// GetByKey returns the object with the key namespace/name. Objects of
+// namespaces not watched do not exist
+func (s *NamespacedStore) GetByKey(key string) (interface{}, bool, error) {
+	ns, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	store, ok := s.stores[ns]
+	if !ok {
+		return nil, false, nil
+	}
+
+	return store.GetByKey(key)
+}
+
+// Replace replaces the content of the stores of the namespaces of the objects
+func (s *NamespacedStore) Replace(list []interface{}, resourceVersion string) error {
+	items := map[string][]interface{}{}
+	for ns := range s.stores {
+		items[ns] = []interface{}{}
+	}
+
+	for _, obj := range list {
+		m, err := meta.Accessor(obj)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := items[m.GetNamespace()]; !ok {
+			return fmt.Errorf("namespace %v is not watched", m.GetNamespace())
+		}
+		items[m.GetNamespace()] = append(items[m.GetNamespace()], obj)
+	}
+
+	for ns, store := range s.stores {
+		err := store.Replace(items[ns], resourceVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Resync resyncs the stores of all the namespaces
+func (s *NamespacedStore) Resync() error {
+	for _, ns := range s.namespaces() {
+		err := s.stores[ns].Resync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *NamespacedStore) namespaces() []string {
+	namespaces := []string{}
+	for ns := range s.stores {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
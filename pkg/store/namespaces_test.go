@@ -0,0 +1,76 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestNamespacedStore(t *testing.T) {
+	s := NewNamespacedStore(map[string]cache.Store{
+		"team-a": cache.NewStore(cache.MetaNamespaceKeyFunc),
+		"team-b": cache.NewStore(cache.MetaNamespaceKeyFunc),
+	})
+
+	svc := func(ns, name string) *api.Service {
+		return &api.Service{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+	}
+
+	for _, obj := range []*api.Service{svc("team-b", "web"), svc("team-a", "db")} {
+		err := s.Add(obj)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	err := s.Add(svc("team-c", "web"))
+	if err == nil {
+		t.Errorf("expected an error adding an object of a namespace not watched")
+	}
+
+	keys := s.ListKeys()
+	expected := []string{"team-a/db", "team-b/web"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v but returned %v", expected, keys)
+	}
+
+	_, exists, err := s.GetByKey("team-b/web")
+	if err != nil || !exists {
+		t.Errorf("expected team-b/web to exist: %v", err)
+	}
+
+	_, exists, err = s.GetByKey("team-c/web")
+	if err != nil || exists {
+		t.Errorf("expected team-c/web to not exist: %v", err)
+	}
+
+	err = s.Replace([]interface{}{svc("team-a", "cache")}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	keys = s.ListKeys()
+	expected = []string{"team-a/cache"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v after replace but returned %v", expected, keys)
+	}
+}
@@ -5,5 +5,7 @@ NAME="$2"
 STATE="$3"
 
 echo -n "${STATE}" > /var/run/keepalived.state
+# state of each VRRP instance
+echo -n "${STATE}" > "/var/run/keepalived.${NAME}.state"
 exit 0
 